@@ -2,7 +2,6 @@ package go_apario_identifier
 
 import (
 	`context`
-	`encoding/json`
 	`errors`
 	`log`
 	`net/url`
@@ -54,7 +53,7 @@ func (a *Assign) Unmarshal() any {
 	}
 	tempAny := reflect.New(tempAnyType).Interface()
 
-	err := json.Unmarshal(a.B, &tempAny)
+	err := DecodeRecord(a.B, tempAny)
 	if err != nil {
 		a.E = err
 		return nil
@@ -79,7 +78,7 @@ func (a *Assign) GetAnyError() (any, error) {
 	}
 	tempAny := reflect.New(tempAnyType).Interface()
 
-	err := json.Unmarshal(a.B, &tempAny)
+	err := DecodeRecord(a.B, tempAny)
 	if err != nil {
 		return nil, err
 	}
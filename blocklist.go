@@ -0,0 +1,137 @@
+package go_apario_identifier
+
+import (
+	`regexp`
+	`strings`
+	`sync`
+	`sync/atomic`
+)
+
+// DefaultBlockedWords are rejected anywhere inside of a randomly generated fragment. The list covers offensive words
+// (including common digit substitutions that base36 can produce) and words that are confusing in a public identifier.
+var DefaultBlockedWords = []string{
+	// offensive
+	"ANAL", "ANUS", "ARSE", "CHINK", "COCK", "COON", "CUM", "CUNT", "DICK", "DYKE", "FAG", "FCK", "FUCK", "FUK",
+	"JIZZ", "KIKE", "KKK", "NAZI", "NIGG", "PAKI", "PENIS", "PISS", "PORN", "PUSSY", "RAPE", "RETARD", "SEX",
+	"SHIT", "SLUT", "SPIC", "TITS", "TWAT", "WANK", "WHORE", "5HIT", "FVCK", "N1GG", "PR0N", "S3X", "SH1T",
+	// confusing
+	"ADMIN", "DEBUG", "ERROR", "FALSE", "NULL", "NONE", "ROOT", "TRUE", "UNDEFINED",
+}
+
+// DefaultBlockedPatterns are regular expressions rejected by the default blocklist. They are matched against the
+// uppercase token.
+var DefaultBlockedPatterns = []string{
+	`0O|O0|1I|I1`, // look-alike characters side by side are easily mistyped when read from a screen
+}
+
+// Blocklist is consulted by the random token generator and rejects any token that contains a blocked word or matches
+// a blocked pattern. Rejected tokens are regenerated and counted in the Blocklist's stats. The zero value blocks
+// nothing and is ready to use.
+type Blocklist struct {
+	mu       sync.RWMutex
+	words    []string
+	patterns []*regexp.Regexp
+	checked  atomic.Int64
+	rejected atomic.Int64
+}
+
+// BlocklistStats reports how many tokens a Blocklist has checked and how many of them it rejected
+type BlocklistStats struct {
+	Words    int   `json:"words"`
+	Patterns int   `json:"patterns"`
+	Checked  int64 `json:"checked"`
+	Rejected int64 `json:"rejected"`
+}
+
+var tokenBlocklist atomic.Pointer[Blocklist]
+
+func init() {
+	tokenBlocklist.Store(DefaultBlocklist())
+}
+
+// NewBlocklist returns a *Blocklist that rejects tokens containing any of words
+func NewBlocklist(words ...string) *Blocklist {
+	b := &Blocklist{}
+	b.AddWords(words...)
+	return b
+}
+
+// DefaultBlocklist returns a new *Blocklist built from DefaultBlockedWords and DefaultBlockedPatterns
+func DefaultBlocklist() *Blocklist {
+	b := NewBlocklist(DefaultBlockedWords...)
+	for _, expr := range DefaultBlockedPatterns {
+		b.patterns = append(b.patterns, regexp.MustCompile(expr))
+	}
+	return b
+}
+
+// TokenBlocklist returns the *Blocklist that is consulted when generating random tokens
+func TokenBlocklist() *Blocklist {
+	return tokenBlocklist.Load()
+}
+
+// SetTokenBlocklist replaces the *Blocklist consulted when generating random tokens; nil disables the blocklist
+func SetTokenBlocklist(b *Blocklist) {
+	if b == nil {
+		b = NewBlocklist()
+	}
+	tokenBlocklist.Store(b)
+}
+
+// AddWords adds words to the Blocklist; words are matched case-insensitively anywhere inside of a token
+func (b *Blocklist) AddWords(words ...string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, word := range words {
+		word = strings.ToUpper(strings.TrimSpace(word))
+		if len(word) == 0 {
+			continue
+		}
+		b.words = append(b.words, word)
+	}
+}
+
+// AddPattern compiles expr and adds it to the Blocklist; the pattern is matched against the uppercase token
+func (b *Blocklist) AddPattern(expr string) error {
+	pattern, compileErr := regexp.Compile(expr)
+	if compileErr != nil {
+		return compileErr
+	}
+	b.mu.Lock()
+	b.patterns = append(b.patterns, pattern)
+	b.mu.Unlock()
+	return nil
+}
+
+// Blocked returns true when token contains a blocked word or matches a blocked pattern and counts the rejection
+func (b *Blocklist) Blocked(token string) bool {
+	b.checked.Add(1)
+	token = strings.ToUpper(token)
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for _, word := range b.words {
+		if strings.Contains(token, word) {
+			b.rejected.Add(1)
+			return true
+		}
+	}
+	for _, pattern := range b.patterns {
+		if pattern.MatchString(token) {
+			b.rejected.Add(1)
+			return true
+		}
+	}
+	return false
+}
+
+// Stats returns the current BlocklistStats of the Blocklist
+func (b *Blocklist) Stats() BlocklistStats {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return BlocklistStats{
+		Words:    len(b.words),
+		Patterns: len(b.patterns),
+		Checked:  b.checked.Load(),
+		Rejected: b.rejected.Load(),
+	}
+}
@@ -0,0 +1,103 @@
+package go_apario_identifier
+
+import (
+	`strings`
+	`testing`
+	`time`
+)
+
+func TestBlocklist_Blocked(t *testing.T) {
+	b := DefaultBlocklist()
+	b.AddWords("apario")
+	patternErr := b.AddPattern(`^ZZ`)
+	if patternErr != nil {
+		t.Errorf("b.AddPattern() returned err %v", patternErr)
+		return
+	}
+	if b.AddPattern(`(`) == nil {
+		t.Errorf("expected b.AddPattern(`(`) to return an err")
+		return
+	}
+
+	tests := []struct {
+		token string
+		want  bool
+	}{
+		{token: "A1B2C3", want: false},
+		{token: "XSHITX", want: true},
+		{token: "xnullx", want: true},
+		{token: "APARIO", want: true},
+		{token: "ZZ1234", want: true},
+		{token: "AB0OCD", want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.token, func(t *testing.T) {
+			if got := b.Blocked(tt.token); got != tt.want {
+				t.Errorf("Blocked(%v) = %v, want %v", tt.token, got, tt.want)
+			}
+		})
+	}
+
+	stats := b.Stats()
+	if stats.Checked != int64(len(tests)) || stats.Rejected != 5 {
+		t.Errorf("expected %d checked and 5 rejected ; got %d checked and %d rejected", len(tests), stats.Checked, stats.Rejected)
+	}
+}
+
+func TestBlocklist_ZeroValue(t *testing.T) {
+	b := &Blocklist{}
+	if b.Blocked("XSHITX") {
+		t.Errorf("expected the zero value Blocklist to block nothing")
+		return
+	}
+	b.AddWords("apario")
+	patternErr := b.AddPattern(`^ZZ`)
+	if patternErr != nil {
+		t.Errorf("b.AddPattern() returned err %v", patternErr)
+		return
+	}
+	if !b.Blocked("XAPARIO") || !b.Blocked("ZZ1234") {
+		t.Errorf("expected the zero value Blocklist to block the words and patterns added to it")
+		return
+	}
+	stats := b.Stats()
+	if stats.Words != 1 || stats.Patterns != 1 || stats.Checked != 3 || stats.Rejected != 2 {
+		t.Errorf("expected 1 word, 1 pattern, 3 checked and 2 rejected ; got %+v", stats)
+	}
+}
+
+func TestSetTokenBlocklist(t *testing.T) {
+	previous := TokenBlocklist()
+	defer SetTokenBlocklist(previous)
+
+	// block every token that contains a digit so only letters can be generated
+	b := NewBlocklist()
+	patternErr := b.AddPattern(`[0-9]`)
+	if patternErr != nil {
+		t.Errorf("b.AddPattern() returned err %v", patternErr)
+		return
+	}
+	SetTokenBlocklist(b)
+
+	for i := 0; i < 33; i++ {
+		id, idErr := newToken(3, 17, time.Now().UTC().Year(), TokenBlocklist())
+		if idErr != nil {
+			t.Errorf("newToken(3, 17) returned err %v", idErr)
+			return
+		}
+		if strings.ContainsAny(id.Fragment.String(), "0123456789") {
+			t.Errorf("expected blocklist to reject %v", id.Fragment.String())
+			return
+		}
+	}
+	if b.Stats().Checked < 33 {
+		t.Errorf("expected newToken to consult the blocklist at least 33 times ; got %d", b.Stats().Checked)
+	}
+
+	// a blocklist that rejects everything must not loop forever
+	SetTokenBlocklist(NewBlocklist(strings.Split(IdentifierCharset, "")...))
+	_, expectErr := newToken(3, 17, time.Now().UTC().Year(), TokenBlocklist())
+	if expectErr == nil {
+		t.Errorf("expected newToken to give up when every token is blocked")
+	}
+}
@@ -9,22 +9,35 @@ import (
 	`log`
 	`os`
 	`path/filepath`
+	`reflect`
 	`strconv`
 	`strings`
 	`sync`
-	`sync/atomic`
 	`time`
 
 	sema `github.com/andreimerlescu/go-sema`
 )
 
 type Cache struct {
-	ctx        context.Context
-	Path       string                    `json:"-"`
-	Mutexes    map[string]*sync.RWMutex  `json:"-"`
-	Semaphores map[string]sema.Semaphore `json:"-"`
-	muMu       *sync.RWMutex
-	muSe       *sync.RWMutex
+	ctx         context.Context
+	Path        string                    `json:"-"`
+	Mutexes     map[string]*sync.RWMutex  `json:"-"`
+	Semaphores  map[string]sema.Semaphore `json:"-"`
+	LockTTL     time.Duration             `json:"-"` // lease of every lock acquired by the Cache ; defaults to DefaultLockTTL
+	Durability  Durability                `json:"-"` // how far writes go to survive a crash ; defaults to DurabilityFull
+	Codec       Codec                     `json:"-"` // how Stores encode records ; defaults to JSONCodec
+	Compression Compression               `json:"-"` // how Stores compress records ; defaults to NoCompression
+	Manifest    *Manifest                 `json:"-"` // layout of the database ; read and validated when it is first used
+	manifested  bool                      // Manifest was read, or the database has none
+	muMa        *sync.Mutex
+	muMu        *sync.RWMutex
+	muSe        *sync.RWMutex
+	muHe        *sync.Mutex
+	held        map[string]string
+	rheld       map[string][]string
+	table       *lockTable
+	snowflake   *Snowflake // guarded by muSn
+	muSn        *sync.Mutex
 }
 
 func (c *Cache) PathExists(path string) bool {
@@ -32,78 +45,98 @@ func (c *Cache) PathExists(path string) bool {
 }
 
 func (c *Cache) SafeLoadBytes(path string) ([]byte, error) {
-	c.EnsureIdentifierMutex(path)
-	c.Mutex(path).RLock()
-	defer func() {
-		// unlock the read request on the path
-		c.Mutex(path).RUnlock()
-		// read the property safely
-		c.muMu.RLock()
-		count := len(c.Mutexes)
-		c.muMu.RUnlock()
-		// auto-cleanup
-		if count > 369 {
-			c.muMu.Lock()
-			delete(c.Mutexes, path)
-			c.muMu.Unlock()
-		}
-	}()
+	c.retain(path)
+	defer c.release(path)
+	mu := c.identifierMutex(path)
+	mu.RLock()
+	defer mu.RUnlock()
 	return os.ReadFile(path)
 }
 
 func (c *Cache) removeMutex(path string) {
 	c.muMu.Lock()
-	_, exists := c.Mutexes[path]
-	if !exists {
-		return
-	}
+	defer c.muMu.Unlock()
 	delete(c.Mutexes, path)
-	c.muMu.Unlock()
 }
 
 func (c *Cache) removeSemaphore(path string) {
 	c.muSe.Lock()
-	_, exists := c.Semaphores[path]
-	if !exists {
-		return
-	}
+	defer c.muSe.Unlock()
 	delete(c.Semaphores, path)
-	c.muSe.Unlock()
 }
 
 func (c *Cache) SafeWriteBytes(path string, bytes []byte) error {
-	c.EnsureIdentifierMutex(path)
-	c.Mutex(path).Lock()
-	defer func() {
-		c.Mutex(path).Unlock()
-		// read the property safely
-		c.muMu.RLock()
-		count := len(c.Mutexes)
-		c.muMu.RUnlock()
-		// auto-cleanup
-		if count > 369 {
-			c.removeMutex(path)
-		}
-	}()
-	return os.WriteFile(path, bytes, 0600)
+	c.retain(path)
+	defer c.release(path)
+	mu := c.identifierMutex(path)
+	mu.Lock()
+	defer mu.Unlock()
+	return c.writeFile(path, bytes)
 }
 
 func (c *Cache) LoadIdentifierFileInto(identifier string, filename string, receiver any) (any, error) {
-	c.EnsureIdentifier(identifier)
+	c.ensureIdentifier(identifier)
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultLockTimeout)
+	defer cancel()
+	recoverErr := c.recoverPending(ctx, identifier)
+	if recoverErr != nil {
+		return nil, recoverErr
+	}
 	path := filepath.Join(c.Path, IdentifierPath(identifier), filename)
 	bytes, loadErr := c.SafeLoadBytes(path)
 	if loadErr != nil {
 		return nil, loadErr
 	}
-	jsonErr := json.Unmarshal(bytes, &receiver)
-	if jsonErr != nil {
-		return nil, jsonErr
+	target := receiver
+	if reflect.ValueOf(receiver).Kind() != reflect.Pointer {
+		target = &receiver
+	}
+	decodeErr := DecodeRecord(bytes, target)
+	if decodeErr != nil {
+		return nil, decodeErr
 	}
 	return receiver, nil
 }
 
-// LockIdentifier will place a .locked file inside of the directory that belongs to the identifier argument
-func (c *Cache) LockIdentifier(identifier string) (err error) {
+// LockIdentifier will atomically create a .locked file inside of the directory that belongs to the identifier argument.
+// The file is created with O_CREATE|O_EXCL so that only one process (or Cache) can ever hold the lock; everyone else
+// retries every 30ms until the lock file is removed or DefaultLockTimeout has passed, at which point an error matching
+// ErrLockTimeout is returned. The lock file holds a lease that expires after the Cache's LockTTL, after which anyone may
+// remove it ; use RenewIdentifierLock or Heartbeat to keep a lock for longer.
+func (c *Cache) LockIdentifier(identifier string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultLockTimeout)
+	defer cancel()
+	return c.lockIdentifier(ctx, identifier, ``, false)
+}
+
+// LockIdentifierAs is LockIdentifier that records label (such as the name of the job or goroutine taking the lock)
+// alongside the PID and hostname in the .locked file so that LockInfo can show who is holding it
+func (c *Cache) LockIdentifierAs(identifier string, label string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultLockTimeout)
+	defer cancel()
+	return c.lockIdentifier(ctx, identifier, label, false)
+}
+
+// LockIdentifierContext is LockIdentifier that waits for the lock until ctx is done instead of DefaultLockTimeout. When
+// the deadline of ctx passes the returned error matches both ErrLockTimeout and context.DeadlineExceeded ; when ctx is
+// canceled, context.Canceled is returned.
+func (c *Cache) LockIdentifierContext(ctx context.Context, identifier string) error {
+	return c.lockIdentifier(ctx, identifier, ``, false)
+}
+
+// TryLockIdentifier makes a single attempt at locking identifier and returns ErrIdentifierLocked when another holder
+// has it
+func (c *Cache) TryLockIdentifier(identifier string) error {
+	return c.lockIdentifier(context.Background(), identifier, ``, true)
+}
+
+func (c *Cache) lockIdentifier(ctx context.Context, identifier string, label string, try bool) (err error) {
+	c.retain(identifier)
+	defer func() {
+		if err != nil {
+			c.release(identifier)
+		}
+	}()
 	defer func() {
 		r := recover()
 		if r == nil {
@@ -116,47 +149,121 @@ func (c *Cache) LockIdentifier(identifier string) (err error) {
 		}
 		return
 	}()
+	if ctx == nil {
+		ctx = context.Background()
+	}
 	err = c.IdentifierCheck(identifier)
 	if err != nil {
 		log.Printf("c.LockIdentifier(%v) received err %v", identifier, err)
 		return err
 	}
 
-	var breakMe bool = false
-	lockerChecker := time.NewTicker(30 * time.Millisecond)
-	attempts := atomic.Int64{}
-	for {
-		select {
-		case <-c.ctx.Done():
-			return c.ctx.Err()
-		case <-lockerChecker.C: // every 30ms retry
-			attempts.Add(1)
-			i, readErr := c.readInt64File(identifier, ".locked")
-			if readErr != nil {
-				// not locked
-				breakMe = true
-				break
-			}
-			if i > 0 {
-				if attempts.Load() > 30 {
-					err = errors.New(".locked file present and failed to unlock within timeout")
-					return
+	s := c.identifierSemaphore(identifier)
+	mu := c.identifierMutex(identifier)
+	lockPath := c.identifierLockFile(identifier)
+	lease := c.newLockHolder(identifier, label)
+	leaseBytes, jsonErr := json.Marshal(lease)
+	if jsonErr != nil {
+		return jsonErr
+	}
+	err = c.waitLock(ctx, try, func() (bool, error) {
+		for {
+			createErr := createLockFile(lockPath, leaseBytes)
+			if createErr == nil {
+				if !asideLockHeld(filepath.Dir(lockPath), filepath.Base(lockPath)) {
+					return true, nil
 				}
+				// the holder is renewing its lease and put its lock file aside for a moment ; give way to it and
+				// let it put its lock file back before trying again
+				releaseLockFile(lockPath, lease.Token)
+				deadline := time.Now().Add(lockRetryInterval)
+				for asideLockHeld(filepath.Dir(lockPath), filepath.Base(lockPath)) && time.Now().Before(deadline) {
+					time.Sleep(time.Millisecond)
+				}
+				return false, nil
+			}
+			if !errors.Is(createErr, fs.ErrExist) {
+				return false, createErr
 			}
+			reaped, reapErr := reapLockFile(lockPath, time.Now().UTC())
+			if reapErr != nil || !reaped {
+				return false, nil
+			}
+			// the previous holder's lease expired
+		}
+	})
+	if err != nil {
+		return err
+	}
 
+	// new readers back off while .locked exists ; wait for the ones that already hold a shared lock to release it
+	err = c.waitLock(ctx, try, func() (bool, error) {
+		return !sharedLocksHeld(filepath.Dir(lockPath)), nil
+	})
+	if err == nil {
+		if ws, weighted := s.(*WeightedSemaphore); weighted {
+			err = c.acquireWeight(ctx, try, ws, 1)
+		} else {
+			err = c.acquireInMemory(ctx, try, s.Acquire, s.Release, nil)
 		}
-		if breakMe {
-			break
+	}
+	if err == nil {
+		err = c.acquireInMemory(ctx, try, mu.Lock, mu.Unlock, mu.TryLock)
+		if err != nil {
+			s.Release()
 		}
 	}
+	if err != nil {
+		c.removeLockFile(identifier, lease.Token)
+		return err
+	}
+	c.muHe.Lock()
+	c.held[identifier] = lease.Token
+	c.muHe.Unlock()
+	return nil
+}
 
-	c.Semaphore(identifier).Acquire()
-	c.Mutex(identifier).Lock()
-	return c.writeTimestampFile(identifier, ".locked", time.Now().UTC())
+// createLockFile creates path with O_EXCL and writes body into it. When the file already exists, the returned error
+// matches fs.ErrExist. Exclusive creation is atomic across processes, unlike checking for the file and then writing it.
+func createLockFile(path string, body []byte) error {
+	f, openErr := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if openErr != nil {
+		return openErr
+	}
+	_, writeErr := f.Write(body)
+	closeErr := f.Close()
+	if writeErr != nil || closeErr != nil {
+		return errors.Join(writeErr, closeErr, os.Remove(path))
+	}
+	return nil
 }
 
-// EnsureIdentifierMutex protects against nil dereference errors and locks the mutex if .locked exists in the identifiers' directory
+// EnsureIdentifierMutex protects against nil dereference errors and returns the RWMutex of the identifier. The mutex
+// is handed out to the caller, so it is pinned in memory for the lifetime of the Cache and never evicted.
 func (c *Cache) EnsureIdentifierMutex(identifier string) (mu *sync.RWMutex) {
+	mu = c.identifierMutex(identifier)
+	c.pin(identifier)
+	return
+}
+
+// EnsureIdentifierSemaphore protects against nil dereference errors and loads the identifiers' .sema file into the
+// Cache. The semaphore is handed out to the caller, so it is pinned in memory for the lifetime of the Cache and never
+// evicted.
+func (c *Cache) EnsureIdentifierSemaphore(identifier string) (s sema.Semaphore) {
+	s = c.identifierSemaphore(identifier)
+	c.pin(identifier)
+	return
+}
+
+// EnsureIdentifier ensures non-nil assignments to Cache's Mutexes and Semaphores data for identifier
+func (c *Cache) EnsureIdentifier(identifier string) {
+	c.EnsureIdentifierMutex(identifier)
+	c.EnsureIdentifierSemaphore(identifier)
+}
+
+// identifierMutex returns the RWMutex of the identifier without pinning it ; callers that hold on to it must retain
+// the identifier first
+func (c *Cache) identifierMutex(identifier string) (mu *sync.RWMutex) {
 	c.SafetyCheck()
 
 	c.muMu.RLock()
@@ -164,7 +271,9 @@ func (c *Cache) EnsureIdentifierMutex(identifier string) (mu *sync.RWMutex) {
 	c.muMu.RUnlock()
 	if !mExists {
 		c.muMu.Lock()
-		c.Mutexes[identifier] = &sync.RWMutex{}
+		if _, mExists = c.Mutexes[identifier]; !mExists {
+			c.Mutexes[identifier] = &sync.RWMutex{}
+		}
 		c.muMu.Unlock()
 	}
 
@@ -172,50 +281,39 @@ func (c *Cache) EnsureIdentifierMutex(identifier string) (mu *sync.RWMutex) {
 	mu = c.Mutexes[identifier]
 	c.muMu.RUnlock()
 
-	lockPath := filepath.Join(c.Path, IdentifierPath(identifier), ".locked")
-	if c.PathExists(lockPath) {
-		lockedAt, readErr := c.readTimestampFile(identifier, ".locked")
-		if readErr == nil {
-			if time.Now().UTC().After(lockedAt) {
-				// locked in the past, aka still actively locked
-				if mu.TryLock() {
-					mu.Lock()
-				}
-			}
-		}
-	}
-
+	c.touch(identifier)
 	return
 }
 
-// EnsureIdentifierSemaphore protects against nil dereference errors and loads the identifiers' .sema file into the Cache
-func (c *Cache) EnsureIdentifierSemaphore(identifier string) (s sema.Semaphore) {
+// identifierSemaphore returns the semaphore of the identifier without pinning it ; callers that hold on to it must
+// retain the identifier first
+func (c *Cache) identifierSemaphore(identifier string) (s sema.Semaphore) {
 	c.SafetyCheck()
 	c.muSe.RLock()
 	_, sExists := c.Semaphores[identifier]
 	c.muSe.RUnlock()
 	if !sExists {
 		semaLimit, semaErr := c.readInt64File(identifier, ".sema")
-		if semaErr == nil && semaLimit > 0 {
-			c.muSe.Lock()
-			c.Semaphores[identifier] = sema.New(int(semaLimit))
-			c.muSe.Unlock()
-		} else {
-			c.muSe.Lock()
-			c.Semaphores[identifier] = sema.New(1)
-			c.muSe.Unlock()
+		if semaErr != nil || semaLimit < 1 {
+			semaLimit = 1
+		}
+		c.muSe.Lock()
+		if _, sExists = c.Semaphores[identifier]; !sExists {
+			c.Semaphores[identifier] = NewWeightedSemaphore(semaLimit)
 		}
+		c.muSe.Unlock()
 	}
 	c.muSe.RLock()
 	s = c.Semaphores[identifier]
 	c.muSe.RUnlock()
+	c.touch(identifier)
 	return
 }
 
-// EnsureIdentifier ensures non-nil assignments to Cache's Mutexes and Semaphores data for identifier
-func (c *Cache) EnsureIdentifier(identifier string) {
-	c.EnsureIdentifierMutex(identifier)
-	c.EnsureIdentifierSemaphore(identifier)
+// ensureIdentifier is EnsureIdentifier without pinning the identifier
+func (c *Cache) ensureIdentifier(identifier string) {
+	c.identifierMutex(identifier)
+	c.identifierSemaphore(identifier)
 }
 
 func (c *Cache) EnsureIdentifierDirectory(identifier string) (*Identifier, string, error) {
@@ -223,7 +321,7 @@ func (c *Cache) EnsureIdentifierDirectory(identifier string) (*Identifier, strin
 	if idErr != nil {
 		return nil, "", idErr
 	}
-	c.EnsureIdentifier(identifier)
+	c.ensureIdentifier(identifier)
 
 	identifierPath := filepath.Join(c.Path, id.Path())
 	if !c.PathExists(identifierPath) {
@@ -250,12 +348,14 @@ func (c *Cache) readInt64File(identifier string, filename string) (int64, error)
 }
 
 func (c *Cache) writeInt64File(identifier string, filename string, value int64) error {
-	_, dir, idErr := c.EnsureIdentifierDirectory(identifier)
-	if idErr != nil {
-		return idErr
+	// written to the same sharded directory that readInt64File reads from
+	dir := filepath.Join(c.Path, IdentifierPath(identifier))
+	mkdirErr := os.MkdirAll(dir, 0700)
+	if mkdirErr != nil {
+		return mkdirErr
 	}
 	path := filepath.Join(dir, filename)
-	return os.WriteFile(path, []byte(fmt.Sprintf("%d", value)), 0600)
+	return c.writeFile(path, []byte(fmt.Sprintf("%d", value)))
 }
 
 func (c *Cache) readTimestampFile(identifier string, filename string) (time.Time, error) {
@@ -272,29 +372,24 @@ func (c *Cache) writeTimestampFile(identifier string, filename string, timestamp
 }
 
 func (c *Cache) identifierLockFile(identifier string) string {
-	_, path, idErr := c.EnsureIdentifierDirectory(identifier)
-	if idErr != nil {
-		log.Printf("c.identifierLockFile() raised error at c.EnsureIdentifierDirectory() called idErr = %v", idErr)
+	path := filepath.Join(c.Path, IdentifierPath(identifier))
+	mkdirErr := os.MkdirAll(path, 0700)
+	if mkdirErr != nil {
+		log.Printf("c.identifierLockFile() raised error at os.MkdirAll() called mkdirErr = %v", mkdirErr)
 	}
 	return filepath.Join(path, ".locked")
 }
 
-func (c *Cache) removeLockFile(identifier string) bool {
+// removeLockFile removes the .locked file of identifier when its lease belongs to token. It is taken aside first, so a
+// lock that expired and was taken by someone else is never removed. Lock files that cannot be read are left for the
+// reaper.
+func (c *Cache) removeLockFile(identifier string, token string) bool {
 	err := c.IdentifierCheck(identifier)
 	if err != nil {
 		log.Printf("c.removeLockFile(%v) received err %v", identifier, err)
 		return false
 	}
-	lockPath := c.identifierLockFile(identifier)
-	info, infoErr := os.Stat(lockPath)
-	if infoErr == nil && !info.IsDir() && info.Name() == ".locked" && info.Size() > 0 {
-		rmErr := os.RemoveAll(lockPath)
-		if rmErr != nil {
-			log.Printf("c.removeLockFile() raised error at os.RemoveAll() called rmErr = %v", rmErr)
-			return false
-		}
-	}
-	return true
+	return releaseLockFile(c.identifierLockFile(identifier), token)
 }
 
 func (c *Cache) UnlockIdentifier(identifier string) {
@@ -303,25 +398,59 @@ func (c *Cache) UnlockIdentifier(identifier string) {
 		log.Printf("c.UnlockIdentifier(%v) received err %v", identifier, err)
 		return
 	}
-	c.removeLockFile(identifier)
-	c.Mutex(identifier).Unlock()
-	c.Semaphore(identifier).Release()
+	// only release the in-memory locks when this Cache acquired them ; the .locked file may belong to another process
+	c.muHe.Lock()
+	token, held := c.held[identifier]
+	delete(c.held, identifier)
+	c.muHe.Unlock()
+	c.removeLockFile(identifier, token)
+	if !held {
+		return
+	}
+	c.identifierMutex(identifier).Unlock()
+	c.identifierSemaphore(identifier).Release()
+	c.release(identifier)
 }
 
 func (c *Cache) IdentifierCheck(identifier string) error {
 	c.SafetyCheck()
-	c.EnsureIdentifier(identifier)
+	c.ensureIdentifier(identifier)
 	return nil
 
 }
 
 func (c *Cache) SafetyCheck() {
+	if c.ctx == nil {
+		c.ctx = context.Background()
+	}
 	if c.muMu == nil {
 		c.muMu = &sync.RWMutex{}
 	}
 	if c.muSe == nil {
 		c.muSe = &sync.RWMutex{}
 	}
+	if c.muHe == nil {
+		c.muHe = &sync.Mutex{}
+	}
+	if c.muMa == nil {
+		c.muMa = &sync.Mutex{}
+	}
+	if c.muSn == nil {
+		c.muSn = &sync.Mutex{}
+	}
+	if c.held == nil {
+		c.muHe.Lock()
+		c.held = make(map[string]string)
+		c.muHe.Unlock()
+	}
+	if c.rheld == nil {
+		c.muHe.Lock()
+		c.rheld = make(map[string][]string)
+		c.muHe.Unlock()
+	}
+	if c.table == nil {
+		c.table = newLockTable(DefaultLockTableCapacity)
+	}
 	if c.Mutexes == nil {
 		c.muMu.Lock()
 		c.Mutexes = make(map[string]*sync.RWMutex)
@@ -335,10 +464,9 @@ func (c *Cache) SafetyCheck() {
 }
 
 func (c *Cache) Write(identifier string, limit int) (err error) {
-	go func() {
+	defer func() {
 		r := recover()
 		if r == nil {
-			err = nil
 			return
 		}
 		var wasErr bool
@@ -365,26 +493,9 @@ func (c *Cache) Write(identifier string, limit int) (err error) {
 		return writeErr
 	}
 
-	c.muMu.RLock()
-	_, mutexExists := c.Mutexes[identifier]
-	c.muMu.RUnlock()
-	if !mutexExists {
-		c.muMu.Lock()
-		c.Mutexes[identifier] = &sync.RWMutex{}
-		c.muMu.Unlock()
-	}
-
-	c.muSe.RLock()
-	_, semaExists := c.Semaphores[identifier]
-	c.muSe.RUnlock()
-	if !semaExists {
-		if limit == 0 {
-			limit = 1
-		}
-		c.muSe.Lock()
-		c.Semaphores[identifier] = sema.New(limit)
-		c.muSe.Unlock()
-	}
+	// a semaphore created now takes its limit from the .sema written above ; the limit of one that already exists is
+	// left alone so that runtime changes made with SetSemaphoreLimit are kept
+	c.ensureIdentifier(identifier)
 	return
 }
 
@@ -430,13 +541,7 @@ func (c *Cache) LoadDatabase(databasePath string) error {
 			log.Printf("LoadDatabase() failed ParseIdentifier(%v) resulted in %v", maybeIdentifier, idErr)
 			return nil // skip over invalid identifiers
 		}
-		c.muMu.Lock()
-		c.Mutexes[identifier.String()] = &sync.RWMutex{}
-		c.muMu.Unlock()
-
-		c.muSe.Lock()
-		c.Semaphores[identifier.String()] = sema.New(1)
-		c.muSe.Unlock()
+		c.ensureIdentifier(identifier.String())
 
 		return nil
 	})
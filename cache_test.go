@@ -5,7 +5,10 @@ import (
 	`os`
 	`path/filepath`
 	`reflect`
+	`sync`
+	`sync/atomic`
 	`testing`
+	`time`
 )
 
 func TestCache_LockIdentifier(t *testing.T) {
@@ -97,3 +100,56 @@ func TestCache_LockIdentifier(t *testing.T) {
 		t.Errorf("nextID is not equal ; %v == %v", CodeFragment("4"), nextId.Fragment)
 	}
 }
+
+func TestCache_LockIdentifierAcrossCaches(t *testing.T) {
+	db, err := os.MkdirTemp("", "locks.db")
+	defer func(path string) {
+		err := os.RemoveAll(path)
+		if err != nil {
+			log.Printf("os.RemoveAll(%v) returned err %v", path, err)
+		}
+	}(db)
+	if err != nil {
+		t.Errorf("os.MkdirTemp() received err %v", err)
+		return
+	}
+
+	// every worker uses its own Valet so that only the .locked file can keep them apart, just like separate processes
+	identifier := "2024LOCKS"
+	holders := atomic.Int32{}
+	maxHolders := atomic.Int32{}
+	acquired := atomic.Int32{}
+	wg := &sync.WaitGroup{}
+	for i := 0; i < 6; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			cache, _ := NewValet(db).GetCache(db)
+			for j := 0; j < 3; j++ {
+				lockErr := cache.LockIdentifier(identifier)
+				if lockErr != nil {
+					continue
+				}
+				acquired.Add(1)
+				current := holders.Add(1)
+				if current > maxHolders.Load() {
+					maxHolders.Store(current)
+				}
+				time.Sleep(3 * time.Millisecond)
+				holders.Add(-1)
+				cache.UnlockIdentifier(identifier)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if maxHolders.Load() != 1 {
+		t.Errorf("expected at most 1 holder of the lock at a time ; got %d", maxHolders.Load())
+	}
+	if acquired.Load() == 0 {
+		t.Errorf("expected the lock to be acquired at least once")
+	}
+	if pathExists(filepath.Join(db, IdentifierPath(identifier), ".locked")) {
+		t.Errorf("expected .locked to be removed after every holder unlocked")
+	}
+}
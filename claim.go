@@ -0,0 +1,135 @@
+package go_apario_identifier
+
+import (
+	`errors`
+	`fmt`
+	`os`
+	`path/filepath`
+	`strings`
+)
+
+// maxCodeLength keeps a claimed identifier (4 digit year + code) within the 29 characters LoadDatabase accepts
+const maxCodeLength = 25
+
+var (
+	ErrIdentifierTaken    Err = errors.New("identifier already taken")
+	ErrIdentifierNotFound Err = errors.New("identifier not found")
+	ErrInvalidCode        Err = errors.New("invalid identifier code")
+	ErrInvalidYear        Err = errors.New("year must be between 1000 and 9999")
+)
+
+// IdentifierTakenError is returned when a claim is made on an identifier whose .identifier file already exists or
+// that was deleted and left a tombstone behind. It matches ErrIdentifierTaken with errors.Is.
+type IdentifierTakenError struct {
+	Identifier string `json:"identifier"`
+	Path       string `json:"path"`
+	Tombstoned bool   `json:"tombstoned"`
+}
+
+func (e *IdentifierTakenError) Error() string {
+	if e.Tombstoned {
+		return fmt.Sprintf("identifier %v was deleted and cannot be reused", e.Identifier)
+	}
+	return fmt.Sprintf("identifier %v already taken at %v", e.Identifier, e.Path)
+}
+
+func (e *IdentifierTakenError) Unwrap() error {
+	return ErrIdentifierTaken
+}
+
+// ValidateCode verifies that code is between 1 and 25 characters of the IdentifierCharset (case-insensitive)
+func ValidateCode(code string) error {
+	if len(code) == 0 || len(code) > maxCodeLength {
+		return fmt.Errorf("%w: length must be between 1 and %d characters", ErrInvalidCode, maxCodeLength)
+	}
+	for _, r := range strings.ToUpper(code) {
+		if !strings.ContainsRune(IdentifierCharset, r) {
+			return fmt.Errorf("%w: character %q is not in the IdentifierCharset", ErrInvalidCode, r)
+		}
+	}
+	return nil
+}
+
+// ClaimID creates the identifier for year and the human-chosen code inside databasePath. The directory is created if
+// needed and the .identifier file is created with O_EXCL, so only one caller can ever claim a given identifier. When
+// the identifier already exists an *IdentifierTakenError is returned.
+func (v *Valet) ClaimID(databasePath string, year int, code string) (*Identifier, error) {
+	if year < 1000 || year > 9999 {
+		return nil, ErrInvalidYear
+	}
+	codeErr := ValidateCode(code)
+	if codeErr != nil {
+		return nil, codeErr
+	}
+	c, cErr := v.cache(databasePath)
+	if cErr != nil {
+		return nil, cErr
+	}
+	identifier, identifierErr := CodeFragment(code).ToYearIdentifier(year)
+	if identifierErr != nil {
+		return nil, identifierErr
+	}
+	claimErr := c.claimIdentifier(identifier)
+	if claimErr != nil {
+		return nil, claimErr
+	}
+	return identifier, nil
+}
+
+// claimIdentifier atomically creates the .identifier file of identifier inside the Cache's database
+func (c *Cache) claimIdentifier(identifier *Identifier) error {
+	identifierDir := filepath.Join(c.Path, IdentifierPath(identifier.String()))
+	taken := &IdentifierTakenError{
+		Identifier: identifier.String(),
+		Path:       identifierDir,
+	}
+	if c.IsTombstoned(identifier.String()) {
+		taken.Tombstoned = true
+		return taken // checked before creating any directory, so a deleted identifier's directories stay removed
+	}
+
+	mkdirErr := os.MkdirAll(identifierDir, 0700)
+	if mkdirErr != nil {
+		return mkdirErr
+	}
+	if identifierDirInUse(identifierDir) {
+		return taken
+	}
+
+	identifierPath := filepath.Join(identifierDir, ".identifier")
+	f, openErr := os.OpenFile(identifierPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if openErr != nil {
+		if os.IsExist(openErr) {
+			return taken
+		}
+		return openErr
+	}
+	_, writeErr := f.Write([]byte(identifier.String()))
+	closeErr := f.Close()
+	if writeErr != nil || closeErr != nil {
+		return errors.Join(writeErr, closeErr, os.Remove(identifierPath))
+	}
+	if c.IsTombstoned(identifier.String()) {
+		// the identifier was deleted while it was being claimed
+		taken.Tombstoned = true
+		return errors.Join(taken, os.Remove(identifierPath))
+	}
+	c.ensureIdentifier(identifier.String())
+	return nil
+}
+
+// identifierDirInUse reports whether dir already holds files. Directories that were created before .identifier files
+// existed only hold files when they belong to an identifier; shard directories of longer identifiers only hold
+// directories.
+func identifierDirInUse(dir string) bool {
+	entries, readDirErr := os.ReadDir(dir)
+	if readDirErr != nil {
+		return false
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,139 @@
+package go_apario_identifier
+
+import (
+	`errors`
+	`log`
+	`os`
+	`path/filepath`
+	`sync`
+	`sync/atomic`
+	`testing`
+	`time`
+)
+
+func TestValidateCode(t *testing.T) {
+	tests := []struct {
+		name    string
+		code    string
+		wantErr bool
+	}{
+		{name: "upper case code", code: "EPSTEIN", wantErr: false},
+		{name: "lower case code", code: "jfk1963", wantErr: false},
+		{name: "empty code", code: "", wantErr: true},
+		{name: "code with punctuation", code: "JFK-1963", wantErr: true},
+		{name: "code too long", code: "ABCDEFGHIJKLMNOPQRSTUVWXYZ", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ValidateCode(tt.code)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ValidateCode(%v) error = %v, wantErr %v", tt.code, err, tt.wantErr)
+				return
+			}
+			if err != nil && !errors.Is(err, ErrInvalidCode) {
+				t.Errorf("expected ErrInvalidCode ; got %v", err)
+			}
+		})
+	}
+}
+
+func TestValet_ClaimID(t *testing.T) {
+	db, err := os.MkdirTemp("", "collections.db")
+	if err != nil {
+		t.Errorf("os.MkdirTemp() received err %v", err)
+		return
+	}
+	defer func(path string) {
+		err := os.RemoveAll(path)
+		if err != nil {
+			log.Printf("os.RemoveAll(%v) returned err %v", path, err)
+		}
+	}(db)
+
+	valet := NewValet(db)
+	valet.SafetyCheck()
+
+	_, yearErr := valet.ClaimID(db, 24, "JFK")
+	if !errors.Is(yearErr, ErrInvalidYear) {
+		t.Errorf("expected ErrInvalidYear ; got %v", yearErr)
+		return
+	}
+
+	// many callers racing for the same vanity code must produce exactly one winner
+	wg := &sync.WaitGroup{}
+	winners := atomic.Int32{}
+	taken := atomic.Int32{}
+	for i := 0; i < 17; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, claimErr := valet.ClaimID(db, 2024, "jfk")
+			if claimErr == nil {
+				winners.Add(1)
+				return
+			}
+			var takenErr *IdentifierTakenError
+			if errors.As(claimErr, &takenErr) && errors.Is(claimErr, ErrIdentifierTaken) {
+				taken.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+	if winners.Load() != 1 || taken.Load() != 16 {
+		t.Errorf("expected 1 winner and 16 taken ; got %d winners and %d taken", winners.Load(), taken.Load())
+		return
+	}
+
+	identifierBytes, readErr := os.ReadFile(filepath.Join(db, IdentifierPath("2024JFK"), ".identifier"))
+	if readErr != nil {
+		t.Errorf("os.ReadFile(.identifier) returned err %v", readErr)
+		return
+	}
+	if string(identifierBytes) != "2024JFK" {
+		t.Errorf("expected .identifier to contain 2024JFK ; got %v", string(identifierBytes))
+	}
+}
+
+func TestValet_NextID_SkipsClaimed(t *testing.T) {
+	db, err := os.MkdirTemp("", "claimed.db")
+	if err != nil {
+		t.Errorf("os.MkdirTemp() received err %v", err)
+		return
+	}
+	defer func(path string) {
+		err := os.RemoveAll(path)
+		if err != nil {
+			log.Printf("os.RemoveAll(%v) returned err %v", path, err)
+		}
+	}(db)
+
+	valet := NewValet(db)
+	dbErr := valet.NewCountableDatabase(db)
+	if dbErr != nil {
+		t.Errorf("valet.NewCountableDatabase() returned err %v", dbErr)
+		return
+	}
+	claimed, claimErr := valet.ClaimID(db, time.Now().UTC().Year(), "2")
+	if claimErr != nil {
+		t.Errorf("valet.ClaimID() returned err %v", claimErr)
+		return
+	}
+	next, nextErr := valet.NextID(db)
+	if nextErr != nil {
+		t.Errorf("valet.NextID() returned err %v", nextErr)
+		return
+	}
+	if next.String() == claimed.String() {
+		t.Errorf("expected NextID to skip the claimed %v", claimed)
+		return
+	}
+	expected, _ := IntegerFragment(3).ToIdentifier()
+	if next.String() != expected.String() {
+		t.Errorf("expected NextID to return %v ; got %v", expected, next)
+		return
+	}
+	lastBytes, _ := os.ReadFile(filepath.Join(db, ".lastid"))
+	if string(lastBytes) != "3" {
+		t.Errorf("expected .lastid to be 3 ; got %q", lastBytes)
+	}
+}
@@ -0,0 +1,308 @@
+package go_apario_identifier
+
+import (
+	`bytes`
+	`compress/flate`
+	`compress/gzip`
+	`compress/zlib`
+	`encoding/gob`
+	`encoding/json`
+	`errors`
+	`fmt`
+	`io`
+	`strconv`
+	`strings`
+	`sync`
+)
+
+const (
+	// recordHeaderPrefix starts the first line of every record file written with a codec
+	recordHeaderPrefix = "apario:"
+	// recordFormatVersion is the version of the record header
+	recordFormatVersion = 1
+)
+
+var (
+	ErrUnknownCodec       Err = errors.New("unknown record codec")
+	ErrUnknownCompression Err = errors.New("unknown record compression")
+	ErrRecordHeader       Err = errors.New("invalid record header")
+)
+
+// Codec turns records into bytes and back
+type Codec interface {
+	Name() string
+	Marshal(v any) ([]byte, error)
+	Unmarshal(data []byte, v any) error
+}
+
+// Compression wraps the encoded bytes of a record
+type Compression interface {
+	Name() string
+	NewWriter(w io.Writer) (io.WriteCloser, error)
+	NewReader(r io.Reader) (io.ReadCloser, error)
+}
+
+// JSONCodec encodes records with encoding/json ; record files without a header are read as JSON
+type JSONCodec struct{}
+
+func (JSONCodec) Name() string                       { return "json" }
+func (JSONCodec) Marshal(v any) ([]byte, error)      { return json.Marshal(v) }
+func (JSONCodec) Unmarshal(data []byte, v any) error { return json.Unmarshal(data, v) }
+
+// GobCodec encodes records with encoding/gob
+type GobCodec struct{}
+
+func (GobCodec) Name() string { return "gob" }
+
+func (GobCodec) Marshal(v any) ([]byte, error) {
+	buf := bytes.Buffer{}
+	encodeErr := gob.NewEncoder(&buf).Encode(v)
+	if encodeErr != nil {
+		return nil, encodeErr
+	}
+	return buf.Bytes(), nil
+}
+
+func (GobCodec) Unmarshal(data []byte, v any) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+// NoCompression stores the encoded bytes as they are
+type NoCompression struct{}
+
+func (NoCompression) Name() string                                  { return "none" }
+func (NoCompression) NewWriter(w io.Writer) (io.WriteCloser, error) { return nopWriteCloser{w}, nil }
+func (NoCompression) NewReader(r io.Reader) (io.ReadCloser, error)  { return io.NopCloser(r), nil }
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+// GzipCompression compresses records with compress/gzip
+type GzipCompression struct {
+	Level int // defaults to gzip.DefaultCompression
+}
+
+func (GzipCompression) Name() string { return "gzip" }
+
+func (g GzipCompression) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	if g.Level == 0 {
+		return gzip.NewWriter(w), nil
+	}
+	return gzip.NewWriterLevel(w, g.Level)
+}
+
+func (GzipCompression) NewReader(r io.Reader) (io.ReadCloser, error) { return gzip.NewReader(r) }
+
+// ZlibCompression compresses records with compress/zlib
+type ZlibCompression struct {
+	Level int // defaults to zlib.DefaultCompression
+}
+
+func (ZlibCompression) Name() string { return "zlib" }
+
+func (z ZlibCompression) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	if z.Level == 0 {
+		return zlib.NewWriter(w), nil
+	}
+	return zlib.NewWriterLevel(w, z.Level)
+}
+
+func (ZlibCompression) NewReader(r io.Reader) (io.ReadCloser, error) { return zlib.NewReader(r) }
+
+// FlateCompression compresses records with compress/flate
+type FlateCompression struct {
+	Level int // defaults to flate.DefaultCompression
+}
+
+func (FlateCompression) Name() string { return "flate" }
+
+func (f FlateCompression) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	if f.Level == 0 {
+		return flate.NewWriter(w, flate.DefaultCompression)
+	}
+	return flate.NewWriter(w, f.Level)
+}
+
+func (FlateCompression) NewReader(r io.Reader) (io.ReadCloser, error) { return flate.NewReader(r), nil }
+
+var (
+	codecsMu     = &sync.RWMutex{}
+	codecs       = map[string]Codec{"json": JSONCodec{}, "gob": GobCodec{}}
+	compressions = map[string]Compression{
+		"none":  NoCompression{},
+		"gzip":  GzipCompression{},
+		"zlib":  ZlibCompression{},
+		"flate": FlateCompression{},
+	}
+)
+
+// RegisterCodec makes codec available to readers of record files that name it in their header
+func RegisterCodec(codec Codec) {
+	codecsMu.Lock()
+	defer codecsMu.Unlock()
+	codecs[codec.Name()] = codec
+}
+
+// RegisterCompression makes compression available to readers of record files that name it in their header
+func RegisterCompression(compression Compression) {
+	codecsMu.Lock()
+	defer codecsMu.Unlock()
+	compressions[compression.Name()] = compression
+}
+
+func lookupCodec(name string) (Codec, error) {
+	codecsMu.RLock()
+	defer codecsMu.RUnlock()
+	codec, exists := codecs[name]
+	if !exists {
+		return nil, fmt.Errorf("%w: %q", ErrUnknownCodec, name)
+	}
+	return codec, nil
+}
+
+func lookupCompression(name string) (Compression, error) {
+	codecsMu.RLock()
+	defer codecsMu.RUnlock()
+	compression, exists := compressions[name]
+	if !exists {
+		return nil, fmt.Errorf("%w: %q", ErrUnknownCompression, name)
+	}
+	return compression, nil
+}
+
+// RecordHeader is the first line of a record file, such as "apario:1;codec=json;compression=gzip". It tells readers
+// how the rest of the file was written and, for records written by a Store, which type and schema version they hold.
+type RecordHeader struct {
+	Version     int    `json:"version"`
+	Codec       string `json:"codec"`
+	Compression string `json:"compression"`
+	Type        string `json:"type"`   // record type the schema belongs to ; empty when not written by a Store
+	Schema      int    `json:"schema"` // schema version of the record ; 0 for records written before versioning
+}
+
+func (h RecordHeader) String() string {
+	header := fmt.Sprintf("%s%d;codec=%s;compression=%s", recordHeaderPrefix, h.Version, h.Codec, h.Compression)
+	if len(h.Type) > 0 {
+		header += fmt.Sprintf(";type=%s;schema=%d", h.Type, h.Schema)
+	}
+	return header
+}
+
+// ParseRecordHeader splits data into its header and payload. Record files written before headers existed are plain
+// JSON ; they are returned with a JSON header and their bytes as the payload.
+func ParseRecordHeader(data []byte) (RecordHeader, []byte, error) {
+	legacy := RecordHeader{Version: 0, Codec: JSONCodec{}.Name(), Compression: NoCompression{}.Name()}
+	if !bytes.HasPrefix(data, []byte(recordHeaderPrefix)) {
+		return legacy, data, nil
+	}
+	line, payload, found := bytes.Cut(data, []byte("\n"))
+	if !found {
+		return RecordHeader{}, nil, fmt.Errorf("%w: missing end of line", ErrRecordHeader)
+	}
+	fields := strings.Split(strings.TrimPrefix(string(line), recordHeaderPrefix), ";")
+	version, versionErr := strconv.Atoi(fields[0])
+	if versionErr != nil {
+		return RecordHeader{}, nil, fmt.Errorf("%w: %w", ErrRecordHeader, versionErr)
+	}
+	header := RecordHeader{Version: version, Codec: legacy.Codec, Compression: legacy.Compression}
+	for _, field := range fields[1:] {
+		key, value, _ := strings.Cut(field, "=")
+		switch key {
+		case "codec":
+			header.Codec = value
+		case "compression":
+			header.Compression = value
+		case "type":
+			header.Type = value
+		case "schema":
+			schema, schemaErr := strconv.Atoi(value)
+			if schemaErr != nil {
+				return RecordHeader{}, nil, fmt.Errorf("%w: %w", ErrRecordHeader, schemaErr)
+			}
+			header.Schema = schema
+		}
+	}
+	return header, payload, nil
+}
+
+// EncodeRecord encodes v with codec, compresses it with compression and prefixes it with a RecordHeader. A nil codec
+// defaults to JSONCodec and a nil compression to NoCompression.
+func EncodeRecord(v any, codec Codec, compression Compression) ([]byte, error) {
+	return encodeRecord(v, codec, compression, ``, 0)
+}
+
+// encodeRecord is EncodeRecord that records the type and schema version of v in the header
+func encodeRecord(v any, codec Codec, compression Compression, recordType string, schema int) ([]byte, error) {
+	if codec == nil {
+		codec = JSONCodec{}
+	}
+	encoded, marshalErr := codec.Marshal(v)
+	if marshalErr != nil {
+		return nil, marshalErr
+	}
+	return encodePayload(encoded, codec, compression, recordType, schema)
+}
+
+// encodePayload compresses bytes that were already encoded with codec and prefixes them with a RecordHeader
+func encodePayload(encoded []byte, codec Codec, compression Compression, recordType string, schema int) ([]byte, error) {
+	if compression == nil {
+		compression = NoCompression{}
+	}
+	header := RecordHeader{
+		Version:     recordFormatVersion,
+		Codec:       codec.Name(),
+		Compression: compression.Name(),
+		Type:        recordType,
+		Schema:      schema,
+	}
+	buf := bytes.NewBufferString(header.String() + "\n")
+	w, writerErr := compression.NewWriter(buf)
+	if writerErr != nil {
+		return nil, writerErr
+	}
+	_, writeErr := w.Write(encoded)
+	closeErr := w.Close()
+	if writeErr != nil || closeErr != nil {
+		return nil, errors.Join(writeErr, closeErr)
+	}
+	return buf.Bytes(), nil
+}
+
+// DecodeRecord decodes data written by EncodeRecord into v, detecting the codec and compression from its header.
+// Record files without a header are decoded as JSON.
+func DecodeRecord(data []byte, v any) error {
+	_, codec, decoded, decodeErr := decodePayload(data)
+	if decodeErr != nil {
+		return decodeErr
+	}
+	return codec.Unmarshal(decoded, v)
+}
+
+// decodePayload returns the header of data, its codec and its decompressed payload
+func decodePayload(data []byte) (RecordHeader, Codec, []byte, error) {
+	header, payload, headerErr := ParseRecordHeader(data)
+	if headerErr != nil {
+		return header, nil, nil, headerErr
+	}
+	codec, codecErr := lookupCodec(header.Codec)
+	if codecErr != nil {
+		return header, nil, nil, codecErr
+	}
+	compression, compressionErr := lookupCompression(header.Compression)
+	if compressionErr != nil {
+		return header, nil, nil, compressionErr
+	}
+	r, readerErr := compression.NewReader(bytes.NewReader(payload))
+	if readerErr != nil {
+		return header, nil, nil, readerErr
+	}
+	decoded, readErr := io.ReadAll(r)
+	closeErr := r.Close()
+	if readErr != nil || closeErr != nil {
+		return header, nil, nil, errors.Join(readErr, closeErr)
+	}
+	return header, codec, decoded, nil
+}
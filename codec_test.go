@@ -0,0 +1,82 @@
+package go_apario_identifier
+
+import (
+	`bytes`
+	`context`
+	`errors`
+	`log`
+	`os`
+	`path/filepath`
+	`testing`
+)
+
+func TestEncodeRecord(t *testing.T) {
+	record := storeTestDocument{Title: "Minutes", Pages: 4}
+	for _, codec := range []Codec{JSONCodec{}, GobCodec{}} {
+		for _, compression := range []Compression{NoCompression{}, GzipCompression{}, ZlibCompression{}, FlateCompression{}} {
+			encoded, encodeErr := EncodeRecord(record, codec, compression)
+			if encodeErr != nil {
+				t.Errorf("EncodeRecord(%v, %v) returned err %v", codec.Name(), compression.Name(), encodeErr)
+				return
+			}
+			header, _, headerErr := ParseRecordHeader(encoded)
+			if headerErr != nil || header.Codec != codec.Name() || header.Compression != compression.Name() {
+				t.Errorf("unexpected header %+v and err %v", header, headerErr)
+				return
+			}
+			decoded := storeTestDocument{}
+			decodeErr := DecodeRecord(encoded, &decoded)
+			if decodeErr != nil || decoded != record {
+				t.Errorf("expected %+v back from %v ; got %+v and err %v", record, header, decoded, decodeErr)
+				return
+			}
+		}
+	}
+
+	legacy := storeTestDocument{}
+	decodeErr := DecodeRecord([]byte(`{"title":"Legacy","pages":1}`), &legacy)
+	if decodeErr != nil || legacy.Title != "Legacy" {
+		t.Errorf("expected headerless records to be read as JSON ; got %+v and err %v", legacy, decodeErr)
+		return
+	}
+	decodeErr = DecodeRecord([]byte("apario:1;codec=yaml;compression=none\n{}"), &legacy)
+	if !errors.Is(decodeErr, ErrUnknownCodec) {
+		t.Errorf("expected ErrUnknownCodec ; got %v", decodeErr)
+	}
+}
+
+func TestStore_Codec(t *testing.T) {
+	db, err := os.MkdirTemp("", "codec.db")
+	if err != nil {
+		t.Errorf("os.MkdirTemp() received err %v", err)
+		return
+	}
+	defer func(path string) {
+		err := os.RemoveAll(path)
+		if err != nil {
+			log.Printf("os.RemoveAll(%v) returned err %v", path, err)
+		}
+	}(db)
+
+	cache, _ := NewValet(db).GetCache(db)
+	cache.Compression = GzipCompression{}
+	documents, _ := NewStore[storeTestDocument](cache, StoreOptions{Codec: GobCodec{}})
+	id, createErr := documents.Create(context.Background(), storeTestDocument{Title: "Compressed", Pages: 2})
+	if createErr != nil {
+		t.Errorf("documents.Create() returned err %v", createErr)
+		return
+	}
+
+	recordBytes, _ := os.ReadFile(filepath.Join(db, IdentifierPath(id.String()), DefaultRecordFile))
+	if !bytes.HasPrefix(recordBytes, []byte("apario:1;codec=gob;compression=gzip;type=go_apario_identifier.storeTestDocument;schema=0\n")) {
+		t.Errorf("expected the record file to start with its header ; got %q", recordBytes)
+		return
+	}
+
+	// readers that know nothing about the store detect the format from the header
+	loaded := &storeTestDocument{}
+	_, loadErr := cache.LoadIdentifierFileInto(id.String(), DefaultRecordFile, loaded)
+	if loadErr != nil || loaded.Title != "Compressed" {
+		t.Errorf("expected LoadIdentifierFileInto to decode the record ; got %+v and err %v", loaded, loadErr)
+	}
+}
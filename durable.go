@@ -0,0 +1,102 @@
+package go_apario_identifier
+
+import (
+	`errors`
+	`os`
+	`path/filepath`
+)
+
+// Durability is how far an atomic write goes to survive a crash. Every level replaces the file with a rename, so a
+// reader never sees a truncated file ; the levels differ in what survives the machine losing power.
+type Durability int
+
+const (
+	// DurabilityFull fsyncs the file before the rename and its directory after it ; the zero value
+	DurabilityFull Durability = iota
+	// DurabilityFile fsyncs the file before the rename but not the directory, so the rename itself may be lost
+	DurabilityFile
+	// DurabilityNone renames without fsync ; the write survives the process crashing, but not the machine
+	DurabilityNone
+)
+
+// WriteFileAtomic replaces path with bytes. The bytes are written to a temporary file in the same directory, which is
+// renamed over path once it is complete, so path holds either its old or its new contents and never a torn write.
+func WriteFileAtomic(path string, bytes []byte, perm os.FileMode, durability Durability) error {
+	return writeFileAtomic(path, bytes, perm, durability, nil)
+}
+
+// writeFault is called after each stage of writeFileAtomic ("write", "sync" and "rename" ; the last one before the
+// rename) and aborts the write when it returns an error. Tests use it to simulate a crash part of the way through.
+type writeFault func(stage string) error
+
+func (fault writeFault) at(stage string) error {
+	if fault == nil {
+		return nil
+	}
+	return fault(stage)
+}
+
+// writeFileAtomic is WriteFileAtomic that consults fault between its stages
+func writeFileAtomic(path string, bytes []byte, perm os.FileMode, durability Durability, fault writeFault) error {
+	dir := filepath.Dir(path)
+	f, createErr := os.CreateTemp(dir, "."+filepath.Base(path)+".tmp-*")
+	if createErr != nil {
+		return createErr
+	}
+	tmp := f.Name()
+	writeErr := writeTempFile(f, bytes, perm, durability, fault)
+	closeErr := f.Close()
+	if writeErr != nil || closeErr != nil {
+		return errors.Join(writeErr, closeErr, os.Remove(tmp))
+	}
+	renameErr := fault.at("rename")
+	if renameErr == nil {
+		renameErr = os.Rename(tmp, path)
+	}
+	if renameErr != nil {
+		return errors.Join(renameErr, os.Remove(tmp))
+	}
+	if durability == DurabilityFull {
+		return syncDir(dir)
+	}
+	return nil
+}
+
+// writeTempFile writes bytes into the temporary file f of writeFileAtomic and fsyncs it when durability asks for it
+func writeTempFile(f *os.File, bytes []byte, perm os.FileMode, durability Durability, fault writeFault) error {
+	_, writeErr := f.Write(bytes)
+	if writeErr != nil {
+		return writeErr
+	}
+	faultErr := fault.at("write")
+	if faultErr != nil {
+		return faultErr
+	}
+	chmodErr := f.Chmod(perm)
+	if chmodErr != nil {
+		return chmodErr
+	}
+	if durability <= DurabilityFile {
+		syncErr := f.Sync()
+		if syncErr != nil {
+			return syncErr
+		}
+	}
+	return fault.at("sync")
+}
+
+// syncDir fsyncs dir so that the renames and removals inside of it are durable
+func syncDir(dir string) error {
+	d, openErr := os.Open(dir)
+	if openErr != nil {
+		return openErr
+	}
+	syncErr := d.Sync()
+	closeErr := d.Close()
+	return errors.Join(syncErr, closeErr)
+}
+
+// writeFile atomically replaces path with bytes at the Cache's Durability
+func (c *Cache) writeFile(path string, bytes []byte) error {
+	return WriteFileAtomic(path, bytes, 0600, c.Durability)
+}
@@ -0,0 +1,70 @@
+package go_apario_identifier
+
+import (
+	`errors`
+	`fmt`
+	`log`
+	`os`
+	`path/filepath`
+	`testing`
+)
+
+func TestWriteFileAtomic(t *testing.T) {
+	db, err := os.MkdirTemp("", "durable.db")
+	if err != nil {
+		t.Errorf("os.MkdirTemp() received err %v", err)
+		return
+	}
+	defer func(path string) {
+		err := os.RemoveAll(path)
+		if err != nil {
+			log.Printf("os.RemoveAll(%v) returned err %v", path, err)
+		}
+	}(db)
+	cache, _ := NewValet(db).GetCache(db)
+	path := filepath.Join(db, "record.json")
+	original := []byte(`{"title":"original"}`)
+	err = cache.SafeWriteBytes(path, original)
+	if err != nil {
+		t.Errorf("cache.SafeWriteBytes() returned err %v", err)
+		return
+	}
+
+	crash := errors.New("crashed")
+	for _, stage := range []string{"write", "sync", "rename"} {
+		for _, durability := range []Durability{DurabilityFull, DurabilityFile, DurabilityNone} {
+			fault := func(at string) error {
+				if at == stage {
+					return crash
+				}
+				return nil
+			}
+			writeErr := writeFileAtomic(path, []byte(fmt.Sprintf(`{"title":"crashed at %v"}`, stage)), 0600, durability, fault)
+			if !errors.Is(writeErr, crash) {
+				t.Errorf("expected the injected fault at %v ; got %v", stage, writeErr)
+				return
+			}
+			contents, _ := os.ReadFile(path)
+			if string(contents) != string(original) {
+				t.Errorf("expected a crash at %v to leave the original contents ; got %s", stage, contents)
+				return
+			}
+			entries, _ := os.ReadDir(db)
+			if len(entries) != 1 {
+				t.Errorf("expected the temporary file to be removed after a crash at %v ; got %d entries", stage, len(entries))
+				return
+			}
+		}
+	}
+
+	updated := []byte(`{"title":"updated"}`)
+	err = cache.SafeWriteBytes(path, updated)
+	if err != nil {
+		t.Errorf("cache.SafeWriteBytes() returned err %v", err)
+		return
+	}
+	contents, _ := os.ReadFile(path)
+	if string(contents) != string(updated) {
+		t.Errorf("expected the updated contents ; got %s", contents)
+	}
+}
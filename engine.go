@@ -1,92 +1,174 @@
 package go_apario_identifier
 
 import (
+	`context`
 	`crypto/rand`
 	`errors`
 	`fmt`
-	`log`
 	`math/big`
 	`os`
-	`path/filepath`
 	`time`
 )
 
-// newToken this is attempts squared with a length of the token
-func newToken(length int, attempts int) (*Identifier, error) {
+const (
+	// maxBlockedTokens is how many tokens in a row the TokenBlocklist may reject before generation gives up
+	maxBlockedTokens = 369
+
+	// maxTokenLength is the longest random fragment that can be generated
+	maxTokenLength = 29
+
+	// DefaultIdentifierLength is the fragment length used when IdentifierOptions.Length is not set
+	DefaultIdentifierLength = 6
+
+	// DefaultIdentifierAttempts is the number of collisions tolerated when IdentifierOptions.MaxAttempts is not set
+	DefaultIdentifierAttempts = 17
+)
+
+var ErrIdentifiersExhausted Err = errors.New("failed to acquire new unique identifier")
+
+// IdentifierOptions configures NewIdentifierContext
+type IdentifierOptions struct {
+	Length      int        `json:"length"`       // length of the random fragment ; defaults to DefaultIdentifierLength
+	MaxAttempts int        `json:"max_attempts"` // unique identifiers to try ; defaults to DefaultIdentifierAttempts
+	Year        int        `json:"year"`         // year of the identifier ; defaults to the current UTC year
+	Blocklist   *Blocklist `json:"-"`            // consulted for every token ; defaults to TokenBlocklist()
+}
+
+// ExhaustedError is returned by NewIdentifierContext when every attempt collided with an existing identifier or too
+// many tokens were rejected by the blocklist. It matches ErrIdentifiersExhausted with errors.Is.
+type ExhaustedError struct {
+	Attempts   int `json:"attempts"`   // tokens that were checked against the database
+	Collisions int `json:"collisions"` // tokens that were already taken
+	Rejected   int `json:"rejected"`   // tokens that were rejected by the blocklist
+}
+
+func (e *ExhaustedError) Error() string {
+	return fmt.Sprintf("%v after %d attempts (%d collisions, %d rejected by blocklist)", ErrIdentifiersExhausted, e.Attempts, e.Collisions, e.Rejected)
+}
+
+func (e *ExhaustedError) Unwrap() error {
+	return ErrIdentifiersExhausted
+}
+
+// randomToken returns length characters chosen from the IdentifierCharset with crypto/rand
+func randomToken(length int) (string, error) {
+	token := make([]byte, length)
+	m := big.NewInt(int64(len(IdentifierCharset)))
+	for i := range token {
+		randIndex, err := rand.Int(rand.Reader, m)
+		if err != nil {
+			return "", fmt.Errorf("failed to generate random number: %w", err)
+		}
+		token[i] = IdentifierCharset[randIndex.Int64()]
+	}
+	return string(token), nil
+}
+
+// newToken returns an identifier for year with a random fragment of length characters. Tokens that blocklist rejects
+// are regenerated, and once it rejected more than maxBlockedTokens in a row an *ExhaustedError is returned. Up to
+// attempts tokens that fail to parse are retried.
+func newToken(length int, attempts int, year int, blocklist *Blocklist) (*Identifier, error) {
 	if length < 0 {
 		return nil, errors.New("token length must be > 0")
 	}
 	if attempts < 1 {
 		return nil, errors.New("no remaining attempts left")
 	}
-	if length > 30 {
+	if length > maxTokenLength {
 		return nil, errors.New("maximum token length is 29 chars")
 	}
 
-	for {
-		token := make([]byte, length)
-		for i := range token {
-			m := big.NewInt(int64(len(IdentifierCharset)))
-			randIndex, err := rand.Int(rand.Reader, m)
-			if err != nil {
-				log.Printf("failed to generate random number: %v", err)
-				continue
-			}
-			token[i] = IdentifierCharset[randIndex.Int64()]
+	rejected := 0
+	for attempt := 0; attempt < attempts; {
+		token, tokenErr := randomToken(length)
+		if tokenErr != nil {
+			return nil, tokenErr
 		}
 
-		id := fmt.Sprintf("%4d%v", time.Now().UTC().Year(), string(token))
-
-		identifier, identifierErr := ParseIdentifier(id)
-		if identifierErr != nil {
-			attempts += 1
-			if attempts <= 17 {
-				return newToken(length, attempts)
+		if blocklist.Blocked(token) {
+			rejected++
+			if rejected > maxBlockedTokens {
+				return nil, &ExhaustedError{Rejected: rejected}
 			}
-			return nil, errors.New("failed to generate acceptable token after 17 attempts")
+			continue
+		}
+
+		attempt++
+		identifier, identifierErr := ParseIdentifier(fmt.Sprintf("%4d%v", year, token))
+		if identifierErr == nil {
+			return identifier, nil
 		}
-		return identifier, nil
 	}
+	return nil, fmt.Errorf("failed to generate acceptable token after %d attempts", attempts)
 }
 
-// generateIdentifier takes the databasePrefixPath and a newToken(length, attempts) and attempts an os.MkdirAll on the
-// filesystem to verify whether or not the identifier currently exists. The newToken(length, attempts) result is
-// converted to a filepath and then verified using an os.Stat. If the identifier/path exists, then this func is
-// recursively called up to the remaining attempts > 0. This func uses a semaphore that limits the concurrent runtime
-// of the func to 1. This ensures that there are not more than 1 attempt being made to write to the database prefix.
-func generateIdentifier(databasePrefixPath string, length int, attempts int) (*Identifier, error) {
-	valet := NewValet(databasePrefixPath)
-	valet.SafetyCheck()
-	var identifier string
-	cache, cacheErr := valet.GetCache(databasePrefixPath)
-	if cacheErr != nil {
-		return nil, cacheErr
+// NewIdentifierContext generates a random identifier and claims it inside databasePrefixPath. Each attempt draws a new
+// token, skips it when the blocklist rejects it and otherwise claims it with an exclusive .identifier file, so two
+// callers can never receive the same identifier. The loop stops when ctx is done, when a claim succeeds or when
+// opts.MaxAttempts tokens collided with existing identifiers, in which case an *ExhaustedError is returned.
+func NewIdentifierContext(ctx context.Context, databasePrefixPath string, opts IdentifierOptions) (*Identifier, error) {
+	if opts.Length == 0 {
+		opts.Length = DefaultIdentifierLength
 	}
-	attemptedIdentifier, attemptErr := newToken(length, attempts)
-	if attemptErr != nil {
-		return nil, attemptErr
+	if opts.Length < 1 || opts.Length > maxTokenLength {
+		return nil, fmt.Errorf("identifier length must be between 1 and %d", maxTokenLength)
 	}
-	identifierPath := IdentifierPath(attemptedIdentifier.String())
-	path := filepath.Join(databasePrefixPath, identifierPath)
-	_, infoErr := os.Stat(path)
-	if infoErr != nil {
-		// error with path, lets create it
-		err := os.MkdirAll(path, 0700)
-		if err != nil {
-			return nil, err
+	if opts.MaxAttempts < 1 {
+		opts.MaxAttempts = DefaultIdentifierAttempts
+	}
+	if opts.Year == 0 {
+		opts.Year = time.Now().UTC().Year()
+	}
+	if opts.Year < 1000 || opts.Year > 9999 {
+		return nil, ErrInvalidYear
+	}
+	if opts.Blocklist == nil {
+		opts.Blocklist = TokenBlocklist()
+	}
+	_, statErr := os.Stat(databasePrefixPath)
+	if statErr != nil {
+		return nil, statErr
+	}
+
+	cache := &Cache{ctx: ctx, Path: databasePrefixPath}
+	cache.SafetyCheck()
+
+	exhausted := &ExhaustedError{}
+	for exhausted.Attempts < opts.MaxAttempts {
+		ctxErr := ctx.Err()
+		if ctxErr != nil {
+			return nil, ctxErr
 		}
-		err = cache.Write(attemptedIdentifier.String(), 1)
-		if err != nil {
-			log.Printf("failed to cache.Write(%v, 1) due to err %v", identifier, err)
-			return nil, err
+
+		identifier, tokenErr := newToken(opts.Length, 1, opts.Year, opts.Blocklist)
+		var rejected *ExhaustedError
+		if errors.As(tokenErr, &rejected) {
+			exhausted.Rejected += rejected.Rejected
+			return nil, exhausted
+		}
+		if tokenErr != nil {
+			return nil, tokenErr
+		}
+
+		exhausted.Attempts++
+		claimErr := cache.claimIdentifier(identifier)
+		if errors.Is(claimErr, ErrIdentifierTaken) {
+			exhausted.Collisions++
+			continue
 		}
-		return attemptedIdentifier, nil
-	} else {
-		log.Printf("[retrying] identifier exists at path: %v", path)
-		attempts += 1
-		if attempts <= 17 {
-			return generateIdentifier(databasePrefixPath, length, attempts)
+		if claimErr != nil {
+			return nil, claimErr
 		}
-		return nil, errors.New("failed to acquire new unique identifier within allotted attempt window of opportunity")
+		return identifier, nil
 	}
+	return nil, exhausted
+}
+
+// generateIdentifier claims a random identifier of length characters inside databasePrefixPath, trying up to
+// attempts tokens before giving up with an *ExhaustedError.
+func generateIdentifier(databasePrefixPath string, length int, attempts int) (*Identifier, error) {
+	return NewIdentifierContext(context.Background(), databasePrefixPath, IdentifierOptions{
+		Length:      length,
+		MaxAttempts: attempts,
+	})
 }
@@ -1,6 +1,9 @@
 package go_apario_identifier
 
 import (
+	`context`
+	`errors`
+	`log`
 	`os`
 	`testing`
 	`time`
@@ -83,7 +86,7 @@ func Test_newToken(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			got, err := newToken(tt.args.length, tt.args.attempts)
+			got, err := newToken(tt.args.length, tt.args.attempts, time.Now().UTC().Year(), TokenBlocklist())
 			if (tt.wantErr && err == nil) || (!tt.wantErr && err != nil) {
 				t.Errorf("newToken() error = %v, wantErr %v", err, tt.wantErr)
 				return
@@ -154,3 +157,60 @@ func Test_generateIdentifier(t *testing.T) {
 		})
 	}
 }
+
+func TestNewIdentifierContext(t *testing.T) {
+	db, err := os.MkdirTemp("", "context.db")
+	if err != nil {
+		t.Errorf("os.MkdirTemp() received err %v", err)
+		return
+	}
+	defer func(path string) {
+		err := os.RemoveAll(path)
+		if err != nil {
+			log.Printf("os.RemoveAll(%v) returned err %v", path, err)
+		}
+	}(db)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, canceledErr := NewIdentifierContext(ctx, db, IdentifierOptions{})
+	if !errors.Is(canceledErr, context.Canceled) {
+		t.Errorf("expected context.Canceled ; got %v", canceledErr)
+		return
+	}
+
+	// claim every single character fragment so that the generator can only collide
+	valet := NewValet(db)
+	for _, code := range IdentifierCharset {
+		_, claimErr := valet.ClaimID(db, 2024, string(code))
+		if claimErr != nil {
+			t.Errorf("valet.ClaimID(db, 2024, %v) returned err %v", string(code), claimErr)
+			return
+		}
+	}
+
+	_, exhaustedErr := NewIdentifierContext(context.Background(), db, IdentifierOptions{
+		Length:      1,
+		MaxAttempts: 9,
+		Year:        2024,
+		Blocklist:   NewBlocklist(),
+	})
+	var exhausted *ExhaustedError
+	if !errors.As(exhaustedErr, &exhausted) || !errors.Is(exhaustedErr, ErrIdentifiersExhausted) {
+		t.Errorf("expected *ExhaustedError ; got %v", exhaustedErr)
+		return
+	}
+	if exhausted.Attempts != 9 || exhausted.Collisions != 9 {
+		t.Errorf("expected 9 attempts and 9 collisions ; got %d attempts and %d collisions", exhausted.Attempts, exhausted.Collisions)
+		return
+	}
+
+	id, idErr := NewIdentifierContext(context.Background(), db, IdentifierOptions{Length: 2, Year: 2024})
+	if idErr != nil {
+		t.Errorf("NewIdentifierContext() returned err %v", idErr)
+		return
+	}
+	if len(id.Fragment) != 2 || id.Year != 2024 {
+		t.Errorf("expected a 2 character fragment in 2024 ; got %v", id.String())
+	}
+}
@@ -0,0 +1,383 @@
+package go_apario_identifier
+
+import (
+	`context`
+	`errors`
+	`fmt`
+	`io/fs`
+	`os`
+	`path/filepath`
+	`strconv`
+	`strings`
+	`time`
+)
+
+// FsckIssueKind names a kind of problem Fsck finds in a database
+type FsckIssueKind string
+
+const (
+	// FsckIdentifierMismatch is a .identifier file that does not hold the identifier of its directory
+	FsckIdentifierMismatch FsckIssueKind = "identifier_mismatch"
+	// FsckIdentifierMissing is a directory holding files without a .identifier file
+	FsckIdentifierMissing FsckIssueKind = "identifier_missing"
+	// FsckOrphanDirectory is a shard directory with no identifier or file anywhere below it
+	FsckOrphanDirectory FsckIssueKind = "orphan_directory"
+	// FsckStaleLock is a .locked or .rlocked-<token> file whose lease has expired
+	FsckStaleLock FsckIssueKind = "stale_lock"
+	// FsckInvalidSema is a .sema file that does not hold a limit of at least 1
+	FsckInvalidSema FsckIssueKind = "invalid_sema"
+	// FsckCorruptLastID is a .lastid file that does not hold a counter of at least 1
+	FsckCorruptLastID FsckIssueKind = "corrupt_lastid"
+)
+
+// FsckIssue is one problem found by Fsck
+type FsckIssue struct {
+	Kind        FsckIssueKind `json:"kind"`
+	Path        string        `json:"path"`
+	Identifier  string        `json:"identifier,omitempty"`
+	Detail      string        `json:"detail"`
+	Repaired    bool          `json:"repaired"`
+	RepairError string        `json:"repair_error,omitempty"`
+}
+
+// FsckOptions configures Fsck
+type FsckOptions struct {
+	Repair bool `json:"repair"` // fix the issues that can be fixed safely instead of only reporting them
+}
+
+// FsckReport is what Fsck found in a database ; it is meant to be written out as JSON
+type FsckReport struct {
+	Database    string      `json:"database"`
+	Repair      bool        `json:"repair"`
+	Started     time.Time   `json:"started"`
+	Finished    time.Time   `json:"finished"`
+	Directories int         `json:"directories"`
+	Identifiers int         `json:"identifiers"`
+	Issues      []FsckIssue `json:"issues"`
+}
+
+// OK returns true when every issue in the report was repaired
+func (r *FsckReport) OK() bool {
+	for _, issue := range r.Issues {
+		if !issue.Repaired {
+			return false
+		}
+	}
+	return true
+}
+
+// fsck holds the state of one run of Fsck
+type fsck struct {
+	c        *Cache
+	ctx      context.Context
+	root     string
+	repair   bool
+	now      time.Time
+	counters map[int64]bool // counters NextID could have issued, used to repair .lastid
+	report   *FsckReport
+}
+
+// Fsck walks the database and reports mismatched or missing .identifier files, orphan shard directories, stale lock
+// files, invalid .sema values and a corrupt .lastid. With opts.Repair set it also fixes what can be fixed without
+// guessing:
+//   - a .identifier that is empty or unparsable is rewritten, and a missing one is written, when the directory's path
+//     is a valid identifier ; a .identifier naming another identifier is only reported
+//   - orphan directories untouched for a full lock lease are removed
+//   - stale locks are reaped the same way ReapStaleLocks does
+//   - an invalid .sema is removed so the identifier falls back to a limit of 1
+//   - a corrupt .lastid is rewritten with the last counter of the unbroken run NextID issued from 2 onward ; random and
+//     vanity fragments are not counters NextID produced and are ignored
+//
+// Directories starting with a dot (transactions, indexes, tombstones) are not checked.
+func (c *Cache) Fsck(ctx context.Context, opts FsckOptions) (*FsckReport, error) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	c.SafetyCheck()
+	f := &fsck{
+		c:      c,
+		ctx:    ctx,
+		root:   filepath.Clean(c.Path),
+		repair: opts.Repair,
+		now:    time.Now().UTC(),
+		report: &FsckReport{Database: c.Path, Repair: opts.Repair, Started: time.Now().UTC(), Issues: []FsckIssue{}},
+	}
+	_, walkErr := f.dir(f.root, nil)
+	if walkErr == nil {
+		f.lastID()
+	}
+	f.report.Finished = time.Now().UTC()
+	return f.report, walkErr
+}
+
+// issue records an issue and, when repairing, fixes it with fix
+func (f *fsck) issue(issue FsckIssue, fix func() error) {
+	if f.repair && fix != nil {
+		fixErr := fix()
+		if fixErr != nil {
+			issue.RepairError = fixErr.Error()
+		} else {
+			issue.Repaired = true
+		}
+	}
+	f.report.Issues = append(f.report.Issues, issue)
+}
+
+// dir checks the directory at path, whose path relative to the database is made of segments, and everything below
+// it. It returns true when neither the directory nor anything below it holds a file.
+func (f *fsck) dir(path string, segments []string) (bool, error) {
+	ctxErr := f.ctx.Err()
+	if ctxErr != nil {
+		return false, ctxErr
+	}
+	entries, readDirErr := os.ReadDir(path)
+	if readDirErr != nil {
+		if errors.Is(readDirErr, fs.ErrNotExist) {
+			return false, nil // removed while checking
+		}
+		return false, readDirErr
+	}
+	if path != f.root {
+		f.report.Directories++
+	}
+
+	empty := true
+	var emptyChildren []string
+	hasFiles := false
+	for _, entry := range entries {
+		if entry.IsDir() {
+			if strings.HasPrefix(entry.Name(), ".") {
+				empty = false // bookkeeping of the database, or of an identifier, such as .txn
+				continue
+			}
+			childEmpty, childErr := f.dir(filepath.Join(path, entry.Name()), append(segments[:len(segments):len(segments)], entry.Name()))
+			if childErr != nil {
+				return false, childErr
+			}
+			if childEmpty {
+				emptyChildren = append(emptyChildren, filepath.Join(path, entry.Name()))
+			} else {
+				empty = false
+			}
+			continue
+		}
+		empty = false
+		if path == f.root {
+			continue // .lastid and the like are checked once the walk is done
+		}
+		switch name := entry.Name(); {
+		case name == ".locked", isSharedLockFile(name):
+			f.lock(filepath.Join(path, name))
+		case name == ".sema":
+			f.sema(filepath.Join(path, name), segments)
+		case name != ".identifier" && !strings.HasPrefix(name, "."):
+			hasFiles = true
+		}
+	}
+
+	if path != f.root {
+		f.identifier(path, segments, hasFiles)
+	}
+	if empty && path != f.root {
+		return true, nil // the parent reports the topmost empty directory
+	}
+	for _, orphan := range emptyChildren {
+		f.orphan(orphan)
+	}
+	return false, nil
+}
+
+// identifier checks the .identifier file of the directory at path
+func (f *fsck) identifier(path string, segments []string, hasFiles bool) {
+	expected := strings.ToUpper(strings.Join(segments, ``))
+	idPath := filepath.Join(path, ".identifier")
+	idBytes, readErr := os.ReadFile(idPath)
+	valid := validIdentifier(expected)
+	rewrite := func() error {
+		if !valid {
+			return errors.New("the directory path is not a valid identifier")
+		}
+		return f.c.writeFile(idPath, []byte(expected))
+	}
+	if readErr != nil {
+		if !errors.Is(readErr, fs.ErrNotExist) {
+			f.issue(FsckIssue{Kind: FsckIdentifierMismatch, Path: idPath, Identifier: expected, Detail: readErr.Error()}, nil)
+			return
+		}
+		if hasFiles {
+			f.issue(FsckIssue{
+				Kind:       FsckIdentifierMissing,
+				Path:       idPath,
+				Identifier: expected,
+				Detail:     "directory holds files but has no .identifier",
+			}, rewrite)
+		}
+		return
+	}
+
+	f.report.Identifiers++
+	f.counterOf(expected)
+	found := strings.ToUpper(strings.TrimSpace(string(idBytes)))
+	if found == expected {
+		return
+	}
+	issue := FsckIssue{Kind: FsckIdentifierMismatch, Path: idPath, Identifier: expected}
+	if validIdentifier(found) {
+		issue.Detail = "holds " + found + " ; the directory is used by another identifier"
+		f.issue(issue, nil)
+		return
+	}
+	issue.Detail = "holds " + strconv.Quote(string(idBytes))
+	f.issue(issue, rewrite)
+}
+
+// validIdentifier returns true when identifier is a year followed by a fragment
+func validIdentifier(identifier string) bool {
+	if len(identifier) <= 4 {
+		return false // ParseIdentifier needs the four digits of the year
+	}
+	_, parseErr := ParseIdentifier(identifier)
+	return parseErr == nil
+}
+
+// counterOf remembers the counter of identifier when NextID could have issued it, so that .lastid can be repaired. The
+// fragment must be the base36 encoding of its counter, which rules out fragments with a leading zero.
+func (f *fsck) counterOf(identifier string) {
+	if len(identifier) <= 4 {
+		return
+	}
+	fragment := identifier[4:]
+	counter, decodeErr := DecodeBase36(fragment)
+	if decodeErr != nil || counter < 1 || EncodeBase36(counter) != fragment {
+		return
+	}
+	if f.counters == nil {
+		f.counters = make(map[int64]bool)
+	}
+	f.counters[int64(counter)] = true
+}
+
+// lastCounter returns the last counter NextID issued. NextID counts up from .lastid and skips the identifiers that are
+// taken, so every counter up to the last one issued is an identifier or a tombstone ; counters past the first gap
+// belong to random or vanity identifiers. Tombstones that were purged shorten the run, which only makes NextID skip
+// the identifiers that are taken once more.
+func (f *fsck) lastCounter() int64 {
+	tombstones, _ := f.c.Tombstones()
+	for _, tombstone := range tombstones {
+		f.counterOf(strings.ToUpper(tombstone.Identifier))
+	}
+	last := int64(1)
+	for f.counters[last+1] {
+		last++
+	}
+	return last
+}
+
+// lock checks the lock file at path
+func (f *fsck) lock(path string) {
+	holder, holderErr := f.c.lockHolderAt(path)
+	if holderErr == nil && !holder.expired(f.now) {
+		return
+	}
+	issue := FsckIssue{Kind: FsckStaleLock, Path: path}
+	if holderErr == nil {
+		issue.Identifier = holder.Identifier
+		issue.Detail = "lease expired at " + holder.Expires.Format(time.RFC3339)
+	} else {
+		info, statErr := os.Stat(path)
+		if statErr != nil || f.now.Sub(info.ModTime()) < DefaultLockTTL {
+			return // unreadable while it is being written, or removed already
+		}
+		issue.Detail = "unreadable lock file untouched since " + info.ModTime().UTC().Format(time.RFC3339)
+	}
+	f.issue(issue, func() error {
+		reaped, reapErr := reapLockFile(path, f.now)
+		if reapErr == nil && !reaped {
+			return errors.New("the lock was renewed or released while it was being reaped")
+		}
+		return reapErr
+	})
+}
+
+// sema checks the .sema file at path
+func (f *fsck) sema(path string, segments []string) {
+	semaBytes, readErr := os.ReadFile(path)
+	if readErr != nil {
+		return
+	}
+	limit, parseErr := strconv.ParseInt(string(semaBytes), 10, 64)
+	if parseErr == nil && limit >= 1 {
+		return
+	}
+	f.issue(FsckIssue{
+		Kind:       FsckInvalidSema,
+		Path:       path,
+		Identifier: strings.ToUpper(strings.Join(segments, ``)),
+		Detail:     "holds " + strconv.Quote(string(semaBytes)),
+	}, func() error {
+		return os.Remove(path)
+	})
+}
+
+// orphan reports the empty directory at path and removes it when repairing and it has not changed for a full lock
+// lease, so that a directory created for an identifier that is being claimed right now is left alone
+func (f *fsck) orphan(path string) {
+	f.issue(FsckIssue{Kind: FsckOrphanDirectory, Path: path, Detail: "no identifier or file below it"}, func() error {
+		return f.removeEmpty(path)
+	})
+}
+
+// removeEmpty removes the directory at path and the directories below it, bottom-up, with os.Remove so that a file
+// written below it since the walk makes the removal fail instead of being deleted. A directory that changed within a
+// lock lease is left alone.
+func (f *fsck) removeEmpty(path string) error {
+	info, statErr := os.Stat(path)
+	if statErr != nil {
+		return statErr
+	}
+	if f.now.Sub(info.ModTime()) < f.c.lockTTL() {
+		return errors.New("changed too recently to be removed safely")
+	}
+	entries, readDirErr := os.ReadDir(path)
+	if readDirErr != nil {
+		return readDirErr
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			return fmt.Errorf("%v is no longer empty", path)
+		}
+		removeErr := f.removeEmpty(filepath.Join(path, entry.Name()))
+		if removeErr != nil {
+			return removeErr
+		}
+	}
+	return os.Remove(path)
+}
+
+// lastID checks the .lastid file of a countable database
+func (f *fsck) lastID() {
+	path := filepath.Join(f.root, ".lastid")
+	lastBytes, readErr := os.ReadFile(path)
+	if readErr != nil {
+		if !errors.Is(readErr, fs.ErrNotExist) {
+			f.issue(FsckIssue{Kind: FsckCorruptLastID, Path: path, Detail: readErr.Error()}, nil)
+		}
+		return
+	}
+	last, parseErr := strconv.ParseInt(string(lastBytes), 10, 64)
+	if parseErr == nil && last >= 1 {
+		return
+	}
+	f.issue(FsckIssue{Kind: FsckCorruptLastID, Path: path, Detail: "holds " + strconv.Quote(string(lastBytes))}, func() error {
+		return f.c.writeFile(path, []byte(strconv.FormatInt(f.lastCounter(), 10)))
+	})
+}
+
+// Fsck checks, and optionally repairs, the database at databasePath ; see Cache.Fsck
+func (v *Valet) Fsck(ctx context.Context, databasePath string, opts FsckOptions) (*FsckReport, error) {
+	c, cErr := v.cache(databasePath)
+	if cErr != nil {
+		return nil, cErr
+	}
+	return c.Fsck(ctx, opts)
+}
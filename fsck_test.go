@@ -0,0 +1,146 @@
+package go_apario_identifier
+
+import (
+	`context`
+	`encoding/json`
+	`log`
+	`os`
+	`path/filepath`
+	`testing`
+	`time`
+)
+
+// fsckKinds counts the issues of report by kind
+func fsckKinds(report *FsckReport) map[FsckIssueKind]int {
+	kinds := map[FsckIssueKind]int{}
+	for _, issue := range report.Issues {
+		kinds[issue.Kind]++
+	}
+	return kinds
+}
+
+func TestCache_Fsck(t *testing.T) {
+	db, err := os.MkdirTemp("", "fsck.db")
+	if err != nil {
+		t.Errorf("os.MkdirTemp() received err %v", err)
+		return
+	}
+	defer func(path string) {
+		err := os.RemoveAll(path)
+		if err != nil {
+			log.Printf("os.RemoveAll(%v) returned err %v", path, err)
+		}
+	}(db)
+
+	valet := NewValet(db)
+	cache, _ := valet.GetCache(db)
+	ctx := context.Background()
+	dir := func(identifier string) string {
+		path := filepath.Join(db, IdentifierPath(identifier))
+		_ = os.MkdirAll(path, 0700)
+		return path
+	}
+
+	_, _ = valet.ClaimID(db, 1961, "ACE")
+	_ = os.WriteFile(filepath.Join(dir("1961ACE"), ".sema"), []byte("zero"), 0600)
+	staleBytes, _ := json.Marshal(&LockHolder{Identifier: "1961ACE", Token: "stale", Expires: time.Now().Add(-time.Hour)})
+	_ = os.WriteFile(filepath.Join(dir("1961ACE"), ".locked"), staleBytes, 0600)
+	_ = os.WriteFile(filepath.Join(dir("1961BEE"), ".identifier"), []byte("1961ACE"), 0600)
+	_ = os.WriteFile(filepath.Join(dir("1961CAT"), ".identifier"), []byte("??"), 0600)
+	_ = os.WriteFile(filepath.Join(dir("1961DOG"), "record.json"), []byte("{}"), 0600)
+	_ = os.MkdirAll(filepath.Join(db, "1999", "Z", "Z"), 0700)
+	old := time.Now().Add(-time.Hour)
+	for _, orphan := range []string{"1999/Z/Z", "1999/Z", "1999"} {
+		_ = os.Chtimes(filepath.Join(db, filepath.FromSlash(orphan)), old, old)
+	}
+	_ = os.MkdirAll(filepath.Join(db, "1998", "Q"), 0700)
+	_ = os.WriteFile(filepath.Join(db, ".lastid"), []byte("abc"), 0600)
+	for _, counted := range []string{"19612", "19613", "19624", "19626"} {
+		_ = os.WriteFile(filepath.Join(dir(counted), ".identifier"), []byte(counted), 0600)
+	}
+	_ = cache.writeTombstone("19625", time.Now())
+
+	report, fsckErr := cache.Fsck(ctx, FsckOptions{})
+	if fsckErr != nil {
+		t.Errorf("cache.Fsck() returned err %v", fsckErr)
+		return
+	}
+	expected := map[FsckIssueKind]int{
+		FsckIdentifierMismatch: 2,
+		FsckIdentifierMissing:  1,
+		FsckOrphanDirectory:    2,
+		FsckStaleLock:          1,
+		FsckInvalidSema:        1,
+		FsckCorruptLastID:      1,
+	}
+	kinds := fsckKinds(report)
+	for kind, count := range expected {
+		if kinds[kind] != count {
+			t.Errorf("expected %d %v issues ; got %d in %+v", count, kind, kinds[kind], report.Issues)
+			return
+		}
+	}
+	if report.OK() || report.Identifiers != 7 || !cache.PathExists(filepath.Join(db, "1999")) {
+		t.Errorf("expected a report of 7 identifiers without repairs ; got %+v", report)
+		return
+	}
+	if _, jsonErr := json.Marshal(report); jsonErr != nil {
+		t.Errorf("json.Marshal(report) returned err %v", jsonErr)
+		return
+	}
+
+	report, fsckErr = valet.Fsck(ctx, db, FsckOptions{Repair: true})
+	if fsckErr != nil {
+		t.Errorf("valet.Fsck() returned err %v", fsckErr)
+		return
+	}
+	for _, issue := range report.Issues {
+		repairable := !(issue.Kind == FsckIdentifierMismatch && issue.Identifier == "1961BEE") &&
+			issue.Path != filepath.Join(db, "1998")
+		if issue.Repaired != repairable {
+			t.Errorf("expected %v to be repaired %v ; got %+v", issue.Path, repairable, issue)
+			return
+		}
+	}
+	if cache.PathExists(filepath.Join(db, "1999")) || !cache.PathExists(filepath.Join(db, "1998")) {
+		t.Errorf("expected only the orphan untouched for a lease to be removed")
+		return
+	}
+	if cache.PathExists(filepath.Join(dir("1961ACE"), ".locked")) || cache.PathExists(filepath.Join(dir("1961ACE"), ".sema")) {
+		t.Errorf("expected the stale lock and invalid .sema of 1961ACE to be removed")
+		return
+	}
+	for _, identifier := range []string{"1961CAT", "1961DOG"} {
+		idBytes, _ := os.ReadFile(filepath.Join(dir(identifier), ".identifier"))
+		if string(idBytes) != identifier {
+			t.Errorf("expected the .identifier of %v to be written ; got %q", identifier, idBytes)
+			return
+		}
+	}
+	// 2, 3 and 4 are identifiers and 5 is tombstoned, so NextID issued up to 6 ; ACE and CAT are vanity fragments
+	lastBytes, _ := os.ReadFile(filepath.Join(db, ".lastid"))
+	if string(lastBytes) != "6" {
+		t.Errorf("expected .lastid to be the last counter 6 ; got %q", lastBytes)
+		return
+	}
+
+	// a file written below an orphan after the walk is never removed with it
+	late := filepath.Join(db, "1997", "Y", "record.json")
+	_ = os.MkdirAll(filepath.Dir(late), 0700)
+	_ = os.WriteFile(late, []byte("{}"), 0600)
+	for _, orphan := range []string{"1997/Y", "1997"} {
+		_ = os.Chtimes(filepath.Join(db, filepath.FromSlash(orphan)), old, old)
+	}
+	f := &fsck{c: cache, now: time.Now()}
+	if f.removeEmpty(filepath.Join(db, "1997")) == nil || !cache.PathExists(late) {
+		t.Errorf("expected the removal of a directory that is no longer empty to fail and keep %v", late)
+		return
+	}
+	_ = os.RemoveAll(filepath.Join(db, "1997"))
+
+	report, _ = cache.Fsck(ctx, FsckOptions{})
+	kinds = fsckKinds(report)
+	if len(report.Issues) != 2 || kinds[FsckIdentifierMismatch] != 1 || kinds[FsckOrphanDirectory] != 1 {
+		t.Errorf("expected only the issues that cannot be repaired to remain ; got %+v", report.Issues)
+	}
+}
@@ -0,0 +1,659 @@
+package go_apario_identifier
+
+import (
+	`context`
+	`encoding/hex`
+	`encoding/json`
+	`errors`
+	`fmt`
+	`io/fs`
+	`math`
+	`os`
+	`path/filepath`
+	`reflect`
+	`sort`
+	`strconv`
+	`strings`
+	`time`
+	`unicode`
+)
+
+const (
+	// textDirectory is the directory inside of a database that holds its full-text indexes
+	textDirectory = ".fulltext"
+	// textPostings is the directory inside of a term's directory that holds one file per identifier containing the
+	// term, so indexing a document only writes the files of that document
+	textPostings = ".postings"
+	// textDocuments is the directory inside of a full-text index that remembers the terms of each identifier
+	textDocuments = ".documents"
+	// textCount holds the number of identifiers in a full-text index
+	textCount = ".count"
+	// textLock is the lock file guarding the .count of a full-text index, or the .terms of one of its documents
+	textLock = ".locked"
+	// DefaultTextIndex is the name of a TextIndex when TextIndexOptions.Name is empty
+	DefaultTextIndex = "text"
+)
+
+var ErrTextQuery Err = errors.New("invalid full-text query")
+
+// TextIndexOptions configures a TextIndex
+type TextIndexOptions struct {
+	Name     string                     `json:"name"`  // directory of the index inside of .fulltext ; defaults to DefaultTextIndex
+	Files    []string                   `json:"files"` // files inside of each identifier that IndexFiles reads by default
+	Tokenize func(text string) []string `json:"-"`     // splits text into terms ; defaults to Tokenize
+}
+
+// TextHit is an identifier matching a full-text query and how well it matched
+type TextHit struct {
+	Identifier string  `json:"identifier"`
+	Score      float64 `json:"score"`
+}
+
+// textPostingList maps identifiers to the positions of a term in each of their fields
+type textPostingList map[string]textPosting
+
+// textPosting maps the fields of one identifier to the positions of a term in them
+type textPosting map[string][]int
+
+// textDocument is what a full-text index remembers about an identifier so that it can be removed again
+type textDocument struct {
+	Terms []string `json:"terms"`
+}
+
+// TextIndex is an inverted index over text stored under identifiers. Each term has a directory under
+// .fulltext/<name> that is sharded the way IdentifierPath shards identifiers, so terms sharing a prefix share
+// directories and prefix queries only read the part of the tree below the prefix. The postings of a term hold one file
+// per identifier, and the documents and the count of the index are updated under lock files, so several processes can
+// index the same database at once.
+type TextIndex struct {
+	cache    *Cache
+	root     string
+	files    []string
+	tokenize func(text string) []string
+}
+
+// NewTextIndex returns the full-text index called opts.Name inside of the database of c
+func NewTextIndex(c *Cache, opts TextIndexOptions) (*TextIndex, error) {
+	if c == nil {
+		return nil, ErrNoSuchDatabase
+	}
+	if len(opts.Name) == 0 {
+		opts.Name = DefaultTextIndex
+	}
+	nameErr := validIndexName(opts.Name)
+	if nameErr != nil {
+		return nil, nameErr
+	}
+	for _, file := range opts.Files {
+		fileErr := validTxFileName(file)
+		if fileErr != nil {
+			return nil, fileErr
+		}
+	}
+	if opts.Tokenize == nil {
+		opts.Tokenize = Tokenize
+	}
+	c.SafetyCheck()
+	return &TextIndex{
+		cache:    c,
+		root:     filepath.Join(c.Path, textDirectory, opts.Name),
+		files:    opts.Files,
+		tokenize: opts.Tokenize,
+	}, nil
+}
+
+// Tokenize splits text into lower case terms on everything that is not a letter or a digit
+func Tokenize(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// termKey encodes term as upper case hex so that any term is a valid path and a prefix of a term encodes to a prefix
+// of its key
+func termKey(term string) string {
+	return strings.ToUpper(hex.EncodeToString([]byte(term)))
+}
+
+// termPath returns the directory of term
+func (t *TextIndex) termPath(term string) string {
+	return filepath.Join(t.root, IdentifierPath(termKey(term)))
+}
+
+// documentPath returns the file remembering the terms of identifier
+func (t *TextIndex) documentPath(identifier string) string {
+	return filepath.Join(t.root, textDocuments, IdentifierPath(identifier), ".terms")
+}
+
+// readPostings returns the postings of every identifier containing term
+func (t *TextIndex) readPostings(term string) (textPostingList, error) {
+	dir := filepath.Join(t.termPath(term), textPostings)
+	postings := textPostingList{}
+	entries, readDirErr := os.ReadDir(dir)
+	if readDirErr != nil {
+		if errors.Is(readDirErr, fs.ErrNotExist) {
+			return postings, nil
+		}
+		return nil, readDirErr
+	}
+	for _, entry := range entries {
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			continue // temporary files of writes in progress
+		}
+		postingBytes, readErr := os.ReadFile(filepath.Join(dir, entry.Name()))
+		if readErr != nil {
+			if errors.Is(readErr, fs.ErrNotExist) {
+				continue // removed since the listing
+			}
+			return nil, readErr
+		}
+		posting := textPosting{}
+		jsonErr := json.Unmarshal(postingBytes, &posting)
+		if jsonErr != nil {
+			return nil, fmt.Errorf("corrupt posting of %v for %q: %w", entry.Name(), term, jsonErr)
+		}
+		postings[entry.Name()] = posting
+	}
+	return postings, nil
+}
+
+// writePosting records the positions of term in the fields of identifier
+func (t *TextIndex) writePosting(term string, identifier string, posting textPosting) error {
+	postingBytes, jsonErr := json.Marshal(posting)
+	if jsonErr != nil {
+		return jsonErr
+	}
+	dir := filepath.Join(t.termPath(term), textPostings)
+	mkdirErr := os.MkdirAll(dir, 0700)
+	if mkdirErr != nil {
+		return mkdirErr
+	}
+	return t.cache.writeFile(filepath.Join(dir, identifier), postingBytes)
+}
+
+// removePosting drops identifier from the postings of term
+func (t *TextIndex) removePosting(term string, identifier string) error {
+	rmErr := os.Remove(filepath.Join(t.termPath(term), textPostings, identifier))
+	if rmErr != nil && !os.IsNotExist(rmErr) {
+		return rmErr
+	}
+	return nil
+}
+
+// lock takes the lock file at path, reaping it when its holder let the lease expire, and returns the function that
+// releases it
+func (t *TextIndex) lock(ctx context.Context, path string) (func(), error) {
+	mkdirErr := os.MkdirAll(filepath.Dir(path), 0700)
+	if mkdirErr != nil {
+		return nil, mkdirErr
+	}
+	lease := t.cache.newLockHolder(``, textDirectory)
+	leaseBytes, jsonErr := json.Marshal(lease)
+	if jsonErr != nil {
+		return nil, jsonErr
+	}
+	lockErr := t.cache.waitLock(ctx, false, func() (bool, error) {
+		for {
+			createErr := createLockFile(path, leaseBytes)
+			if createErr == nil {
+				return true, nil
+			}
+			if !errors.Is(createErr, fs.ErrExist) {
+				return false, createErr
+			}
+			reaped, reapErr := reapLockFile(path, time.Now().UTC())
+			if reapErr != nil || !reaped {
+				return false, nil
+			}
+		}
+	})
+	if lockErr != nil {
+		return nil, lockErr
+	}
+	return func() {
+		releaseLockFile(path, lease.Token)
+	}, nil
+}
+
+// count returns the number of identifiers in the index
+func (t *TextIndex) count() int64 {
+	countBytes, readErr := os.ReadFile(filepath.Join(t.root, textCount))
+	if readErr != nil {
+		return 0
+	}
+	count, parseErr := strconv.ParseInt(strings.TrimSpace(string(countBytes)), 10, 64)
+	if parseErr != nil {
+		return 0
+	}
+	return count
+}
+
+// addCount changes the number of identifiers in the index by delta
+func (t *TextIndex) addCount(ctx context.Context, delta int64) error {
+	if delta == 0 {
+		return nil
+	}
+	unlock, lockErr := t.lock(ctx, filepath.Join(t.root, textLock))
+	if lockErr != nil {
+		return lockErr
+	}
+	defer unlock()
+	return t.cache.writeFile(filepath.Join(t.root, textCount), []byte(strconv.FormatInt(max(t.count()+delta, 0), 10)))
+}
+
+// IndexText replaces the text indexed for identifier with fields, which maps a field name (such as a record field or
+// a file name) to its text
+func (t *TextIndex) IndexText(ctx context.Context, identifier string, fields map[string]string) error {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	identifier = strings.ToUpper(identifier)
+	postings := map[string]textPosting{}
+	for field, text := range fields {
+		for position, term := range t.tokenize(text) {
+			if _, exists := postings[term]; !exists {
+				postings[term] = textPosting{}
+			}
+			postings[term][field] = append(postings[term][field], position)
+		}
+	}
+
+	documentPath := t.documentPath(identifier)
+	unlock, lockErr := t.lock(ctx, filepath.Join(filepath.Dir(documentPath), textLock))
+	if lockErr != nil {
+		return lockErr
+	}
+	defer unlock()
+	removed, removeErr := t.remove(ctx, identifier, postings)
+	if removeErr != nil {
+		return removeErr
+	}
+	terms := make([]string, 0, len(postings))
+	for term, posting := range postings {
+		ctxErr := ctx.Err()
+		if ctxErr != nil {
+			return ctxErr
+		}
+		writeErr := t.writePosting(term, identifier, posting)
+		if writeErr != nil {
+			return writeErr
+		}
+		terms = append(terms, term)
+	}
+	sort.Strings(terms)
+
+	if len(terms) == 0 {
+		if removed {
+			return t.addCount(ctx, -1)
+		}
+		return nil
+	}
+	documentBytes, jsonErr := json.Marshal(textDocument{Terms: terms})
+	if jsonErr != nil {
+		return jsonErr
+	}
+	mkdirErr := os.MkdirAll(filepath.Dir(documentPath), 0700)
+	if mkdirErr != nil {
+		return mkdirErr
+	}
+	writeErr := t.cache.writeFile(documentPath, documentBytes)
+	if writeErr != nil {
+		return writeErr
+	}
+	if !removed {
+		return t.addCount(ctx, 1)
+	}
+	return nil
+}
+
+// IndexFiles indexes the contents of files inside of identifier, or of TextIndexOptions.Files when none are given.
+// Files that do not exist are indexed as empty, and so is every file of an identifier that has no directory.
+func (t *TextIndex) IndexFiles(ctx context.Context, identifier string, files ...string) error {
+	if len(files) == 0 {
+		files = t.files
+	}
+	if !t.cache.PathExists(filepath.Join(t.cache.Path, IdentifierPath(identifier))) {
+		return t.IndexText(ctx, identifier, nil) // locking it would create its directories
+	}
+	lockErr := t.cache.RLockIdentifierContext(ctx, identifier)
+	if lockErr != nil {
+		return lockErr
+	}
+	fields := make(map[string]string, len(files))
+	var readErr error
+	for _, file := range files {
+		nameErr := validTxFileName(file)
+		if nameErr != nil {
+			readErr = nameErr
+			break
+		}
+		fileBytes, fileErr := os.ReadFile(filepath.Join(t.cache.Path, IdentifierPath(identifier), file))
+		if fileErr != nil && !errors.Is(fileErr, fs.ErrNotExist) {
+			readErr = fileErr
+			break
+		}
+		fields[file] = string(fileBytes)
+	}
+	t.cache.RUnlockIdentifier(identifier)
+	if readErr != nil {
+		return readErr
+	}
+	return t.IndexText(ctx, identifier, fields)
+}
+
+// Remove removes identifier from the index
+func (t *TextIndex) Remove(ctx context.Context, identifier string) error {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	identifier = strings.ToUpper(identifier)
+	unlock, lockErr := t.lock(ctx, filepath.Join(filepath.Dir(t.documentPath(identifier)), textLock))
+	if lockErr != nil {
+		return lockErr
+	}
+	defer unlock()
+	removed, removeErr := t.remove(ctx, identifier, nil)
+	if removeErr != nil || !removed {
+		return removeErr
+	}
+	return t.addCount(ctx, -1)
+}
+
+// remove drops identifier from the postings of the terms it was indexed with, except for the terms in keep which are
+// about to be rewritten anyway. It returns true when identifier was indexed. The caller must hold the lock of the
+// document of identifier.
+func (t *TextIndex) remove(ctx context.Context, identifier string, keep map[string]textPosting) (bool, error) {
+	documentPath := t.documentPath(identifier)
+	documentBytes, readErr := os.ReadFile(documentPath)
+	if readErr != nil {
+		if errors.Is(readErr, fs.ErrNotExist) {
+			return false, nil
+		}
+		return false, readErr
+	}
+	document := textDocument{}
+	jsonErr := json.Unmarshal(documentBytes, &document)
+	if jsonErr != nil {
+		return false, fmt.Errorf("corrupt full-text document %v: %w", identifier, jsonErr)
+	}
+	for _, term := range document.Terms {
+		if _, kept := keep[term]; kept {
+			continue
+		}
+		ctxErr := ctx.Err()
+		if ctxErr != nil {
+			return false, ctxErr
+		}
+		rmErr := t.removePosting(term, identifier)
+		if rmErr != nil {
+			return false, rmErr
+		}
+	}
+	rmErr := os.Remove(documentPath)
+	if rmErr != nil && !os.IsNotExist(rmErr) {
+		return false, rmErr
+	}
+	return true, nil
+}
+
+// idf weighs a term found in documents identifiers out of the whole index
+func (t *TextIndex) idf(documents int) float64 {
+	return math.Log(1 + float64(max(t.count(), int64(documents)))/float64(max(documents, 1)))
+}
+
+// weight scores occurrences of a term that has the given idf
+func weight(occurrences int, idf float64) float64 {
+	return (1 + math.Log(float64(occurrences))) * idf
+}
+
+// termScores returns the score of every identifier containing term
+func (t *TextIndex) termScores(term string) (map[string]float64, error) {
+	list, readErr := t.readPostings(term)
+	if readErr != nil {
+		return nil, readErr
+	}
+	idf := t.idf(len(list))
+	scores := make(map[string]float64, len(list))
+	for identifier, fields := range list {
+		occurrences := 0
+		for _, positions := range fields {
+			occurrences += len(positions)
+		}
+		scores[identifier] = weight(occurrences, idf)
+	}
+	return scores, nil
+}
+
+// phraseScores returns the score of every identifier containing the terms of phrase next to each other in one field
+func (t *TextIndex) phraseScores(phrase []string) (map[string]float64, error) {
+	lists := make([]textPostingList, len(phrase))
+	idf := 0.0
+	for i, term := range phrase {
+		list, readErr := t.readPostings(term)
+		if readErr != nil {
+			return nil, readErr
+		}
+		lists[i] = list
+		idf += t.idf(len(list))
+	}
+	scores := map[string]float64{}
+	for identifier, fields := range lists[0] {
+		occurrences := 0
+		for field, starts := range fields {
+			for _, start := range starts {
+				if phraseAt(lists[1:], identifier, field, start) {
+					occurrences++
+				}
+			}
+		}
+		if occurrences > 0 {
+			scores[identifier] = weight(occurrences, idf)
+		}
+	}
+	return scores, nil
+}
+
+// phraseAt returns true when the terms of lists follow position start in field of identifier
+func phraseAt(lists []textPostingList, identifier string, field string, start int) bool {
+	for offset, list := range lists {
+		found := false
+		for _, position := range list[identifier][field] {
+			if position == start+offset+1 {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// prefixScores returns the score of every identifier containing a term that starts with prefix
+func (t *TextIndex) prefixScores(ctx context.Context, prefix string) (map[string]float64, error) {
+	segments := strings.Split(IdentifierPath(termKey(prefix)), string(os.PathSeparator))
+	parent := filepath.Join(append([]string{t.root}, segments[:len(segments)-1]...)...)
+	last := segments[len(segments)-1]
+	entries, readDirErr := os.ReadDir(parent)
+	if readDirErr != nil {
+		if os.IsNotExist(readDirErr) {
+			return map[string]float64{}, nil
+		}
+		return nil, readDirErr
+	}
+	scores := map[string]float64{}
+	for _, entry := range entries {
+		if !entry.IsDir() || !strings.HasPrefix(entry.Name(), last) {
+			continue
+		}
+		walkErr := filepath.WalkDir(filepath.Join(parent, entry.Name()), func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			ctxErr := ctx.Err()
+			if ctxErr != nil {
+				return ctxErr
+			}
+			if !d.IsDir() || d.Name() != textPostings {
+				return nil
+			}
+			rel, relErr := filepath.Rel(t.root, filepath.Dir(path))
+			if relErr != nil {
+				return relErr
+			}
+			term, decodeErr := hex.DecodeString(strings.ReplaceAll(rel, string(os.PathSeparator), ``))
+			if decodeErr != nil {
+				return filepath.SkipDir
+			}
+			termScores, scoreErr := t.termScores(string(term))
+			if scoreErr != nil {
+				return scoreErr
+			}
+			for identifier, score := range termScores {
+				scores[identifier] += score
+			}
+			return filepath.SkipDir // the postings of one term
+		})
+		if walkErr != nil {
+			return nil, walkErr
+		}
+	}
+	return scores, nil
+}
+
+// SearchTerm returns the identifiers containing term, best match first
+func (t *TextIndex) SearchTerm(ctx context.Context, term string) ([]TextHit, error) {
+	return t.Search(ctx, term)
+}
+
+// SearchPhrase returns the identifiers containing the words of phrase in order, best match first
+func (t *TextIndex) SearchPhrase(ctx context.Context, phrase string) ([]TextHit, error) {
+	return t.Search(ctx, `"`+strings.ReplaceAll(phrase, `"`, ` `)+`"`)
+}
+
+// SearchPrefix returns the identifiers containing a term that starts with prefix, best match first
+func (t *TextIndex) SearchPrefix(ctx context.Context, prefix string) ([]TextHit, error) {
+	return t.Search(ctx, strings.ReplaceAll(prefix, `"`, ` `)+"*")
+}
+
+// Search returns the identifiers matching every clause of query, best match first. Words are terms, words ending
+// in * are prefixes and words inside of double quotes are phrases, as in: hoover "field office" memo*
+func (t *TextIndex) Search(ctx context.Context, query string) ([]TextHit, error) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	parts := strings.Split(query, `"`)
+	if len(parts)%2 == 0 {
+		return nil, fmt.Errorf("%w: unbalanced quotes in %q", ErrTextQuery, query)
+	}
+	var clauses []map[string]float64
+	for i, part := range parts {
+		if i%2 == 1 {
+			phrase := t.tokenize(part)
+			if len(phrase) == 0 {
+				continue
+			}
+			scores, scoreErr := t.phraseScores(phrase)
+			if scoreErr != nil {
+				return nil, scoreErr
+			}
+			clauses = append(clauses, scores)
+			continue
+		}
+		for _, word := range strings.Fields(part) {
+			var scores map[string]float64
+			var scoreErr error
+			if strings.HasSuffix(word, "*") {
+				prefix := strings.Join(t.tokenize(strings.TrimSuffix(word, "*")), ``)
+				if len(prefix) == 0 {
+					return nil, fmt.Errorf("%w: empty prefix in %q", ErrTextQuery, query)
+				}
+				scores, scoreErr = t.prefixScores(ctx, prefix)
+			} else {
+				terms := t.tokenize(word)
+				if len(terms) == 0 {
+					continue
+				}
+				if len(terms) > 1 {
+					scores, scoreErr = t.phraseScores(terms)
+				} else {
+					scores, scoreErr = t.termScores(terms[0])
+				}
+			}
+			if scoreErr != nil {
+				return nil, scoreErr
+			}
+			clauses = append(clauses, scores)
+		}
+	}
+	if len(clauses) == 0 {
+		return nil, fmt.Errorf("%w: nothing to search for in %q", ErrTextQuery, query)
+	}
+
+	var hits []TextHit
+	for identifier, score := range clauses[0] {
+		matched := true
+		for _, clause := range clauses[1:] {
+			clauseScore, found := clause[identifier]
+			if !found {
+				matched = false
+				break
+			}
+			score += clauseScore
+		}
+		if matched {
+			hits = append(hits, TextHit{Identifier: identifier, Score: score})
+		}
+	}
+	sort.Slice(hits, func(i, j int) bool {
+		if hits[i].Score != hits[j].Score {
+			return hits[i].Score > hits[j].Score
+		}
+		return hits[i].Identifier < hits[j].Identifier
+	})
+	return hits, nil
+}
+
+// textFields returns the text of fields of record for a TextIndex. Each element of a slice is a field of its own, such
+// as Tags.0 and Tags.1, so that a phrase does not run from one element into the next.
+func textFields(record any, fields []string) map[string]string {
+	v := reflect.ValueOf(record)
+	for v.Kind() == reflect.Pointer && !v.IsNil() {
+		v = v.Elem()
+	}
+	text := make(map[string]string, len(fields))
+	if v.Kind() != reflect.Struct {
+		return text
+	}
+	for _, name := range fields {
+		field := v.FieldByName(name)
+		if !field.IsValid() || !field.CanInterface() {
+			continue
+		}
+		switch field.Kind() {
+		case reflect.Slice, reflect.Array:
+			for i := 0; i < field.Len(); i++ {
+				text[name+"."+strconv.Itoa(i)] = fmt.Sprint(field.Index(i).Interface())
+			}
+		default:
+			text[name] = fmt.Sprint(field.Interface())
+		}
+	}
+	return text
+}
+
+// textUpdate indexes the FullTextFields of record once tx commits, or removes the identifier from the full-text index
+// when record is nil. The record is committed by then, so a failure is returned by Put and Delete wrapped in
+// ErrAfterCommit ; indexing the record again with TextIndex.IndexText repairs it.
+func (s *Store[T]) textUpdate(ctx context.Context, tx *Tx, record *T) {
+	if s.text == nil {
+		return
+	}
+	tx.afterCommit(func() error {
+		if record == nil {
+			return s.text.Remove(ctx, tx.Identifier())
+		}
+		return s.text.IndexText(ctx, tx.Identifier(), textFields(*record, s.textFields))
+	})
+}
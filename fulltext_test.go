@@ -0,0 +1,190 @@
+package go_apario_identifier
+
+import (
+	`context`
+	`errors`
+	`fmt`
+	`log`
+	`os`
+	`path/filepath`
+	`sync`
+	`testing`
+)
+
+// textHitIdentifiers returns the identifiers of hits in order
+func textHitIdentifiers(hits []TextHit) []string {
+	identifiers := make([]string, 0, len(hits))
+	for _, hit := range hits {
+		identifiers = append(identifiers, hit.Identifier)
+	}
+	return identifiers
+}
+
+func TestTextIndex(t *testing.T) {
+	db, err := os.MkdirTemp("", "fulltext.db")
+	if err != nil {
+		t.Errorf("os.MkdirTemp() received err %v", err)
+		return
+	}
+	defer func(path string) {
+		err := os.RemoveAll(path)
+		if err != nil {
+			log.Printf("os.RemoveAll(%v) returned err %v", path, err)
+		}
+	}(db)
+
+	cache, _ := NewValet(db).GetCache(db)
+	text, textErr := NewTextIndex(cache, TextIndexOptions{Files: []string{"ocr.txt"}})
+	if textErr != nil {
+		t.Errorf("NewTextIndex() returned err %v", textErr)
+		return
+	}
+	ctx := context.Background()
+
+	pages := map[string]string{
+		"1961ACE": "The field office forwarded the memo to Director Hoover.",
+		"1962BEE": "Memorandum for the record: no field work was done. Memo follows.",
+		"1963CAT": "Office supplies were ordered for the field.",
+	}
+	for identifier, page := range pages {
+		dir := filepath.Join(db, IdentifierPath(identifier))
+		_ = os.MkdirAll(dir, 0700)
+		_ = os.WriteFile(filepath.Join(dir, "ocr.txt"), []byte(page), 0600)
+		indexErr := text.IndexFiles(ctx, identifier)
+		if indexErr != nil {
+			t.Errorf("text.IndexFiles(%v) returned err %v", identifier, indexErr)
+			return
+		}
+	}
+
+	hits, searchErr := text.SearchTerm(ctx, "Hoover")
+	if searchErr != nil || len(hits) != 1 || hits[0].Identifier != "1961ACE" || hits[0].Score <= 0 {
+		t.Errorf("expected Hoover to find 1961ACE ; got %+v and err %v", hits, searchErr)
+		return
+	}
+	hits, _ = text.SearchPhrase(ctx, "field office")
+	if identifiers := textHitIdentifiers(hits); len(identifiers) != 1 || identifiers[0] != "1961ACE" {
+		t.Errorf("expected the phrase to only match 1961ACE ; got %v", identifiers)
+		return
+	}
+	hits, _ = text.SearchPrefix(ctx, "mem")
+	if identifiers := textHitIdentifiers(hits); len(identifiers) != 2 || identifiers[0] != "1962BEE" {
+		t.Errorf("expected mem* to rank 1962BEE above 1961ACE ; got %+v", hits)
+		return
+	}
+	hits, _ = text.Search(ctx, `field memo*`)
+	if identifiers := textHitIdentifiers(hits); len(identifiers) != 2 {
+		t.Errorf("expected field and mem* together to match two pages ; got %v", identifiers)
+		return
+	}
+	_, searchErr = text.Search(ctx, `"field office`)
+	if !errors.Is(searchErr, ErrTextQuery) {
+		t.Errorf("expected ErrTextQuery for an unbalanced quote ; got %v", searchErr)
+		return
+	}
+
+	// reindexing replaces the old text and removing drops it
+	err = text.IndexText(ctx, "1963CAT", map[string]string{"ocr.txt": "A memo about pencils."})
+	if err != nil {
+		t.Errorf("text.IndexText() returned err %v", err)
+		return
+	}
+	hits, _ = text.SearchTerm(ctx, "supplies")
+	if len(hits) != 0 {
+		t.Errorf("expected the old text of 1963CAT to be gone ; got %+v", hits)
+		return
+	}
+	err = text.Remove(ctx, "1961ACE")
+	if err != nil {
+		t.Errorf("text.Remove() returned err %v", err)
+		return
+	}
+	hits, _ = text.SearchTerm(ctx, "memo")
+	if identifiers := textHitIdentifiers(hits); len(identifiers) != 2 || identifiers[0] == "1961ACE" || identifiers[1] == "1961ACE" {
+		t.Errorf("expected 1961ACE to be removed ; got %v", identifiers)
+		return
+	}
+	if text.count() != 2 {
+		t.Errorf("expected 2 documents in the index ; got %d", text.count())
+		return
+	}
+
+	// a store keeps its text fields in the index
+	books, _ := NewStore[indexTestBook](cache, StoreOptions{File: "book.json", FullText: text, TextFields: []string{"Title", "Tags"}})
+	err = books.Put(ctx, "1964DOG", indexTestBook{Title: "Notes from Dallas", Tags: []string{"warren", "commission"}})
+	if err != nil {
+		t.Errorf("books.Put() returned err %v", err)
+		return
+	}
+	hits, _ = text.Search(ctx, `dallas warren`)
+	if identifiers := textHitIdentifiers(hits); len(identifiers) != 1 || identifiers[0] != "1964DOG" {
+		t.Errorf("expected the stored book to be searchable ; got %v", identifiers)
+		return
+	}
+	hits, _ = text.SearchPhrase(ctx, "warren commission")
+	if len(hits) != 0 {
+		t.Errorf("expected a phrase not to span two tags ; got %+v", hits)
+		return
+	}
+	err = books.Delete(ctx, "1964DOG")
+	if err != nil {
+		t.Errorf("books.Delete() returned err %v", err)
+		return
+	}
+	hits, _ = text.SearchTerm(ctx, "dallas")
+	if len(hits) != 0 {
+		t.Errorf("expected the deleted book to leave the index ; got %+v", hits)
+		return
+	}
+}
+
+func TestTextIndex_Concurrent(t *testing.T) {
+	db, err := os.MkdirTemp("", "fulltext.db")
+	if err != nil {
+		t.Errorf("os.MkdirTemp() received err %v", err)
+		return
+	}
+	defer func(path string) {
+		err := os.RemoveAll(path)
+		if err != nil {
+			log.Printf("os.RemoveAll(%v) returned err %v", path, err)
+		}
+	}(db)
+	ctx := context.Background()
+
+	// one TextIndex per writer stands for one process each
+	wg := sync.WaitGroup{}
+	errs := make(chan error, 40)
+	for writer := 0; writer < 4; writer++ {
+		wg.Add(1)
+		go func(writer int) {
+			defer wg.Done()
+			cache, _ := NewValet(db).GetCache(db)
+			text, _ := NewTextIndex(cache, TextIndexOptions{})
+			for i := 0; i < 10; i++ {
+				identifier := fmt.Sprintf("2024W%dDOC%d", writer, i)
+				errs <- text.IndexText(ctx, identifier, map[string]string{"body": "shared memo " + identifier})
+			}
+		}(writer)
+	}
+	wg.Wait()
+	close(errs)
+	for indexErr := range errs {
+		if indexErr != nil {
+			t.Errorf("text.IndexText() returned err %v", indexErr)
+			return
+		}
+	}
+
+	cache, _ := NewValet(db).GetCache(db)
+	text, _ := NewTextIndex(cache, TextIndexOptions{})
+	hits, searchErr := text.SearchTerm(ctx, "memo")
+	if searchErr != nil || len(hits) != 40 || text.count() != 40 {
+		t.Errorf("expected every concurrent write to be indexed ; got %d hits, a count of %d and err %v", len(hits), text.count(), searchErr)
+		return
+	}
+	postings, _ := os.ReadDir(filepath.Join(text.termPath("memo"), textPostings))
+	if len(postings) != 40 {
+		t.Errorf("expected one posting file per identifier ; got %d", len(postings))
+	}
+}
@@ -2,4 +2,4 @@ module github.com/andreimerlescu/go-apario-identifier
 
 go 1.21
 
-require github.com/andreimerlescu/go-sema v0.0.1 // indirect
+require github.com/andreimerlescu/go-sema v0.0.1
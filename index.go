@@ -0,0 +1,357 @@
+package go_apario_identifier
+
+import (
+	`context`
+	`crypto/sha256`
+	`encoding/hex`
+	`errors`
+	`fmt`
+	`io/fs`
+	`net/url`
+	`os`
+	`path/filepath`
+	`reflect`
+	`sort`
+	`strings`
+)
+
+// indexDirectory is the directory inside of a database that holds the secondary indexes of its stores
+const indexDirectory = ".indexes"
+
+// maxIndexKeyLength is the length of shortened index directory names ; values that escape to this length or longer
+// are shortened and suffixed with their hash, so a key of this length is always a shortened one
+const maxIndexKeyLength = 160
+
+var (
+	ErrUnknownIndex Err = errors.New("unknown index")
+	ErrIndexName    Err = errors.New("invalid index name")
+)
+
+// StoreIndex declares a secondary index of a Store. Each value of the indexed field gets a directory under
+// .indexes/<Name> holding one empty file per identifier whose record has that value, so finding the records with a
+// value reads one directory instead of walking the database.
+type StoreIndex struct {
+	Name  string                    `json:"name"`  // directory of the index inside of .indexes
+	Field string                    `json:"field"` // exported struct field to index ; slices index each element
+	Keys  func(record any) []string `json:"-"`     // computes the values to index instead of Field when set
+}
+
+// keys returns the distinct non-empty values record has for the index
+func (idx StoreIndex) keys(record any) []string {
+	var values []string
+	if idx.Keys != nil {
+		values = idx.Keys(record)
+	} else {
+		v := reflect.ValueOf(record)
+		for v.Kind() == reflect.Pointer && !v.IsNil() {
+			v = v.Elem()
+		}
+		if v.Kind() != reflect.Struct {
+			return nil
+		}
+		field := v.FieldByName(idx.Field)
+		if !field.IsValid() || !field.CanInterface() {
+			return nil
+		}
+		switch field.Kind() {
+		case reflect.Slice, reflect.Array:
+			for i := 0; i < field.Len(); i++ {
+				values = append(values, fmt.Sprint(field.Index(i).Interface()))
+			}
+		default:
+			values = append(values, fmt.Sprint(field.Interface()))
+		}
+	}
+	seen := make(map[string]bool, len(values))
+	keys := make([]string, 0, len(values))
+	for _, value := range values {
+		if len(value) == 0 || seen[value] {
+			continue
+		}
+		seen[value] = true
+		keys = append(keys, value)
+	}
+	return keys
+}
+
+// validIndexName accepts index names that are a single directory name
+func validIndexName(name string) error {
+	if len(name) == 0 || strings.HasPrefix(name, ".") || strings.ContainsAny(name, `/\`) {
+		return fmt.Errorf("%w: %q", ErrIndexName, name)
+	}
+	return nil
+}
+
+// indexKey turns value into a directory name. Separators and a leading dot are escaped, and values too long for a
+// directory name are shortened and suffixed with their hash.
+func indexKey(value string) string {
+	key := url.PathEscape(value)
+	if strings.HasPrefix(key, ".") {
+		key = "%2E" + key[1:]
+	}
+	if len(key) >= maxIndexKeyLength {
+		sum := sha256.Sum256([]byte(value))
+		key = key[:maxIndexKeyLength-17] + "~" + hex.EncodeToString(sum[:8])
+	}
+	return key
+}
+
+// indexPath returns the directory holding the identifiers with value in the index name
+func (s *Store[T]) indexPath(name, value string) string {
+	return filepath.Join(s.cache.Path, indexDirectory, name, indexKey(value))
+}
+
+// indexRecord adds identifier to every index for the values of record
+func (s *Store[T]) indexRecord(identifier string, record T) error {
+	for _, idx := range s.indexes {
+		for _, value := range idx.keys(record) {
+			dir := s.indexPath(idx.Name, value)
+			mkdirErr := os.MkdirAll(dir, 0700)
+			if mkdirErr != nil {
+				return mkdirErr
+			}
+			writeErr := s.cache.writeFile(filepath.Join(dir, strings.ToUpper(identifier)), nil)
+			if writeErr != nil {
+				return writeErr
+			}
+		}
+	}
+	return nil
+}
+
+// unindexRecord removes identifier from the indexes for the values of old that record no longer has. A nil record
+// removes every value of old.
+func (s *Store[T]) unindexRecord(identifier string, old T, record *T) error {
+	var rmErr error
+	for _, idx := range s.indexes {
+		kept := map[string]bool{}
+		if record != nil {
+			for _, value := range idx.keys(*record) {
+				kept[value] = true
+			}
+		}
+		for _, value := range idx.keys(old) {
+			if kept[value] {
+				continue
+			}
+			entryErr := os.Remove(filepath.Join(s.indexPath(idx.Name, value), strings.ToUpper(identifier)))
+			if entryErr != nil && !os.IsNotExist(entryErr) {
+				rmErr = errors.Join(rmErr, entryErr)
+			}
+		}
+	}
+	return rmErr
+}
+
+// indexUpdate keeps the indexes in step with tx replacing the record of identifier with record, or deleting it when
+// record is nil. Entries for the new values are added before the transaction commits and entries for the old values
+// are removed after, so an index may briefly list an identifier that does not match but never misses one that does ;
+// Lookup checks every entry against the record before returning it. New entries are written outside of the
+// transaction for that reason: one left behind by a transaction that is discarded is skipped by Lookup and removed by
+// Rebuild, like an old entry whose removal failed after the commit.
+func (s *Store[T]) indexUpdate(tx *Tx, record *T) error {
+	if len(s.indexes) == 0 {
+		return nil
+	}
+	if record != nil {
+		indexErr := s.indexRecord(tx.Identifier(), *record)
+		if indexErr != nil {
+			return indexErr
+		}
+	}
+	oldBytes, readErr := tx.Read(s.file)
+	if readErr != nil {
+		if errors.Is(readErr, fs.ErrNotExist) {
+			return nil
+		}
+		return readErr
+	}
+	old, _, decodeErr := s.decode(oldBytes)
+	if decodeErr != nil {
+		return nil // nothing to unindex that can be known ; Rebuild prunes whatever the old record left behind
+	}
+	tx.afterCommit(func() error {
+		return s.unindexRecord(tx.Identifier(), old, record)
+	})
+	return nil
+}
+
+// index returns the StoreIndex called name
+func (s *Store[T]) index(name string) (StoreIndex, error) {
+	for _, idx := range s.indexes {
+		if idx.Name == name {
+			return idx, nil
+		}
+	}
+	return StoreIndex{}, fmt.Errorf("%w: %q", ErrUnknownIndex, name)
+}
+
+// matches returns true when the record of identifier has value in idx. It reads the record under a shared lock.
+func (s *Store[T]) matches(ctx context.Context, idx StoreIndex, identifier string, value string) (bool, error) {
+	record, getErr := s.Get(ctx, identifier)
+	if getErr != nil {
+		if errors.Is(getErr, ErrRecordNotFound) || errors.Is(getErr, ErrInvalidIdentifier) {
+			return false, nil
+		}
+		return false, getErr
+	}
+	for _, key := range idx.keys(record) {
+		if key == value {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Lookup returns the sorted identifiers whose records have value in the index called name
+func (s *Store[T]) Lookup(ctx context.Context, name string, value string) ([]string, error) {
+	idx, idxErr := s.index(name)
+	if idxErr != nil {
+		return nil, idxErr
+	}
+	entries, readDirErr := os.ReadDir(s.indexPath(idx.Name, value))
+	if readDirErr != nil {
+		if os.IsNotExist(readDirErr) {
+			return nil, nil
+		}
+		return nil, readDirErr
+	}
+	var identifiers []string
+	for _, entry := range entries {
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		match, matchErr := s.matches(ctx, idx, entry.Name(), value)
+		if matchErr != nil {
+			return nil, matchErr
+		}
+		if match {
+			identifiers = append(identifiers, entry.Name())
+		}
+	}
+	sort.Strings(identifiers)
+	return identifiers, nil
+}
+
+// Rebuild indexes every record of the Store again and removes the entries that no longer match their record, such as
+// those left behind by a crash or written before the index was declared. With no names every index is rebuilt.
+func (s *Store[T]) Rebuild(ctx context.Context, names ...string) error {
+	indexes := s.indexes
+	if len(names) > 0 {
+		indexes = nil
+		for _, name := range names {
+			idx, idxErr := s.index(name)
+			if idxErr != nil {
+				return idxErr
+			}
+			indexes = append(indexes, idx)
+		}
+	}
+	rebuilding := &Store[T]{}
+	*rebuilding = *s
+	rebuilding.indexes = indexes
+
+	walkErr := s.cache.walkIdentifierDirs(ctx, func(identifier string, dir string) error {
+		if !s.cache.PathExists(filepath.Join(dir, s.file)) {
+			return nil
+		}
+		record, getErr := s.Get(ctx, identifier)
+		if getErr != nil {
+			if errors.Is(getErr, ErrRecordNotFound) {
+				return nil
+			}
+			return fmt.Errorf("%v: %w", identifier, getErr)
+		}
+		return rebuilding.indexRecord(identifier, record)
+	})
+	if walkErr != nil {
+		return walkErr
+	}
+
+	for _, idx := range indexes {
+		pruneErr := s.prune(ctx, idx)
+		if pruneErr != nil {
+			return pruneErr
+		}
+	}
+	return nil
+}
+
+// prune removes the entries of idx whose record no longer has their value. Each entry is checked and removed under a
+// shared lock on its identifier so that a Put adding the same entry is not undone.
+func (s *Store[T]) prune(ctx context.Context, idx StoreIndex) error {
+	root := filepath.Join(s.cache.Path, indexDirectory, idx.Name)
+	keys, readDirErr := os.ReadDir(root)
+	if readDirErr != nil {
+		if os.IsNotExist(readDirErr) {
+			return nil
+		}
+		return readDirErr
+	}
+	for _, key := range keys {
+		if !key.IsDir() {
+			continue
+		}
+		value, unescapeErr := url.PathUnescape(key.Name())
+		if unescapeErr != nil || indexKey(value) != key.Name() {
+			// shortened keys cannot be turned back into their value ; check them against every value of the record
+			value = ``
+		}
+		dir := filepath.Join(root, key.Name())
+		entries, entriesErr := os.ReadDir(dir)
+		if entriesErr != nil {
+			return entriesErr
+		}
+		for _, entry := range entries {
+			if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+				continue
+			}
+			ctxErr := ctx.Err()
+			if ctxErr != nil {
+				return ctxErr
+			}
+			pruneErr := s.pruneEntry(ctx, idx, entry.Name(), dir, value)
+			if pruneErr != nil {
+				return pruneErr
+			}
+		}
+		_ = os.Remove(dir) // only succeeds once it is empty
+	}
+	return nil
+}
+
+// pruneEntry removes the entry of identifier inside of dir unless its record still has value, or any value that maps
+// to dir when value is empty
+func (s *Store[T]) pruneEntry(ctx context.Context, idx StoreIndex, identifier string, dir string, value string) error {
+	entry := filepath.Join(dir, identifier)
+	identifier, idErr := s.existing(identifier)
+	if idErr != nil {
+		return removeIndexEntry(entry) // the identifier is gone, and locking it would create its directories again
+	}
+	lockErr := s.cache.RLockIdentifierContext(ctx, identifier)
+	if lockErr != nil {
+		return lockErr
+	}
+	defer s.cache.RUnlockIdentifier(identifier)
+	recordBytes, readErr := os.ReadFile(filepath.Join(s.cache.Path, IdentifierPath(identifier), s.file))
+	if readErr == nil {
+		record, _, decodeErr := s.decode(recordBytes)
+		if decodeErr == nil {
+			for _, key := range idx.keys(record) {
+				if key == value || (len(value) == 0 && indexKey(key) == filepath.Base(dir)) {
+					return nil
+				}
+			}
+		}
+	}
+	return removeIndexEntry(entry)
+}
+
+// removeIndexEntry removes the index entry at path unless it is gone already
+func removeIndexEntry(path string) error {
+	rmErr := os.Remove(path)
+	if rmErr != nil && !os.IsNotExist(rmErr) {
+		return rmErr
+	}
+	return nil
+}
@@ -0,0 +1,146 @@
+package go_apario_identifier
+
+import (
+	`context`
+	`errors`
+	`log`
+	`os`
+	`path/filepath`
+	`reflect`
+	`strings`
+	`testing`
+)
+
+type indexTestBook struct {
+	Title  string   `json:"title"`
+	Author string   `json:"author"`
+	Tags   []string `json:"tags"`
+}
+
+func TestStore_Indexes(t *testing.T) {
+	db, err := os.MkdirTemp("", "index.db")
+	if err != nil {
+		t.Errorf("os.MkdirTemp() received err %v", err)
+		return
+	}
+	defer func(path string) {
+		err := os.RemoveAll(path)
+		if err != nil {
+			log.Printf("os.RemoveAll(%v) returned err %v", path, err)
+		}
+	}(db)
+
+	cache, _ := NewValet(db).GetCache(db)
+	books, storeErr := NewStore[indexTestBook](cache, StoreOptions{Indexes: []StoreIndex{
+		{Name: "author", Field: "Author"},
+		{Name: "tag", Field: "Tags"},
+	}})
+	if storeErr != nil {
+		t.Errorf("NewStore() returned err %v", storeErr)
+		return
+	}
+	_, storeErr = NewStore[indexTestBook](cache, StoreOptions{Indexes: []StoreIndex{{Name: ".hidden", Field: "Author"}}})
+	if !errors.Is(storeErr, ErrIndexName) {
+		t.Errorf("expected ErrIndexName for a dot index name ; got %v", storeErr)
+		return
+	}
+	ctx := context.Background()
+
+	long := strings.Repeat("a/very/long/author ", 20)
+	records := map[string]indexTestBook{
+		"1961ACE": {Title: "Dispatch", Author: "Hoover", Tags: []string{"fbi", "memo"}},
+		"1962BEE": {Title: "Cable", Author: "Dulles", Tags: []string{"cia"}},
+		"1963CAT": {Title: "Report", Author: "Hoover", Tags: []string{"fbi"}},
+		"1964DOG": {Title: "Notes", Author: long},
+	}
+	for identifier, record := range records {
+		putErr := books.Put(ctx, identifier, record)
+		if putErr != nil {
+			t.Errorf("books.Put(%v) returned err %v", identifier, putErr)
+			return
+		}
+	}
+
+	found, lookupErr := books.Lookup(ctx, "author", "Hoover")
+	if lookupErr != nil || !reflect.DeepEqual(found, []string{"1961ACE", "1963CAT"}) {
+		t.Errorf("expected both of Hoover's books ; got %v and err %v", found, lookupErr)
+		return
+	}
+	found, _ = books.Lookup(ctx, "tag", "memo")
+	if !reflect.DeepEqual(found, []string{"1961ACE"}) {
+		t.Errorf("expected the memo tag to find 1961ACE ; got %v", found)
+		return
+	}
+	found, _ = books.Lookup(ctx, "author", long)
+	if !reflect.DeepEqual(found, []string{"1964DOG"}) {
+		t.Errorf("expected a long value to be found ; got %v", found)
+		return
+	}
+	_, lookupErr = books.Lookup(ctx, "publisher", "Hoover")
+	if !errors.Is(lookupErr, ErrUnknownIndex) {
+		t.Errorf("expected ErrUnknownIndex ; got %v", lookupErr)
+		return
+	}
+
+	// moving a book to another author removes it from the old value
+	err = books.Put(ctx, "1963CAT", indexTestBook{Title: "Report", Author: "Dulles", Tags: []string{"fbi"}})
+	if err != nil {
+		t.Errorf("books.Put() returned err %v", err)
+		return
+	}
+	found, _ = books.Lookup(ctx, "author", "Hoover")
+	if !reflect.DeepEqual(found, []string{"1961ACE"}) {
+		t.Errorf("expected only 1961ACE left for Hoover ; got %v", found)
+		return
+	}
+	if cache.PathExists(filepath.Join(db, indexDirectory, "author", "Hoover", "1963CAT")) {
+		t.Errorf("expected the Hoover entry of 1963CAT to be removed on Put")
+		return
+	}
+	err = books.Delete(ctx, "1961ACE")
+	if err != nil {
+		t.Errorf("books.Delete() returned err %v", err)
+		return
+	}
+	found, _ = books.Lookup(ctx, "tag", "fbi")
+	if !reflect.DeepEqual(found, []string{"1963CAT"}) {
+		t.Errorf("expected the deleted book to leave the fbi tag ; got %v", found)
+		return
+	}
+
+	// an entry left behind by a crash is never returned, and Rebuild removes it
+	stale := filepath.Join(db, indexDirectory, "author", "Dulles", "1961ACE")
+	_ = os.WriteFile(stale, nil, 0600)
+	found, _ = books.Lookup(ctx, "author", "Dulles")
+	if !reflect.DeepEqual(found, []string{"1962BEE", "1963CAT"}) {
+		t.Errorf("expected the stale entry to be skipped ; got %v", found)
+		return
+	}
+
+	// an index declared after its records were written is filled in by Rebuild
+	titled, _ := NewStore[indexTestBook](cache, StoreOptions{Indexes: []StoreIndex{
+		{Name: "author", Field: "Author"},
+		{Name: "title", Keys: func(record any) []string {
+			return []string{strings.ToLower(record.(indexTestBook).Title)}
+		}},
+	}})
+	err = titled.Rebuild(ctx)
+	if err != nil {
+		t.Errorf("titled.Rebuild() returned err %v", err)
+		return
+	}
+	if cache.PathExists(stale) {
+		t.Errorf("expected Rebuild to prune %v", stale)
+		return
+	}
+	found, _ = titled.Lookup(ctx, "title", "cable")
+	if !reflect.DeepEqual(found, []string{"1962BEE"}) {
+		t.Errorf("expected the rebuilt title index to find 1962BEE ; got %v", found)
+		return
+	}
+	found, _ = titled.Lookup(ctx, "author", long)
+	if !reflect.DeepEqual(found, []string{"1964DOG"}) {
+		t.Errorf("expected Rebuild to keep the shortened entry ; got %v", found)
+		return
+	}
+}
@@ -0,0 +1,174 @@
+package go_apario_identifier
+
+import (
+	`context`
+	`errors`
+	`io/fs`
+	`os`
+	`path/filepath`
+	`strconv`
+	`strings`
+	`time`
+)
+
+// IterateFilter narrows down the identifiers Cache.Iterate yields. The zero value yields every identifier.
+type IterateFilter struct {
+	FromYear       int16     `json:"from_year"`       // first year to yield ; 0 for no lower bound
+	ToYear         int16     `json:"to_year"`         // last year to yield ; 0 for no upper bound
+	Prefix         string    `json:"prefix"`          // the fragment (after the year) must start with Prefix
+	ModifiedAfter  time.Time `json:"modified_after"`  // the identifier directory must have changed after this time
+	ModifiedBefore time.Time `json:"modified_before"` // the identifier directory must have changed before this time
+}
+
+// IdentifierEntry is an identifier found by Cache.Iterate
+type IdentifierEntry struct {
+	ID         string      `json:"id"`       // the identifier as written in its .identifier file
+	Identifier *Identifier `json:"-"`        // the parsed identifier
+	Path       string      `json:"path"`     // the directory of the identifier
+	Modified   time.Time   `json:"modified"` // when a file inside of the directory was last added, replaced or removed
+}
+
+// year returns true when year is inside of the filter's years
+func (f IterateFilter) year(year int) bool {
+	return (f.FromYear == 0 || year >= int(f.FromYear)) && (f.ToYear == 0 || year <= int(f.ToYear))
+}
+
+// descend returns true when the directory holding the identifiers starting with partial may hold identifiers that
+// match the filter
+func (f IterateFilter) descend(partial string) bool {
+	if len(partial) >= 4 {
+		year, yearErr := strconv.Atoi(partial[:4])
+		if yearErr != nil || !f.year(year) {
+			return false
+		}
+		fragment, prefix := partial[4:], strings.ToUpper(f.Prefix)
+		return strings.HasPrefix(fragment, prefix) || strings.HasPrefix(prefix, fragment)
+	}
+	return true
+}
+
+// matches returns true when the identifier entry matches the filter
+func (f IterateFilter) matches(entry IdentifierEntry) bool {
+	if !f.year(int(entry.Identifier.Year)) || !strings.HasPrefix(entry.ID[4:], strings.ToUpper(f.Prefix)) {
+		return false
+	}
+	if !f.ModifiedAfter.IsZero() && !entry.Modified.After(f.ModifiedAfter) {
+		return false
+	}
+	if !f.ModifiedBefore.IsZero() && !entry.Modified.Before(f.ModifiedBefore) {
+		return false
+	}
+	return true
+}
+
+// Iterate walks the database one directory at a time and calls fn with every identifier matching filter, in the
+// order of its sharded directories. Identifiers are found by their .identifier files, and directories that cannot
+// hold a match (other years, other fragment prefixes) are not read. Returning filepath.SkipAll from fn stops the
+// iteration without an error, and filepath.SkipDir skips the identifiers nested below the one fn was called with.
+func (c *Cache) Iterate(ctx context.Context, filter IterateFilter, fn func(entry IdentifierEntry) error) error {
+	return c.iterate(ctx, filter, nil, fn)
+}
+
+// iterate is Iterate that starts after the directory whose path relative to the database is made of the segments
+// after. Directories that come before it in the order of the walk are skipped without being read.
+func (c *Cache) iterate(ctx context.Context, filter IterateFilter, after []string, fn func(entry IdentifierEntry) error) error {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	root := filepath.Clean(c.Path)
+	return filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		ctxErr := ctx.Err()
+		if ctxErr != nil {
+			return ctxErr
+		}
+		if !d.IsDir() || path == root {
+			return nil
+		}
+		if strings.HasPrefix(d.Name(), ".") {
+			return filepath.SkipDir
+		}
+		rel, relErr := filepath.Rel(root, path)
+		if relErr != nil {
+			return relErr
+		}
+		partial := strings.ToUpper(strings.ReplaceAll(rel, string(os.PathSeparator), ``))
+		if !filter.descend(partial) {
+			return filepath.SkipDir
+		}
+		switch walkOrder(strings.Split(rel, string(os.PathSeparator)), after) {
+		case -1:
+			return filepath.SkipDir
+		case 0:
+			return nil // the directory after starts at, or one of its parents ; only what is below it comes after it
+		}
+		entry, found, entryErr := c.identifierEntry(path, partial)
+		if entryErr != nil || !found || !filter.matches(entry) {
+			return entryErr
+		}
+		return fn(entry)
+	})
+}
+
+// walkOrder compares the directory made of segments with the one made of after in the order filepath.WalkDir visits
+// them. It returns -1 when segments comes first and is not a parent of after, 0 when segments is after or one of its
+// parents, and 1 when segments comes later.
+func walkOrder(segments []string, after []string) int {
+	if after == nil {
+		return 1
+	}
+	for i, segment := range segments {
+		if i >= len(after) {
+			return 1 // below after
+		}
+		if segment != after[i] {
+			if segment < after[i] {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
+
+// identifierEntry reads the .identifier file inside of dir. Directories without one, or whose .identifier belongs to
+// another identifier, are not found.
+func (c *Cache) identifierEntry(dir string, partial string) (IdentifierEntry, bool, error) {
+	idBytes, readErr := os.ReadFile(filepath.Join(dir, ".identifier"))
+	if readErr != nil {
+		if errors.Is(readErr, fs.ErrNotExist) {
+			return IdentifierEntry{}, false, nil
+		}
+		return IdentifierEntry{}, false, readErr
+	}
+	id := strings.ToUpper(strings.TrimSpace(string(idBytes)))
+	if id != partial || len(id) < 4 {
+		return IdentifierEntry{}, false, nil
+	}
+	identifier, parseErr := ParseIdentifier(id)
+	if parseErr != nil {
+		return IdentifierEntry{}, false, nil
+	}
+	info, statErr := os.Stat(dir)
+	if statErr != nil {
+		if errors.Is(statErr, fs.ErrNotExist) {
+			return IdentifierEntry{}, false, nil
+		}
+		return IdentifierEntry{}, false, statErr
+	}
+	return IdentifierEntry{ID: id, Identifier: identifier, Path: dir, Modified: info.ModTime()}, true, nil
+}
+
+// Iterate calls fn with every identifier of databasePrefix matching filter ; see Cache.Iterate
+func (v *Valet) Iterate(ctx context.Context, databasePrefix string, filter IterateFilter, fn func(entry IdentifierEntry) error) error {
+	c, cErr := v.cache(databasePrefix)
+	if cErr != nil {
+		return cErr
+	}
+	return c.Iterate(ctx, filter, fn)
+}
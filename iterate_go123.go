@@ -0,0 +1,27 @@
+//go:build go1.23
+
+package go_apario_identifier
+
+import (
+	`context`
+	`iter`
+	`path/filepath`
+)
+
+// Identifiers returns the identifiers matching filter as an iterator for range loops ; see Cache.Iterate. An error
+// ends the iteration and is yielded with an empty IdentifierEntry.
+func (c *Cache) Identifiers(ctx context.Context, filter IterateFilter) iter.Seq2[IdentifierEntry, error] {
+	return func(yield func(IdentifierEntry, error) bool) {
+		stopped := false
+		iterateErr := c.Iterate(ctx, filter, func(entry IdentifierEntry) error {
+			if !yield(entry, nil) {
+				stopped = true
+				return filepath.SkipAll
+			}
+			return nil
+		})
+		if iterateErr != nil && !stopped {
+			yield(IdentifierEntry{}, iterateErr)
+		}
+	}
+}
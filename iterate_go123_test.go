@@ -0,0 +1,49 @@
+//go:build go1.23
+
+package go_apario_identifier
+
+import (
+	`context`
+	`log`
+	`os`
+	`testing`
+)
+
+func TestCache_Identifiers(t *testing.T) {
+	db, err := os.MkdirTemp("", "identifiers.db")
+	if err != nil {
+		t.Errorf("os.MkdirTemp() received err %v", err)
+		return
+	}
+	defer func(path string) {
+		err := os.RemoveAll(path)
+		if err != nil {
+			log.Printf("os.RemoveAll(%v) returned err %v", path, err)
+		}
+	}(db)
+
+	valet := NewValet(db)
+	for _, code := range []string{"ACE", "BEE", "CAT"} {
+		_, claimErr := valet.ClaimID(db, 1961, code)
+		if claimErr != nil {
+			t.Errorf("valet.ClaimID(%v) returned err %v", code, claimErr)
+			return
+		}
+	}
+	cache, _ := valet.GetCache(db)
+
+	var found []string
+	for entry, iterErr := range cache.Identifiers(context.Background(), IterateFilter{FromYear: 1961}) {
+		if iterErr != nil {
+			t.Errorf("cache.Identifiers() yielded err %v", iterErr)
+			return
+		}
+		found = append(found, entry.ID)
+		if len(found) == 2 {
+			break
+		}
+	}
+	if len(found) != 2 || found[0] != "1961ACE" || found[1] != "1961BEE" {
+		t.Errorf("expected to break after 1961ACE and 1961BEE ; got %v", found)
+	}
+}
@@ -0,0 +1,94 @@
+package go_apario_identifier
+
+import (
+	`context`
+	`log`
+	`os`
+	`path/filepath`
+	`reflect`
+	`testing`
+	`time`
+)
+
+func TestCache_Iterate(t *testing.T) {
+	db, err := os.MkdirTemp("", "iterate.db")
+	if err != nil {
+		t.Errorf("os.MkdirTemp() received err %v", err)
+		return
+	}
+	defer func(path string) {
+		err := os.RemoveAll(path)
+		if err != nil {
+			log.Printf("os.RemoveAll(%v) returned err %v", path, err)
+		}
+	}(db)
+
+	valet := NewValet(db)
+	claims := []struct {
+		year int
+		code string
+	}{{1961, "ACE"}, {1961, "ACORN"}, {1962, "BEE"}, {1963, "ACT"}, {2024, "JFK"}}
+	for _, claim := range claims {
+		_, claimErr := valet.ClaimID(db, claim.year, claim.code)
+		if claimErr != nil {
+			t.Errorf("valet.ClaimID(%d, %v) returned err %v", claim.year, claim.code, claimErr)
+			return
+		}
+	}
+	// a directory whose .identifier names another identifier is not yielded
+	stray := filepath.Join(db, IdentifierPath("1961ZZZ"))
+	_ = os.MkdirAll(stray, 0700)
+	_ = os.WriteFile(filepath.Join(stray, ".identifier"), []byte("1961ACE"), 0600)
+
+	cache, _ := valet.GetCache(db)
+	ctx := context.Background()
+	collect := func(filter IterateFilter) []string {
+		var found []string
+		iterateErr := cache.Iterate(ctx, filter, func(entry IdentifierEntry) error {
+			found = append(found, entry.ID)
+			return nil
+		})
+		if iterateErr != nil {
+			t.Errorf("cache.Iterate(%+v) returned err %v", filter, iterateErr)
+		}
+		return found
+	}
+
+	if found := collect(IterateFilter{}); !reflect.DeepEqual(found, []string{"1961ACE", "1961ACORN", "1962BEE", "1963ACT", "2024JFK"}) {
+		t.Errorf("expected every identifier in order ; got %v", found)
+		return
+	}
+	if found := collect(IterateFilter{FromYear: 1962, ToYear: 1963}); !reflect.DeepEqual(found, []string{"1962BEE", "1963ACT"}) {
+		t.Errorf("expected 1962 through 1963 ; got %v", found)
+		return
+	}
+	if found := collect(IterateFilter{Prefix: "ac"}); !reflect.DeepEqual(found, []string{"1961ACE", "1961ACORN", "1963ACT"}) {
+		t.Errorf("expected the fragments starting with AC ; got %v", found)
+		return
+	}
+	if found := collect(IterateFilter{ModifiedAfter: time.Now().Add(time.Hour)}); len(found) != 0 {
+		t.Errorf("expected nothing modified in the future ; got %v", found)
+		return
+	}
+	if found := collect(IterateFilter{ModifiedBefore: time.Now().Add(time.Hour), ToYear: 1961}); len(found) != 2 {
+		t.Errorf("expected both identifiers of 1961 ; got %v", found)
+		return
+	}
+
+	var first []string
+	err = cache.Iterate(ctx, IterateFilter{}, func(entry IdentifierEntry) error {
+		first = append(first, entry.ID)
+		return filepath.SkipAll
+	})
+	if err != nil || !reflect.DeepEqual(first, []string{"1961ACE"}) {
+		t.Errorf("expected SkipAll to stop after the first identifier ; got %v and err %v", first, err)
+		return
+	}
+
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	err = cache.Iterate(canceled, IterateFilter{}, func(entry IdentifierEntry) error { return nil })
+	if err == nil {
+		t.Errorf("expected a canceled context to stop the iteration")
+	}
+}
@@ -0,0 +1,97 @@
+package go_apario_identifier
+
+import (
+	`context`
+	`encoding/base64`
+	`errors`
+	`fmt`
+	`os`
+	`path/filepath`
+	`strings`
+)
+
+const (
+	// DefaultListLimit is how many identifiers List returns when its limit is not positive
+	DefaultListLimit = 100
+	// listCursorVersion prefixes the position encoded in a cursor
+	listCursorVersion = "v1:"
+)
+
+var ErrInvalidCursor Err = errors.New("invalid list cursor")
+
+// ListPage is one page of identifiers returned by List
+type ListPage struct {
+	Identifiers []IdentifierEntry `json:"identifiers"`
+	Next        string            `json:"next,omitempty"` // cursor of the next page ; empty on the last page
+}
+
+// encodeListCursor turns the sharded directory segments of the last identifier of a page into an opaque cursor
+func encodeListCursor(segments []string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(listCursorVersion + strings.Join(segments, "/")))
+}
+
+// decodeListCursor returns the sharded directory segments encoded in cursor ; an empty cursor is the first page
+func decodeListCursor(cursor string) ([]string, error) {
+	if len(cursor) == 0 {
+		return nil, nil
+	}
+	decoded, decodeErr := base64.RawURLEncoding.DecodeString(cursor)
+	if decodeErr != nil || !strings.HasPrefix(string(decoded), listCursorVersion) {
+		return nil, fmt.Errorf("%w: %q", ErrInvalidCursor, cursor)
+	}
+	segments := strings.Split(strings.TrimPrefix(string(decoded), listCursorVersion), "/")
+	for _, segment := range segments {
+		if len(segment) == 0 || strings.HasPrefix(segment, ".") || strings.ContainsAny(segment, `\`) {
+			return nil, fmt.Errorf("%w: %q", ErrInvalidCursor, cursor)
+		}
+	}
+	return segments, nil
+}
+
+// List returns up to limit identifiers that come after cursor, in the order of their sharded directories, along with
+// the cursor of the next page. Pass an empty cursor for the first page. The cursor records the position of the last
+// identifier in the tree rather than an offset, so identifiers created or deleted while a caller pages through the
+// database never shift or repeat the pages that follow ; new identifiers show up on a later page when they sort after
+// the cursor.
+func (c *Cache) List(ctx context.Context, cursor string, limit int) (ListPage, error) {
+	after, cursorErr := decodeListCursor(cursor)
+	if cursorErr != nil {
+		return ListPage{}, cursorErr
+	}
+	if limit < 1 {
+		limit = DefaultListLimit
+	}
+	root := filepath.Clean(c.Path)
+	page := ListPage{}
+	var last []string
+	more := false
+	iterateErr := c.iterate(ctx, IterateFilter{}, after, func(entry IdentifierEntry) error {
+		if len(page.Identifiers) == limit {
+			more = true
+			return filepath.SkipAll
+		}
+		rel, relErr := filepath.Rel(root, entry.Path)
+		if relErr != nil {
+			return relErr
+		}
+		page.Identifiers = append(page.Identifiers, entry)
+		last = strings.Split(rel, string(os.PathSeparator))
+		return nil
+	})
+	if iterateErr != nil {
+		return ListPage{}, iterateErr
+	}
+	if more {
+		page.Next = encodeListCursor(last)
+	}
+	return page, nil
+}
+
+// List returns a page of the identifiers of databasePrefix ; see Cache.List
+func (v *Valet) List(ctx context.Context, databasePrefix string, cursor string, limit int) (ListPage, error) {
+	c, cErr := v.cache(databasePrefix)
+	if cErr != nil {
+		return ListPage{}, cErr
+	}
+	return c.List(ctx, cursor, limit)
+}
@@ -0,0 +1,79 @@
+package go_apario_identifier
+
+import (
+	`context`
+	`errors`
+	`log`
+	`os`
+	`reflect`
+	`testing`
+)
+
+func TestCache_List(t *testing.T) {
+	db, err := os.MkdirTemp("", "list.db")
+	if err != nil {
+		t.Errorf("os.MkdirTemp() received err %v", err)
+		return
+	}
+	defer func(path string) {
+		err := os.RemoveAll(path)
+		if err != nil {
+			log.Printf("os.RemoveAll(%v) returned err %v", path, err)
+		}
+	}(db)
+
+	valet := NewValet(db)
+	for _, code := range []string{"ACE", "ACORN", "BEE", "CAT", "DOG"} {
+		_, claimErr := valet.ClaimID(db, 1961, code)
+		if claimErr != nil {
+			t.Errorf("valet.ClaimID(%v) returned err %v", code, claimErr)
+			return
+		}
+	}
+	cache, _ := valet.GetCache(db)
+	ctx := context.Background()
+	ids := func(page ListPage) []string {
+		var found []string
+		for _, entry := range page.Identifiers {
+			found = append(found, entry.ID)
+		}
+		return found
+	}
+
+	page, listErr := cache.List(ctx, ``, 2)
+	if listErr != nil || !reflect.DeepEqual(ids(page), []string{"1961ACE", "1961ACORN"}) || len(page.Next) == 0 {
+		t.Errorf("expected the first two identifiers and a cursor ; got %v, %q and err %v", ids(page), page.Next, listErr)
+		return
+	}
+
+	// identifiers created before and after the cursor while paging
+	_, _ = valet.ClaimID(db, 1961, "AAA")
+	_, _ = valet.ClaimID(db, 1961, "BAT")
+
+	page, listErr = cache.List(ctx, page.Next, 2)
+	if listErr != nil || !reflect.DeepEqual(ids(page), []string{"1961BAT", "1961BEE"}) {
+		t.Errorf("expected the second page to continue after 1961ACORN ; got %v and err %v", ids(page), listErr)
+		return
+	}
+	page, listErr = cache.List(ctx, page.Next, 2)
+	if listErr != nil || !reflect.DeepEqual(ids(page), []string{"1961CAT", "1961DOG"}) || len(page.Next) != 0 {
+		t.Errorf("expected the last page without a cursor ; got %v, %q and err %v", ids(page), page.Next, listErr)
+		return
+	}
+
+	page, listErr = valet.List(ctx, db, ``, 0)
+	if listErr != nil || len(page.Identifiers) != 7 || len(page.Next) != 0 {
+		t.Errorf("expected every identifier with the default limit ; got %v and err %v", ids(page), listErr)
+		return
+	}
+
+	_, listErr = cache.List(ctx, "not a cursor", 2)
+	if !errors.Is(listErr, ErrInvalidCursor) {
+		t.Errorf("expected ErrInvalidCursor ; got %v", listErr)
+		return
+	}
+	_, listErr = cache.List(ctx, encodeListCursor([]string{"..", "etc"}), 2)
+	if !errors.Is(listErr, ErrInvalidCursor) {
+		t.Errorf("expected ErrInvalidCursor for a cursor leaving the database ; got %v", listErr)
+	}
+}
@@ -0,0 +1,591 @@
+package go_apario_identifier
+
+import (
+	`context`
+	`crypto/rand`
+	`encoding/hex`
+	`encoding/json`
+	`errors`
+	`fmt`
+	`io/fs`
+	`log`
+	`os`
+	`path/filepath`
+	`strconv`
+	`strings`
+	`sync`
+	`time`
+)
+
+const (
+	// DefaultLockTTL is the lease given to a lock when Cache.LockTTL is not set
+	DefaultLockTTL = 30 * time.Second
+	// DefaultLockTimeout is how long LockIdentifier and RLockIdentifier wait for a lock held by someone else
+	DefaultLockTimeout = 900 * time.Millisecond
+	// lockRetryInterval is how often a lock held by someone else is checked again
+	lockRetryInterval = 30 * time.Millisecond
+)
+
+var (
+	ErrLockNotHeld      Err = errors.New("identifier lock is not held by this cache")
+	ErrLockExpired      Err = errors.New("identifier lock lease has expired")
+	ErrLockTimeout      Err = errors.New("timed out waiting for identifier lock")
+	ErrIdentifierLocked Err = errors.New("identifier is locked")
+)
+
+// waitLock calls attempt every lockRetryInterval until it succeeds, returns an error or ctx (or the Cache's context) is
+// done. When try is set, attempt is only called once and ErrIdentifierLocked is returned when it does not succeed.
+func (c *Cache) waitLock(ctx context.Context, try bool, attempt func() (bool, error)) error {
+	ticker := time.NewTicker(lockRetryInterval)
+	defer ticker.Stop()
+	for {
+		ok, attemptErr := attempt()
+		if attemptErr != nil {
+			return attemptErr
+		}
+		if ok {
+			return nil
+		}
+		if try {
+			return ErrIdentifierLocked
+		}
+		select {
+		case <-ctx.Done():
+			return lockWaitErr(ctx.Err())
+		case <-c.ctx.Done():
+			return lockWaitErr(c.ctx.Err())
+		case <-ticker.C:
+		}
+	}
+}
+
+// lockWaitErr makes a deadline that passed while waiting for a lock match ErrLockTimeout
+func lockWaitErr(err error) error {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return fmt.Errorf("%w: %w", ErrLockTimeout, err)
+	}
+	return err
+}
+
+// acquireInMemory takes an in-memory lock or semaphore with acquire while honoring ctx. The file lock is already held
+// at this point, so these are only contended by callers that use the Mutex or Semaphore of the identifier directly.
+// When try is set, tryAcquire is used instead ; without one, acquire is given a single lockRetryInterval to succeed.
+func (c *Cache) acquireInMemory(ctx context.Context, try bool, acquire func(), release func(), tryAcquire func() bool) error {
+	if try && tryAcquire != nil {
+		if tryAcquire() {
+			return nil
+		}
+		return ErrIdentifierLocked
+	}
+	if try {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, lockRetryInterval)
+		defer cancel()
+	}
+	acquired := make(chan struct{})
+	go func() {
+		acquire()
+		close(acquired)
+	}()
+	select {
+	case <-acquired:
+		return nil
+	case <-ctx.Done():
+	case <-c.ctx.Done():
+	}
+	// give back whatever the goroutine ends up acquiring
+	go func() {
+		<-acquired
+		release()
+	}()
+	if try {
+		return ErrIdentifierLocked
+	}
+	if ctx.Err() != nil {
+		return lockWaitErr(ctx.Err())
+	}
+	return c.ctx.Err()
+}
+
+// LockHolder is the content of a .locked or .rlocked-<token> file: who acquired the lock and the lease they hold on it. A lease that is
+// past Expires belongs to a holder that crashed or stopped renewing it, and it may be removed by anyone.
+type LockHolder struct {
+	Identifier string    `json:"identifier"`
+	Token      string    `json:"token"`
+	PID        int       `json:"pid"`
+	Hostname   string    `json:"hostname"`
+	Label      string    `json:"label"`
+	Shared     bool      `json:"shared"`
+	Acquired   time.Time `json:"acquired"`
+	Expires    time.Time `json:"expires"`
+}
+
+// Expired returns true when the lease of the LockHolder has run out
+func (l *LockHolder) Expired() bool {
+	return l.expired(time.Now().UTC())
+}
+
+func (l *LockHolder) expired(now time.Time) bool {
+	return now.After(l.Expires)
+}
+
+// newLockToken returns a random token that identifies a single acquisition of a lock
+func newLockToken() string {
+	b := make([]byte, 16)
+	_, randErr := rand.Read(b)
+	if randErr != nil {
+		return strconv.FormatInt(time.Now().UTC().UnixNano(), 36)
+	}
+	return hex.EncodeToString(b)
+}
+
+func (c *Cache) lockTTL() time.Duration {
+	if c.LockTTL > 0 {
+		return c.LockTTL
+	}
+	return DefaultLockTTL
+}
+
+// lockHostname is resolved once since every lock acquired by the process records it
+var lockHostname = sync.OnceValue(func() string {
+	hostname, hostErr := os.Hostname()
+	if hostErr != nil {
+		return ""
+	}
+	return hostname
+})
+
+// newLockHolder returns the holder of a new acquisition of identifier whose lease expires after the Cache's LockTTL
+func (c *Cache) newLockHolder(identifier string, label string) *LockHolder {
+	now := time.Now().UTC()
+	return &LockHolder{
+		Identifier: strings.ToUpper(identifier),
+		Token:      newLockToken(),
+		PID:        os.Getpid(),
+		Hostname:   lockHostname(),
+		Label:      label,
+		Acquired:   now,
+		Expires:    now.Add(c.lockTTL()),
+	}
+}
+
+// readLockHolder reads the holder stored at path. Lock files written before leases existed only hold the unix
+// timestamp of when they were locked ; they are given a token-less lease of DefaultLockTTL.
+func readLockHolder(path string) (*LockHolder, error) {
+	leaseBytes, readErr := os.ReadFile(path)
+	if readErr != nil {
+		return nil, readErr
+	}
+	lease := &LockHolder{}
+	jsonErr := json.Unmarshal(leaseBytes, lease)
+	if jsonErr == nil {
+		return lease, nil
+	}
+	lockedAt, intErr := strconv.ParseInt(strings.TrimSpace(string(leaseBytes)), 10, 64)
+	if intErr != nil {
+		return nil, errors.Join(jsonErr, intErr)
+	}
+	lease.Acquired = time.Unix(lockedAt, 0).UTC()
+	lease.Expires = lease.Acquired.Add(DefaultLockTTL)
+	return lease, nil
+}
+
+// reapLockFile removes the lock file at path when its lease has expired. The file is first renamed out of the way so
+// that a holder renewing at the same moment is detected: if the renamed lease is no longer the expired one, it is put
+// back (unless a new lock was created in the meantime) and nothing is reaped.
+func reapLockFile(path string, now time.Time) (bool, error) {
+	lease, leaseErr := readLockHolder(path)
+	if leaseErr != nil {
+		if errors.Is(leaseErr, fs.ErrNotExist) {
+			return false, nil
+		}
+		// a lock file that cannot be parsed is only stale once it has been untouched for a full lease
+		info, statErr := os.Stat(path)
+		if statErr != nil || now.Sub(info.ModTime()) < DefaultLockTTL {
+			return false, nil
+		}
+		lease = &LockHolder{Expires: info.ModTime()}
+	}
+	if !lease.expired(now) {
+		return false, nil
+	}
+
+	reaping := path + ".reap-" + newLockToken()
+	renameErr := os.Rename(path, reaping)
+	if renameErr != nil {
+		if errors.Is(renameErr, fs.ErrNotExist) {
+			return false, nil
+		}
+		return false, renameErr
+	}
+	again, againErr := readLockHolder(reaping)
+	if againErr == nil && (again.Token != lease.Token || !again.expired(now)) {
+		// renewed between the read and the rename ; restore it
+		linkErr := os.Link(reaping, path)
+		return false, errors.Join(ignoreExist(linkErr), os.Remove(reaping))
+	}
+	return true, os.Remove(reaping)
+}
+
+func ignoreExist(err error) error {
+	if errors.Is(err, fs.ErrExist) {
+		return nil
+	}
+	return err
+}
+
+// heldToken returns the token of the lock this Cache holds on identifier
+func (c *Cache) heldToken(identifier string) (string, bool) {
+	c.SafetyCheck()
+	c.muHe.Lock()
+	defer c.muHe.Unlock()
+	token, held := c.held[identifier]
+	return token, held
+}
+
+// RenewIdentifierLock extends the lease of the lock this Cache holds on identifier by the Cache's LockTTL. When the
+// Cache holds shared locks on identifier instead, each of them is renewed. Long running operations must renew their
+// lock before it expires, or use Heartbeat to renew it in the background.
+func (c *Cache) RenewIdentifierLock(identifier string) error {
+	token, held := c.heldToken(identifier)
+	if held {
+		return c.renewLockFile(c.identifierLockFile(identifier), token)
+	}
+	tokens := c.sharedTokens(identifier)
+	if len(tokens) == 0 {
+		return ErrLockNotHeld
+	}
+	var renewErr error
+	for _, token := range tokens {
+		renewErr = errors.Join(renewErr, c.renewLockFile(c.sharedLockFile(identifier, token), token))
+	}
+	return renewErr
+}
+
+// renewLockFile extends the lease stored at lockPath when it still belongs to token. The lock file is taken aside the
+// same way reapLockFile does, so a reaper or a new holder can never be overwritten by a renewal that came too late.
+// Acquirers that find the lock file missing while it is aside see it with asideLockHeld and give way.
+func (c *Cache) renewLockFile(lockPath string, token string) error {
+	taken, lease, takeErr := takeLockFile(lockPath, token)
+	if takeErr != nil {
+		return takeErr
+	}
+	now := time.Now().UTC()
+	if lease.expired(now) {
+		return errors.Join(ErrLockExpired, restoreLockFile(taken, lockPath))
+	}
+	lease.Expires = now.Add(c.lockTTL())
+	leaseBytes, jsonErr := json.Marshal(lease)
+	if jsonErr != nil {
+		return errors.Join(jsonErr, restoreLockFile(taken, lockPath))
+	}
+	writeErr := os.WriteFile(taken, leaseBytes, 0600)
+	if writeErr != nil {
+		return errors.Join(writeErr, restoreLockFile(taken, lockPath))
+	}
+	deadline := time.Now().Add(lockRetryInterval)
+	for {
+		linkErr := os.Link(taken, lockPath)
+		if linkErr == nil {
+			return os.Remove(taken)
+		}
+		if !errors.Is(linkErr, fs.ErrExist) || time.Now().After(deadline) {
+			return errors.Join(ErrLockExpired, ignoreExist(linkErr), os.Remove(taken))
+		}
+		time.Sleep(time.Millisecond) // an acquirer created the lock file while it was aside and is giving way
+	}
+}
+
+// lockAsideInfix names lock files taken aside by takeLockFile ; their lease still holds while they are aside
+const lockAsideInfix = ".take-"
+
+// takeLockFile renames the lock file at lockPath aside when it holds the lease of token and returns where it went.
+// Nobody can reap, renew or remove a lock file while it is aside. Leases of other holders are put back untouched and
+// ErrLockExpired is returned. A lock file that is aside for someone else at that moment is waited for briefly.
+func takeLockFile(lockPath string, token string) (string, *LockHolder, error) {
+	taken := lockPath + lockAsideInfix + newLockToken()
+	deadline := time.Now().Add(lockRetryInterval)
+	for {
+		renameErr := os.Rename(lockPath, taken)
+		if renameErr == nil {
+			break
+		}
+		if !errors.Is(renameErr, fs.ErrNotExist) {
+			return ``, nil, renameErr
+		}
+		if time.Now().After(deadline) || !asideLockHeld(filepath.Dir(lockPath), filepath.Base(lockPath)) {
+			return ``, nil, ErrLockExpired
+		}
+		time.Sleep(time.Millisecond)
+	}
+	lease, leaseErr := readLockHolder(taken)
+	if leaseErr != nil {
+		return ``, nil, errors.Join(leaseErr, restoreLockFile(taken, lockPath))
+	}
+	if lease.Token != token {
+		return ``, nil, errors.Join(ErrLockExpired, restoreLockFile(taken, lockPath))
+	}
+	return taken, lease, nil
+}
+
+// restoreLockFile puts a lock file taken aside back at lockPath, unless a new lock was created there in the meantime
+func restoreLockFile(taken string, lockPath string) error {
+	linkErr := os.Link(taken, lockPath)
+	return errors.Join(ignoreExist(linkErr), os.Remove(taken))
+}
+
+// releaseLockFile removes the lock file at lockPath when it holds the lease of token and returns true once it is gone
+func releaseLockFile(lockPath string, token string) bool {
+	taken, _, takeErr := takeLockFile(lockPath, token)
+	if takeErr != nil {
+		// gone already, or the lease expired and the lock now belongs to someone else
+		return errors.Is(takeErr, ErrLockExpired) && !pathExists(lockPath)
+	}
+	rmErr := os.Remove(taken)
+	if rmErr != nil && !os.IsNotExist(rmErr) {
+		log.Printf("releaseLockFile() raised error at os.Remove() called rmErr = %v", rmErr)
+		return false
+	}
+	return true
+}
+
+// asideLockHeld returns true when dir holds the lock file name taken aside with a lease that has not expired. Expired
+// ones were left behind by a process that stopped in the middle of a renewal and are reaped on the way.
+func asideLockHeld(dir string, name string) bool {
+	return lockFilesHeld(dir, func(entry string) bool {
+		return isAsideLockFile(entry, name+lockAsideInfix)
+	})
+}
+
+// isAsideLockFile returns true for lock files starting with prefix that were taken aside by takeLockFile, but not for
+// the files reapLockFile creates while it reaps one of them
+func isAsideLockFile(name string, prefix string) bool {
+	return strings.HasPrefix(name, prefix) && strings.Contains(name, lockAsideInfix) && !strings.Contains(name, ".reap-")
+}
+
+// lockFilesHeld lists dir once and returns true when one of the lock files that match holds a lease that has not
+// expired ; expired ones are reaped on the way. A lock file moves between its name and the name it is taken aside to
+// with a rename, which a single listing never sees half done, so a holder renewing its lease is never missed. When a
+// listed lock file is gone by the time it is read, dir is listed again.
+func lockFilesHeld(dir string, match func(name string) bool) bool {
+	for listing := 0; listing < 3; listing++ {
+		entries, readDirErr := os.ReadDir(dir)
+		if readDirErr != nil {
+			return false
+		}
+		changed := false
+		for _, entry := range entries {
+			if entry.IsDir() || !match(entry.Name()) {
+				continue
+			}
+			path := filepath.Join(dir, entry.Name())
+			lease, leaseErr := readLockHolder(path)
+			if errors.Is(leaseErr, fs.ErrNotExist) {
+				changed = true
+				continue
+			}
+			now := time.Now().UTC()
+			if leaseErr == nil && !lease.expired(now) {
+				return true
+			}
+			reaped, reapErr := reapLockFile(path, now)
+			if reapErr != nil || !reaped {
+				return true
+			}
+		}
+		if !changed {
+			return false
+		}
+	}
+	return true // the lock files keep moving, so someone is holding and renewing them
+}
+
+// Heartbeat renews the lock this Cache holds on identifier every third of the LockTTL until ctx is done, stop is
+// called or a renewal fails.
+func (c *Cache) Heartbeat(ctx context.Context, identifier string) (stop func()) {
+	ctx, stop = context.WithCancel(ctx)
+	go func() {
+		ticker := time.NewTicker(c.lockTTL() / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				renewErr := c.RenewIdentifierLock(identifier)
+				if renewErr != nil {
+					log.Printf("c.Heartbeat(%v) stopped because c.RenewIdentifierLock() returned %v", identifier, renewErr)
+					return
+				}
+			}
+		}
+	}()
+	return stop
+}
+
+// walkLockFiles calls fn with the path of every .locked and .rlocked-<token> file inside of the Cache's database
+func (c *Cache) walkLockFiles(ctx context.Context, fn func(path string) error) error {
+	root := filepath.Clean(c.Path)
+	return filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil // removed while walking
+			}
+			return err
+		}
+		ctxErr := ctx.Err()
+		if ctxErr != nil {
+			return ctxErr
+		}
+		if d.IsDir() {
+			if path != root && strings.HasPrefix(d.Name(), ".") {
+				return filepath.SkipDir // .tombstones, .nodes and the like never hold locks
+			}
+			return nil
+		}
+		if d.Name() != ".locked" && !isSharedLockFile(d.Name()) {
+			return nil
+		}
+		return fn(path)
+	})
+}
+
+// ReapStaleLocks walks the Cache's database and removes every exclusive and shared lock file whose lease has expired.
+// It returns the number of locks that were removed.
+func (c *Cache) ReapStaleLocks(ctx context.Context) (int, error) {
+	reaped := 0
+	now := time.Now().UTC()
+	walkErr := c.walkLockFiles(ctx, func(path string) error {
+		removed, reapErr := reapLockFile(path, now)
+		if reapErr != nil {
+			return reapErr
+		}
+		if removed {
+			reaped++
+		}
+		return nil
+	})
+	return reaped, walkErr
+}
+
+// lockHolderAt reads the holder of the lock file at path and fills in the identifier from the directory of lock files
+// that were written before holders were recorded
+func (c *Cache) lockHolderAt(path string) (*LockHolder, error) {
+	holder, holderErr := readLockHolder(path)
+	if holderErr != nil {
+		return nil, holderErr
+	}
+	if len(holder.Identifier) == 0 {
+		rel, relErr := filepath.Rel(c.Path, filepath.Dir(path))
+		if relErr == nil {
+			holder.Identifier = strings.ReplaceAll(rel, string(os.PathSeparator), ``)
+		}
+	}
+	return holder, nil
+}
+
+// LockInfo returns the holder of the lock on identifier, or an error matching fs.ErrNotExist when it is not locked
+func (c *Cache) LockInfo(identifier string) (*LockHolder, error) {
+	return c.lockHolderAt(filepath.Join(c.Path, IdentifierPath(identifier), ".locked"))
+}
+
+// ListLocks returns the holder of every lock inside of the Cache's database, including expired and shared ones
+func (c *Cache) ListLocks(ctx context.Context) ([]*LockHolder, error) {
+	var holders []*LockHolder
+	walkErr := c.walkLockFiles(ctx, func(path string) error {
+		holder, holderErr := c.lockHolderAt(path)
+		if holderErr != nil {
+			if errors.Is(holderErr, fs.ErrNotExist) {
+				return nil // unlocked while walking
+			}
+			return fmt.Errorf("unreadable lock file %v: %w", path, holderErr)
+		}
+		holders = append(holders, holder)
+		return nil
+	})
+	return holders, walkErr
+}
+
+// BreakLock forcibly removes every lock on identifier regardless of who holds it or whether its lease has expired :
+// the exclusive .locked, every shared .rlocked-<token> and the lock files renamed aside to be taken over or reaped. It
+// is meant for administrators ; the previous holders find out the next time they renew their lease.
+func (c *Cache) BreakLock(identifier string) error {
+	dir := filepath.Join(c.Path, IdentifierPath(identifier))
+	entries, readDirErr := os.ReadDir(dir)
+	if readDirErr != nil {
+		if os.IsNotExist(readDirErr) {
+			return nil
+		}
+		return readDirErr
+	}
+	var rmErr error
+	for _, entry := range entries {
+		name := entry.Name()
+		held := name == ".locked" || strings.HasPrefix(name, ".locked.") || strings.HasPrefix(name, sharedLockPrefix)
+		if entry.IsDir() || !held {
+			continue
+		}
+		removeErr := os.Remove(filepath.Join(dir, name))
+		if removeErr != nil && !os.IsNotExist(removeErr) {
+			rmErr = errors.Join(rmErr, removeErr)
+		}
+	}
+	return rmErr
+}
+
+// ListLocks returns the holder of every lock inside of databasePath
+func (v *Valet) ListLocks(databasePath string) ([]*LockHolder, error) {
+	c, cErr := v.cache(databasePath)
+	if cErr != nil {
+		return nil, cErr
+	}
+	ctx := v.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	return c.ListLocks(ctx)
+}
+
+// BreakLock forcibly removes the lock on identifier inside databasePath
+func (v *Valet) BreakLock(databasePath string, identifier string) error {
+	c, cErr := v.cache(databasePath)
+	if cErr != nil {
+		return cErr
+	}
+	return c.BreakLock(identifier)
+}
+
+// StartLockReaper runs ReapStaleLocks on every database of the Valet each interval until the Valet's context is done
+// or stop is called.
+func (v *Valet) StartLockReaper(interval time.Duration) (stop func()) {
+	v.SafetyCheck()
+	parent := v.ctx
+	if parent == nil {
+		parent = context.Background()
+	}
+	ctx, stop := context.WithCancel(parent)
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				v.mu.RLock()
+				caches := make(map[string]*Cache, len(v.Databases))
+				for name, cache := range v.Databases {
+					caches[name] = cache
+				}
+				v.mu.RUnlock()
+				for name, cache := range caches {
+					_, reapErr := cache.ReapStaleLocks(ctx)
+					if reapErr != nil && ctx.Err() == nil {
+						log.Printf("v.StartLockReaper() received err from cache.ReapStaleLocks(%v) = %v", name, reapErr)
+					}
+				}
+			}
+		}
+	}()
+	return stop
+}
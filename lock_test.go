@@ -0,0 +1,442 @@
+package go_apario_identifier
+
+import (
+	`context`
+	`errors`
+	`fmt`
+	`log`
+	`os`
+	`path/filepath`
+	`testing`
+	`time`
+)
+
+func TestCache_ReapStaleLocks(t *testing.T) {
+	db, err := os.MkdirTemp("", "leases.db")
+	if err != nil {
+		t.Errorf("os.MkdirTemp() received err %v", err)
+		return
+	}
+	defer func(path string) {
+		err := os.RemoveAll(path)
+		if err != nil {
+			log.Printf("os.RemoveAll(%v) returned err %v", path, err)
+		}
+	}(db)
+
+	crashed, _ := NewValet(db).GetCache(db)
+	crashed.LockTTL = 50 * time.Millisecond
+	survivor, _ := NewValet(db).GetCache(db)
+
+	identifier := "2024LEASE"
+	lockPath := filepath.Join(db, IdentifierPath(identifier), ".locked")
+	err = crashed.LockIdentifier(identifier)
+	if err != nil {
+		t.Errorf("crashed.LockIdentifier() returned err %v", err)
+		return
+	}
+
+	reaped, reapErr := survivor.ReapStaleLocks(context.Background())
+	if reapErr != nil || reaped != 0 {
+		t.Errorf("expected an active lease to survive the reaper ; got %d reaped and err %v", reaped, reapErr)
+		return
+	}
+
+	time.Sleep(80 * time.Millisecond)
+	reaped, reapErr = survivor.ReapStaleLocks(context.Background())
+	if reapErr != nil || reaped != 1 {
+		t.Errorf("expected the expired lease to be reaped ; got %d reaped and err %v", reaped, reapErr)
+		return
+	}
+
+	err = survivor.LockIdentifier(identifier)
+	if err != nil {
+		t.Errorf("survivor.LockIdentifier() returned err %v", err)
+		return
+	}
+
+	// the crashed holder comes back ; it must not be able to renew or remove the survivor's lock
+	if renewErr := crashed.RenewIdentifierLock(identifier); !errors.Is(renewErr, ErrLockExpired) {
+		t.Errorf("expected ErrLockExpired ; got %v", renewErr)
+		return
+	}
+	crashed.UnlockIdentifier(identifier)
+	if !pathExists(lockPath) {
+		t.Errorf("expected the survivor's .locked file to remain after the crashed holder unlocked")
+		return
+	}
+	survivor.UnlockIdentifier(identifier)
+	if pathExists(lockPath) {
+		t.Errorf("expected .locked to be removed after the survivor unlocked")
+		return
+	}
+
+	// lock files written before leases existed only hold a timestamp
+	legacy := fmt.Sprintf("%d", time.Now().UTC().Add(-time.Hour).Unix())
+	err = os.WriteFile(lockPath, []byte(legacy), 0600)
+	if err != nil {
+		t.Errorf("os.WriteFile(.locked) returned err %v", err)
+		return
+	}
+	err = survivor.LockIdentifier(identifier)
+	if err != nil {
+		t.Errorf("expected survivor.LockIdentifier() to take over the expired legacy lock ; got %v", err)
+		return
+	}
+	survivor.UnlockIdentifier(identifier)
+}
+
+func TestCache_Heartbeat(t *testing.T) {
+	db, err := os.MkdirTemp("", "heartbeat.db")
+	if err != nil {
+		t.Errorf("os.MkdirTemp() received err %v", err)
+		return
+	}
+	defer func(path string) {
+		err := os.RemoveAll(path)
+		if err != nil {
+			log.Printf("os.RemoveAll(%v) returned err %v", path, err)
+		}
+	}(db)
+
+	valet := NewValet(db)
+	cache, _ := valet.GetCache(db)
+	cache.LockTTL = 60 * time.Millisecond
+
+	identifier := "2024BEAT"
+	if renewErr := cache.RenewIdentifierLock(identifier); !errors.Is(renewErr, ErrLockNotHeld) {
+		t.Errorf("expected ErrLockNotHeld ; got %v", renewErr)
+		return
+	}
+
+	err = cache.LockIdentifier(identifier)
+	if err != nil {
+		t.Errorf("cache.LockIdentifier() returned err %v", err)
+		return
+	}
+	stop := cache.Heartbeat(context.Background(), identifier)
+	stopReaper := valet.StartLockReaper(10 * time.Millisecond)
+	time.Sleep(200 * time.Millisecond)
+	stopReaper()
+
+	if !writerLockHeld(filepath.Join(db, IdentifierPath(identifier), ".locked")) {
+		t.Errorf("expected the heartbeat to keep the lease alive")
+		stop()
+		return
+	}
+	stop()
+	cache.UnlockIdentifier(identifier)
+}
+
+func TestValet_ListLocks(t *testing.T) {
+	db, err := os.MkdirTemp("", "holders.db")
+	if err != nil {
+		t.Errorf("os.MkdirTemp() received err %v", err)
+		return
+	}
+	defer func(path string) {
+		err := os.RemoveAll(path)
+		if err != nil {
+			log.Printf("os.RemoveAll(%v) returned err %v", path, err)
+		}
+	}(db)
+
+	valet := NewValet(db)
+	cache, _ := valet.GetCache(db)
+
+	identifier := "2024HOLDER"
+	err = cache.LockIdentifierAs(identifier, "nightly-import")
+	if err != nil {
+		t.Errorf("cache.LockIdentifierAs() returned err %v", err)
+		return
+	}
+
+	holder, infoErr := cache.LockInfo(identifier)
+	if infoErr != nil {
+		t.Errorf("cache.LockInfo() returned err %v", infoErr)
+		return
+	}
+	if holder.Identifier != identifier || holder.Label != "nightly-import" || holder.PID != os.Getpid() || holder.Expired() {
+		t.Errorf("unexpected lock holder %+v", holder)
+		return
+	}
+
+	// a lock file written before holders were recorded is still listed under its identifier
+	legacy := "2024LEGACY"
+	legacyDir := filepath.Join(db, IdentifierPath(legacy))
+	err = os.MkdirAll(legacyDir, 0700)
+	if err != nil {
+		t.Errorf("os.MkdirAll() returned err %v", err)
+		return
+	}
+	err = os.WriteFile(filepath.Join(legacyDir, ".locked"), []byte(fmt.Sprintf("%d", time.Now().UTC().Unix())), 0600)
+	if err != nil {
+		t.Errorf("os.WriteFile(.locked) returned err %v", err)
+		return
+	}
+
+	holders, listErr := valet.ListLocks(db)
+	if listErr != nil || len(holders) != 2 {
+		t.Errorf("expected 2 locks ; got %d and err %v", len(holders), listErr)
+		return
+	}
+	found := map[string]bool{}
+	for _, h := range holders {
+		found[h.Identifier] = true
+	}
+	if !found[identifier] || !found[legacy] {
+		t.Errorf("expected %v and %v to be listed ; got %v", identifier, legacy, found)
+		return
+	}
+
+	err = valet.BreakLock(db, identifier)
+	if err != nil {
+		t.Errorf("valet.BreakLock() returned err %v", err)
+		return
+	}
+	if _, infoErr = cache.LockInfo(identifier); !errors.Is(infoErr, os.ErrNotExist) {
+		t.Errorf("expected the broken lock to be gone ; got %v", infoErr)
+		return
+	}
+	if renewErr := cache.RenewIdentifierLock(identifier); !errors.Is(renewErr, ErrLockExpired) {
+		t.Errorf("expected ErrLockExpired after the lock was broken ; got %v", renewErr)
+		return
+	}
+	cache.UnlockIdentifier(identifier)
+}
+
+func TestValet_BreakLock_Shared(t *testing.T) {
+	db, err := os.MkdirTemp("", "holders.db")
+	if err != nil {
+		t.Errorf("os.MkdirTemp() received err %v", err)
+		return
+	}
+	defer func(path string) {
+		err := os.RemoveAll(path)
+		if err != nil {
+			log.Printf("os.RemoveAll(%v) returned err %v", path, err)
+		}
+	}(db)
+
+	identifier := "2024SHARED"
+	readers := []*Valet{NewValet(db), NewValet(db)}
+	for _, reader := range readers {
+		c, _ := reader.GetCache(db)
+		err = c.RLockIdentifier(identifier)
+		if err != nil {
+			t.Errorf("c.RLockIdentifier() returned err %v", err)
+			return
+		}
+	}
+	dir := filepath.Join(db, IdentifierPath(identifier))
+	err = os.WriteFile(filepath.Join(dir, ".locked"+lockAsideInfix+"abandoned"), []byte("{}"), 0600)
+	if err != nil {
+		t.Errorf("os.WriteFile(.locked.take-) returned err %v", err)
+		return
+	}
+
+	valet := NewValet(db)
+	holders, listErr := valet.ListLocks(db)
+	if listErr != nil || len(holders) != 2 {
+		t.Errorf("expected 2 shared locks ; got %d and err %v", len(holders), listErr)
+		return
+	}
+	err = valet.BreakLock(db, identifier)
+	if err != nil {
+		t.Errorf("valet.BreakLock() returned err %v", err)
+		return
+	}
+	holders, listErr = valet.ListLocks(db)
+	if listErr != nil || len(holders) != 0 {
+		t.Errorf("expected every shared lock to be broken ; got %d and err %v", len(holders), listErr)
+		return
+	}
+	if pathExists(filepath.Join(dir, ".locked"+lockAsideInfix+"abandoned")) {
+		t.Errorf("expected the lock file taken aside to be broken")
+		return
+	}
+	cache, _ := valet.GetCache(db)
+	err = cache.TryLockIdentifier(identifier)
+	if err != nil {
+		t.Errorf("expected the exclusive lock to be free once the shared locks were broken ; got %v", err)
+		return
+	}
+	cache.UnlockIdentifier(identifier)
+	for _, reader := range readers {
+		c, _ := reader.GetCache(db)
+		c.RUnlockIdentifier(identifier)
+	}
+}
+
+func TestCache_LockIdentifierContext(t *testing.T) {
+	db, err := os.MkdirTemp("", "deadlines.db")
+	if err != nil {
+		t.Errorf("os.MkdirTemp() received err %v", err)
+		return
+	}
+	defer func(path string) {
+		err := os.RemoveAll(path)
+		if err != nil {
+			log.Printf("os.RemoveAll(%v) returned err %v", path, err)
+		}
+	}(db)
+
+	holder, _ := NewValet(db).GetCache(db)
+	waiter, _ := NewValet(db).GetCache(db)
+
+	identifier := "2024WAIT"
+	err = holder.LockIdentifier(identifier)
+	if err != nil {
+		t.Errorf("holder.LockIdentifier() returned err %v", err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	started := time.Now()
+	err = waiter.LockIdentifierContext(ctx, identifier)
+	cancel()
+	if !errors.Is(err, ErrLockTimeout) || !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected ErrLockTimeout ; got %v", err)
+		return
+	}
+	if waited := time.Since(started); waited > 500*time.Millisecond {
+		t.Errorf("expected the wait to be bounded by the deadline ; waited %v", waited)
+		return
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	if err = waiter.LockIdentifierContext(ctx, identifier); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected context.Canceled ; got %v", err)
+		return
+	}
+	if err = waiter.TryLockIdentifier(identifier); !errors.Is(err, ErrIdentifierLocked) {
+		t.Errorf("expected ErrIdentifierLocked from TryLockIdentifier ; got %v", err)
+		return
+	}
+	if err = waiter.TryRLockIdentifier(identifier); !errors.Is(err, ErrIdentifierLocked) {
+		t.Errorf("expected ErrIdentifierLocked from TryRLockIdentifier ; got %v", err)
+		return
+	}
+
+	holder.UnlockIdentifier(identifier)
+	if err = waiter.TryLockIdentifier(identifier); err != nil {
+		t.Errorf("expected TryLockIdentifier to succeed once unlocked ; got %v", err)
+		return
+	}
+	waiter.UnlockIdentifier(identifier)
+}
+
+func TestCache_RenewIdentifierLock_Reaped(t *testing.T) {
+	db, err := os.MkdirTemp("", "renew.db")
+	if err != nil {
+		t.Errorf("os.MkdirTemp() received err %v", err)
+		return
+	}
+	defer func(path string) {
+		err := os.RemoveAll(path)
+		if err != nil {
+			log.Printf("os.RemoveAll(%v) returned err %v", path, err)
+		}
+	}(db)
+
+	late, _ := NewValet(db).GetCache(db)
+	late.LockTTL = 2 * time.Millisecond
+	taker, _ := NewValet(db).GetCache(db)
+
+	// a holder renewing right as its lease runs out must never overwrite the lock of whoever reaped it
+	for i := 0; i < 50; i++ {
+		identifier := fmt.Sprintf("2024RENEW%d", i)
+		lockPath := filepath.Join(db, IdentifierPath(identifier), ".locked")
+		err = late.LockIdentifier(identifier)
+		if err != nil {
+			t.Errorf("late.LockIdentifier() returned err %v", err)
+			return
+		}
+		renewed := make(chan struct{})
+		go func() {
+			defer close(renewed)
+			// sleeping at least a lease lets it run out, right as the next renewal starts
+			for late.RenewIdentifierLock(identifier) == nil {
+				time.Sleep(late.LockTTL + time.Duration(i%4)*time.Millisecond/2)
+			}
+		}()
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		err = taker.LockIdentifierContext(ctx, identifier)
+		cancel()
+		if err != nil {
+			t.Errorf("taker.LockIdentifierContext() returned err %v", err)
+			return
+		}
+		<-renewed
+		holder, holderErr := readLockHolder(lockPath)
+		token, _ := taker.heldToken(identifier)
+		if holderErr != nil || holder.Token != token {
+			t.Errorf("expected the taker to own %v ; got %+v and err %v", identifier, holder, holderErr)
+			return
+		}
+		late.UnlockIdentifier(identifier)
+		taker.UnlockIdentifier(identifier)
+		entries, _ := os.ReadDir(filepath.Dir(lockPath))
+		for _, entry := range entries {
+			if entry.Name() != ".identifier" {
+				t.Errorf("expected no lock files to be left behind ; got %v", entry.Name())
+				return
+			}
+		}
+	}
+}
+
+func TestCache_RenewIdentifierLock_Held(t *testing.T) {
+	db, err := os.MkdirTemp("", "renewing.db")
+	if err != nil {
+		t.Errorf("os.MkdirTemp() received err %v", err)
+		return
+	}
+	defer func(path string) {
+		err := os.RemoveAll(path)
+		if err != nil {
+			log.Printf("os.RemoveAll(%v) returned err %v", path, err)
+		}
+	}(db)
+
+	holder, _ := NewValet(db).GetCache(db)
+	contender, _ := NewValet(db).GetCache(db)
+	identifier := "2024HELD"
+	err = holder.LockIdentifier(identifier)
+	if err != nil {
+		t.Errorf("holder.LockIdentifier() returned err %v", err)
+		return
+	}
+	defer holder.UnlockIdentifier(identifier)
+
+	// the lock file is aside for a moment on every renewal ; nobody may take the identifier in the meantime
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	renewed := make(chan error, 1)
+	go func() {
+		for ctx.Err() == nil {
+			renewErr := holder.RenewIdentifierLock(identifier)
+			if renewErr != nil {
+				renewed <- renewErr
+				return
+			}
+		}
+		renewed <- nil
+	}()
+	for ctx.Err() == nil {
+		if contender.TryLockIdentifier(identifier) == nil {
+			t.Errorf("expected the renewing holder to keep its exclusive lock")
+			contender.UnlockIdentifier(identifier)
+			return
+		}
+		if contender.TryRLockIdentifier(identifier) == nil {
+			t.Errorf("expected no shared lock while the renewing holder has the exclusive lock")
+			contender.RUnlockIdentifier(identifier)
+			return
+		}
+	}
+	if renewErr := <-renewed; renewErr != nil {
+		t.Errorf("holder.RenewIdentifierLock() returned err %v", renewErr)
+	}
+}
@@ -0,0 +1,197 @@
+package go_apario_identifier
+
+import (
+	`container/list`
+	`sync`
+)
+
+// DefaultLockTableCapacity is how many identifiers (and paths) keep their mutex and semaphore in memory before the
+// least recently used idle ones are evicted
+const DefaultLockTableCapacity = 369
+
+// LockTableStats describes the in-memory mutexes and semaphores of a Cache
+type LockTableStats struct {
+	Entries   int   `json:"entries"`   // keys with a mutex or semaphore in memory
+	InUse     int   `json:"in_use"`    // keys referenced by a held lock or an operation in progress ; never evicted
+	Pinned    int   `json:"pinned"`    // keys whose mutex or semaphore was handed out by Cache.Mutex and friends ; never evicted
+	Capacity  int   `json:"capacity"`  // entries beyond which idle keys are evicted
+	Evictions int64 `json:"evictions"` // idle keys evicted since the Cache was created
+}
+
+// lockTable reference counts the keys of Cache.Mutexes and Cache.Semaphores and keeps the idle ones in least recently
+// used order so that the maps stay bounded. A key is referenced from the moment a lock on it is requested until it is
+// released, so a mutex that is held or waited on is never evicted and replaced by a new one. Keys whose mutex or
+// semaphore was handed out through the exported accessors are pinned instead: the Cache cannot tell when the caller is
+// done with them, so they stay in memory for the lifetime of the Cache.
+type lockTable struct {
+	mu        sync.Mutex
+	capacity  int
+	refs      map[string]int
+	pinned    map[string]bool
+	idle      *list.List // front is the most recently used
+	elements  map[string]*list.Element
+	evictions int64
+}
+
+func newLockTable(capacity int) *lockTable {
+	if capacity < 1 {
+		capacity = DefaultLockTableCapacity
+	}
+	return &lockTable{
+		capacity: capacity,
+		refs:     make(map[string]int),
+		pinned:   make(map[string]bool),
+		idle:     list.New(),
+		elements: make(map[string]*list.Element),
+	}
+}
+
+// retain references key so that its mutex and semaphore are kept until release is called
+func (c *Cache) retain(key string) {
+	c.SafetyCheck()
+	t := c.table
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if element, idle := t.elements[key]; idle {
+		t.idle.Remove(element)
+		delete(t.elements, key)
+	}
+	t.refs[key]++
+}
+
+// release drops a reference taken by retain ; once key is no longer referenced it becomes idle and may be evicted
+func (c *Cache) release(key string) {
+	c.SafetyCheck()
+	t := c.table
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.refs[key] < 1 {
+		return // never retained
+	}
+	t.refs[key]--
+	if t.refs[key] > 0 {
+		return
+	}
+	delete(t.refs, key)
+	if t.pinned[key] {
+		return
+	}
+	t.elements[key] = t.idle.PushFront(key)
+	c.evictIdle()
+}
+
+// touch records a use of key by callers that did not retain it, such as Cache.LoadDatabase
+func (c *Cache) touch(key string) {
+	c.SafetyCheck()
+	t := c.table
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.refs[key] > 0 || t.pinned[key] {
+		return
+	}
+	if element, idle := t.elements[key]; idle {
+		t.idle.MoveToFront(element)
+		return
+	}
+	t.elements[key] = t.idle.PushFront(key)
+	c.evictIdle()
+}
+
+// pin keeps the mutex and semaphore of key in memory for the lifetime of the Cache, for callers that hold on to them
+// without retaining key, such as those of Cache.Mutex and Cache.Semaphore
+func (c *Cache) pin(key string) {
+	c.SafetyCheck()
+	t := c.table
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.pinned[key] {
+		return
+	}
+	t.pinned[key] = true
+	if element, idle := t.elements[key]; idle {
+		t.idle.Remove(element)
+		delete(t.elements, key)
+	}
+}
+
+// evictIdle removes least recently used idle keys while the table is over capacity. Pinned keys are never idle, and a
+// key whose mutex is locked or whose semaphore has been acquired is skipped as well. The caller must hold
+// c.table.mu.
+func (c *Cache) evictIdle() {
+	t := c.table
+	element := t.idle.Back()
+	for element != nil && t.size() > t.capacity {
+		previous := element.Prev()
+		key := element.Value.(string)
+		if c.evict(key) {
+			t.idle.Remove(element)
+			delete(t.elements, key)
+			t.evictions++
+		}
+		element = previous
+	}
+}
+
+// evict removes the mutex and semaphore of key unless either of them is in use
+func (c *Cache) evict(key string) bool {
+	c.muMu.Lock()
+	defer c.muMu.Unlock()
+	c.muSe.Lock()
+	defer c.muSe.Unlock()
+	mu, mExists := c.Mutexes[key]
+	if mExists {
+		if !mu.TryLock() {
+			return false
+		}
+		defer mu.Unlock()
+	}
+	s, sExists := c.Semaphores[key]
+	if sExists && s.Len() > 0 {
+		return false
+	}
+	delete(c.Mutexes, key)
+	delete(c.Semaphores, key)
+	return true
+}
+
+// size returns how many keys are in the table: referenced, pinned or idle. The caller must hold t.mu.
+func (t *lockTable) size() int {
+	size := len(t.refs) + t.idle.Len()
+	for key := range t.pinned {
+		if t.refs[key] == 0 {
+			size++
+		}
+	}
+	return size
+}
+
+// SetLockTableCapacity changes how many keys keep their mutex and semaphore in memory and evicts idle keys beyond it
+func (c *Cache) SetLockTableCapacity(capacity int) {
+	c.SafetyCheck()
+	if capacity < 1 {
+		capacity = DefaultLockTableCapacity
+	}
+	t := c.table
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.capacity = capacity
+	c.evictIdle()
+}
+
+// LockTableStats returns the size and evictions of the Cache's in-memory mutexes and semaphores
+func (c *Cache) LockTableStats() LockTableStats {
+	c.SafetyCheck()
+	c.muMu.RLock()
+	entries := len(c.Mutexes)
+	c.muMu.RUnlock()
+	t := c.table
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return LockTableStats{
+		Entries:   entries,
+		InUse:     len(t.refs),
+		Pinned:    len(t.pinned),
+		Capacity:  t.capacity,
+		Evictions: t.evictions,
+	}
+}
@@ -0,0 +1,97 @@
+package go_apario_identifier
+
+import (
+	`fmt`
+	`log`
+	`os`
+	`path/filepath`
+	`testing`
+)
+
+func TestCache_LockTable(t *testing.T) {
+	db, err := os.MkdirTemp("", "locktable.db")
+	if err != nil {
+		t.Errorf("os.MkdirTemp() received err %v", err)
+		return
+	}
+	defer func(path string) {
+		err := os.RemoveAll(path)
+		if err != nil {
+			log.Printf("os.RemoveAll(%v) returned err %v", path, err)
+		}
+	}(db)
+
+	cache, _ := NewValet(db).GetCache(db)
+	cache.SetLockTableCapacity(4)
+
+	identifier := "2024TABLE"
+	err = cache.LockIdentifier(identifier)
+	if err != nil {
+		t.Errorf("cache.LockIdentifier() returned err %v", err)
+		return
+	}
+	held := cache.Mutex(identifier)
+
+	for i := 0; i < 20; i++ {
+		path := filepath.Join(db, fmt.Sprintf("file-%d", i))
+		writeErr := cache.SafeWriteBytes(path, []byte("bytes"))
+		if writeErr != nil {
+			t.Errorf("cache.SafeWriteBytes(%v) returned err %v", path, writeErr)
+			return
+		}
+	}
+
+	stats := cache.LockTableStats()
+	if stats.Entries > stats.Capacity || stats.InUse != 1 || stats.Evictions < 16 {
+		t.Errorf("expected the lock table to stay within its capacity of 4 ; got %+v", stats)
+		return
+	}
+	if cache.Mutex(identifier) != held {
+		t.Errorf("expected the mutex of the locked identifier to survive eviction")
+		return
+	}
+	cache.UnlockIdentifier(identifier)
+
+	cache.SetLockTableCapacity(1)
+	stats = cache.LockTableStats()
+	if stats.Entries > 1 || stats.InUse != 0 {
+		t.Errorf("expected idle entries to be evicted down to the new capacity ; got %+v", stats)
+	}
+}
+
+func TestCache_LockTable_Pinned(t *testing.T) {
+	db, err := os.MkdirTemp("", "locktable.db")
+	if err != nil {
+		t.Errorf("os.MkdirTemp() received err %v", err)
+		return
+	}
+	defer func(path string) {
+		err := os.RemoveAll(path)
+		if err != nil {
+			log.Printf("os.RemoveAll(%v) returned err %v", path, err)
+		}
+	}(db)
+
+	valet := NewValet(db)
+	cache, _ := valet.GetCache(db)
+	cache.SetLockTableCapacity(2)
+
+	// handed out but not locked yet ; eviction must not replace them with new ones
+	mu := cache.M("2024PINNED")
+	s := cache.S("2024PINNED")
+	valet.Acquire(db, "2024PINNED")
+	for i := 0; i < 20; i++ {
+		path := filepath.Join(db, fmt.Sprintf("file-%d", i))
+		_ = cache.SafeWriteBytes(path, []byte("bytes"))
+	}
+	if cache.Mutex("2024PINNED") != mu || cache.Semaphore("2024PINNED") != s {
+		t.Errorf("expected the mutex and semaphore handed out by M and S to survive eviction")
+		return
+	}
+	valet.Release(db, "2024PINNED")
+
+	stats := cache.LockTableStats()
+	if stats.Pinned != 1 || stats.InUse != 0 || stats.Entries > stats.Capacity {
+		t.Errorf("expected one pinned key and no key in use ; got %+v", stats)
+	}
+}
@@ -0,0 +1,392 @@
+package go_apario_identifier
+
+import (
+	`context`
+	`encoding/json`
+	`errors`
+	`fmt`
+	`io/fs`
+	`os`
+	`path/filepath`
+	`runtime/debug`
+	`sync`
+	`time`
+)
+
+const (
+	// ManifestFile is the file at the root of a database that describes its layout
+	ManifestFile = ".apario.json"
+	// ManifestFormatVersion is the format of databases created by this version of the package
+	ManifestFormatVersion = 1
+	// PathStrategyFibonacci shards identifiers into directories the way IdentifierPath does
+	PathStrategyFibonacci = "fibonacci"
+	// modulePath is used to find the version of the package that created a database
+	modulePath = "github.com/andreimerlescu/go-apario-identifier"
+)
+
+var (
+	ErrDatabaseExists  Err = errors.New("database is already initialized")
+	ErrManifestInvalid Err = errors.New("invalid database manifest")
+	ErrManifestTooNew  Err = errors.New("database manifest is newer than this package")
+	ErrManifestUpgrade Err = errors.New("no upgrade registered for database manifest")
+	ErrManifestMissing Err = errors.New("database has no manifest")
+)
+
+// Manifest describes the layout of a database and the settings it was created with. It is kept in ManifestFile at
+// the root of the database and validated the first time a Valet uses the database. Countable decides whether
+// Valet.NextID counts identifiers, and Identifier provides the defaults of Valet.NewID and Store.Create.
+type Manifest struct {
+	FormatVersion int               `json:"format_version"`
+	PathStrategy  string            `json:"path_strategy"` // how identifiers are sharded into directories
+	Charset       string            `json:"charset"`       // characters identifiers are made of
+	Countable     bool              `json:"countable"`     // identifiers are issued from .lastid by Valet.NextID
+	Identifier    IdentifierOptions `json:"identifier"`    // how new identifiers are generated
+	CreatedAt     time.Time         `json:"created_at"`
+	CreatedBy     string            `json:"created_by"` // version of the package that created the database
+	UpgradedAt    time.Time         `json:"upgraded_at,omitempty"`
+}
+
+// DatabaseOptions configures InitDatabase
+type DatabaseOptions struct {
+	Countable  bool              `json:"countable"`  // also write .lastid, as NewCountableDatabase does
+	Identifier IdentifierOptions `json:"identifier"` // how new identifiers are generated
+}
+
+// ManifestUpgrade brings the database at databasePath and its manifest from one format version to the next. It may
+// move files around and change m ; the version of m is raised and written by the caller once it returns nil.
+type ManifestUpgrade func(databasePath string, m *Manifest) error
+
+// ManifestUpgrades holds the upgrades of the database format, keyed by the format version they upgrade from
+type ManifestUpgrades struct {
+	mu       sync.RWMutex
+	upgrades map[int]ManifestUpgrade
+}
+
+// NewManifestUpgrades returns a registry holding the upgrade of databases created before manifests existed
+func NewManifestUpgrades() *ManifestUpgrades {
+	return &ManifestUpgrades{upgrades: map[int]ManifestUpgrade{0: upgradeLegacyDatabase}}
+}
+
+// DefaultManifestUpgrades is the registry used by Valet.OpenDatabase
+var DefaultManifestUpgrades = NewManifestUpgrades()
+
+// RegisterManifestUpgrade registers upgrade in DefaultManifestUpgrades ; see ManifestUpgrades.Register
+func RegisterManifestUpgrade(from int, upgrade ManifestUpgrade) error {
+	return DefaultManifestUpgrades.Register(from, upgrade)
+}
+
+// Register adds upgrade as the upgrade of databases at format version from to from+1. Only the upgrade from format 0,
+// which describes databases created before manifests existed, may be replaced.
+func (u *ManifestUpgrades) Register(from int, upgrade ManifestUpgrade) error {
+	if upgrade == nil || from < 0 {
+		return fmt.Errorf("u.Register(%d) requires an upgrade from a format of at least 0", from)
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if _, registered := u.upgrades[from]; registered && from > 0 {
+		return fmt.Errorf("an upgrade from format %d is already registered", from)
+	}
+	u.upgrades[from] = upgrade
+	return nil
+}
+
+func (u *ManifestUpgrades) upgrade(from int) (ManifestUpgrade, bool) {
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+	upgrade, exists := u.upgrades[from]
+	return upgrade, exists
+}
+
+// upgradeLegacyDatabase describes a database created before manifests existed ; its creation time is unknown, so the
+// time of the upgrade is recorded instead
+func upgradeLegacyDatabase(databasePath string, m *Manifest) error {
+	m.PathStrategy = PathStrategyFibonacci
+	m.Charset = IdentifierCharset
+	m.Countable = pathExists(filepath.Join(databasePath, ".lastid"))
+	m.CreatedAt = time.Now().UTC()
+	m.CreatedBy = "unknown"
+	return nil
+}
+
+// moduleVersion returns the version of the package built into the program
+func moduleVersion() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "(devel)"
+	}
+	if info.Main.Path == modulePath {
+		return info.Main.Version
+	}
+	for _, dep := range info.Deps {
+		if dep.Path == modulePath {
+			return dep.Version
+		}
+	}
+	return "(devel)"
+}
+
+// newManifest returns the manifest of a database created now
+func newManifest(opts DatabaseOptions) *Manifest {
+	return &Manifest{
+		FormatVersion: ManifestFormatVersion,
+		PathStrategy:  PathStrategyFibonacci,
+		Charset:       IdentifierCharset,
+		Countable:     opts.Countable,
+		Identifier:    opts.Identifier,
+		CreatedAt:     time.Now().UTC(),
+		CreatedBy:     moduleVersion(),
+	}
+}
+
+// Validate returns an error matching ErrManifestInvalid when the manifest describes a layout this package cannot read,
+// or ErrManifestTooNew when it was written by a newer version of the package
+func (m *Manifest) Validate() error {
+	switch {
+	case m.FormatVersion > ManifestFormatVersion:
+		return fmt.Errorf("%w: format %d, this package reads up to %d", ErrManifestTooNew, m.FormatVersion, ManifestFormatVersion)
+	case m.FormatVersion < 1:
+		return fmt.Errorf("%w: format version %d", ErrManifestInvalid, m.FormatVersion)
+	case m.PathStrategy != PathStrategyFibonacci:
+		return fmt.Errorf("%w: unknown path strategy %q", ErrManifestInvalid, m.PathStrategy)
+	case m.Charset != IdentifierCharset:
+		return fmt.Errorf("%w: charset %q differs from %q", ErrManifestInvalid, m.Charset, IdentifierCharset)
+	case m.CreatedAt.IsZero():
+		return fmt.Errorf("%w: missing creation time", ErrManifestInvalid)
+	case m.Identifier.Length < 0 || m.Identifier.MaxAttempts < 0:
+		return fmt.Errorf("%w: negative identifier options", ErrManifestInvalid)
+	}
+	return nil
+}
+
+// ReadManifest reads the manifest of the database at databasePath without validating it. Databases created before
+// manifests existed return an error matching fs.ErrNotExist.
+func ReadManifest(databasePath string) (*Manifest, error) {
+	manifestBytes, readErr := os.ReadFile(filepath.Join(databasePath, ManifestFile))
+	if readErr != nil {
+		return nil, readErr
+	}
+	m := &Manifest{}
+	jsonErr := json.Unmarshal(manifestBytes, m)
+	if jsonErr != nil {
+		return nil, fmt.Errorf("%w: %w", ErrManifestInvalid, jsonErr)
+	}
+	return m, nil
+}
+
+// writeManifest atomically replaces the manifest of the database at databasePath
+func writeManifest(databasePath string, m *Manifest) error {
+	manifestBytes, jsonErr := json.MarshalIndent(m, "", "  ")
+	if jsonErr != nil {
+		return jsonErr
+	}
+	return WriteFileAtomic(filepath.Join(databasePath, ManifestFile), manifestBytes, 0600, DurabilityFull)
+}
+
+// createManifest writes m as the manifest of the database at databasePath, or returns ErrDatabaseExists when it has
+// one. The manifest is written to a temporary file that is linked into place, so it is created exclusively, like with
+// O_EXCL, and never seen half written.
+func createManifest(databasePath string, m *Manifest) error {
+	manifestBytes, jsonErr := json.MarshalIndent(m, "", "  ")
+	if jsonErr != nil {
+		return jsonErr
+	}
+	f, createErr := os.CreateTemp(databasePath, ManifestFile+".tmp-*")
+	if createErr != nil {
+		return createErr
+	}
+	tmp := f.Name()
+	writeErr := writeTempFile(f, manifestBytes, 0600, DurabilityFull, nil)
+	closeErr := f.Close()
+	if writeErr != nil || closeErr != nil {
+		return errors.Join(writeErr, closeErr, os.Remove(tmp))
+	}
+	linkErr := os.Link(tmp, filepath.Join(databasePath, ManifestFile))
+	rmErr := os.Remove(tmp)
+	if errors.Is(linkErr, fs.ErrExist) {
+		return fmt.Errorf("%w: %v", ErrDatabaseExists, databasePath)
+	}
+	if linkErr != nil || rmErr != nil {
+		return errors.Join(linkErr, rmErr)
+	}
+	return syncDir(databasePath)
+}
+
+// InitDatabase creates the database at databasePath and its manifest. Databases that already have a manifest are
+// refused with ErrDatabaseExists, even when several callers initialize the same database at once.
+func InitDatabase(databasePath string, opts DatabaseOptions) (*Manifest, error) {
+	mkdirErr := os.MkdirAll(databasePath, 0700)
+	if mkdirErr != nil {
+		return nil, mkdirErr
+	}
+	m := newManifest(opts)
+	validErr := m.Validate()
+	if validErr != nil {
+		return nil, validErr
+	}
+	createErr := createManifest(databasePath, m)
+	if createErr != nil {
+		return nil, createErr
+	}
+	if opts.Countable && !pathExists(filepath.Join(databasePath, ".lastid")) {
+		writeErr := WriteFileAtomic(filepath.Join(databasePath, ".lastid"), []byte("1"), 0600, DurabilityFull)
+		if writeErr != nil {
+			return nil, writeErr
+		}
+	}
+	return m, nil
+}
+
+// markCountable records in the manifest of databasePath that it is countable, creating the manifest when the database
+// has none, and returns the manifest
+func markCountable(databasePath string) (*Manifest, error) {
+	m, readErr := ReadManifest(databasePath)
+	if errors.Is(readErr, fs.ErrNotExist) {
+		m = newManifest(DatabaseOptions{Countable: true})
+		createErr := createManifest(databasePath, m)
+		if !errors.Is(createErr, ErrDatabaseExists) {
+			return m, createErr
+		}
+		m, readErr = ReadManifest(databasePath) // created by another caller in the meantime
+	}
+	if readErr != nil {
+		return nil, readErr
+	}
+	if m.Countable {
+		return m, nil
+	}
+	m.Countable = true
+	return m, writeManifest(databasePath, m)
+}
+
+// loadManifest reads and validates the manifest of the database the first time it is needed and returns it, or nil
+// for a database created before manifests existed. An invalid manifest is reported on every call.
+func (c *Cache) loadManifest() (*Manifest, error) {
+	c.SafetyCheck()
+	c.muMa.Lock()
+	defer c.muMa.Unlock()
+	if c.manifested {
+		return c.Manifest, nil
+	}
+	m, readErr := ReadManifest(c.Path)
+	if readErr != nil {
+		if errors.Is(readErr, fs.ErrNotExist) {
+			c.manifested = true
+			return nil, nil
+		}
+		return nil, readErr
+	}
+	validErr := m.Validate()
+	if validErr != nil {
+		return nil, fmt.Errorf("%v: %w", c.Path, validErr)
+	}
+	c.Manifest, c.manifested = m, true
+	return m, nil
+}
+
+// setManifest makes m the manifest of the database
+func (c *Cache) setManifest(m *Manifest) {
+	c.SafetyCheck()
+	c.muMa.Lock()
+	defer c.muMa.Unlock()
+	c.Manifest, c.manifested = m, true
+}
+
+// identifierOptions fills the options that opts leaves at their zero value with those of the manifest
+func (m *Manifest) identifierOptions(opts IdentifierOptions) IdentifierOptions {
+	if m == nil {
+		return opts
+	}
+	if opts.Length == 0 {
+		opts.Length = m.Identifier.Length
+	}
+	if opts.MaxAttempts == 0 {
+		opts.MaxAttempts = m.Identifier.MaxAttempts
+	}
+	if opts.Year == 0 {
+		opts.Year = m.Identifier.Year
+	}
+	return opts
+}
+
+// upgradeManifest brings the manifest of databasePath up to target with upgrades, writing it after every step
+func upgradeManifest(databasePath string, m *Manifest, upgrades *ManifestUpgrades, target int) error {
+	for m.FormatVersion < target {
+		upgrade, exists := upgrades.upgrade(m.FormatVersion)
+		if !exists {
+			return fmt.Errorf("%w: from format %d", ErrManifestUpgrade, m.FormatVersion)
+		}
+		upgradeErr := upgrade(databasePath, m)
+		if upgradeErr != nil {
+			return fmt.Errorf("upgrading %v from format %d: %w", databasePath, m.FormatVersion, upgradeErr)
+		}
+		m.FormatVersion++
+		m.UpgradedAt = time.Now().UTC()
+		writeErr := writeManifest(databasePath, m)
+		if writeErr != nil {
+			return writeErr
+		}
+	}
+	return nil
+}
+
+// OpenDatabase validates the manifest of the database at databasePath and starts tracking the database. Databases
+// at an older format are upgraded with DefaultManifestUpgrades first. Directories that do not exist are refused ;
+// create them with InitDatabase. Directories without a manifest are refused with ErrManifestMissing, since they may
+// not be a database at all ; adopt them with AdoptDatabase.
+func (v *Valet) OpenDatabase(ctx context.Context, databasePath string) (*Cache, error) {
+	return v.openDatabase(ctx, databasePath, DefaultManifestUpgrades, ManifestFormatVersion, false)
+}
+
+// AdoptDatabase is OpenDatabase for a database created before manifests existed: a directory without a manifest is
+// described as one with the upgrade from format 0 and its manifest is written
+func (v *Valet) AdoptDatabase(ctx context.Context, databasePath string) (*Cache, error) {
+	return v.openDatabase(ctx, databasePath, DefaultManifestUpgrades, ManifestFormatVersion, true)
+}
+
+func (v *Valet) openDatabase(ctx context.Context, databasePath string, upgrades *ManifestUpgrades, target int, adopt bool) (*Cache, error) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	info, statErr := os.Stat(databasePath)
+	if statErr != nil {
+		return nil, statErr
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("%w: %v is not a directory", ErrNoSuchDatabase, databasePath)
+	}
+	m, readErr := ReadManifest(databasePath)
+	if readErr != nil {
+		if !errors.Is(readErr, fs.ErrNotExist) {
+			return nil, readErr
+		}
+		if !adopt {
+			return nil, fmt.Errorf("%w: %v", ErrManifestMissing, databasePath)
+		}
+		m = &Manifest{FormatVersion: 0}
+	}
+	if m.FormatVersion > target {
+		return nil, fmt.Errorf("%w: format %d, this package reads up to %d", ErrManifestTooNew, m.FormatVersion, target)
+	}
+	upgradeErr := upgradeManifest(databasePath, m, upgrades, target)
+	if upgradeErr != nil {
+		return nil, upgradeErr
+	}
+	if target == ManifestFormatVersion {
+		validErr := m.Validate()
+		if validErr != nil {
+			return nil, validErr
+		}
+	}
+
+	v.SafetyCheck()
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	c, tracked := v.Databases[databasePath]
+	if !tracked || c == nil {
+		c = &Cache{ctx: context.WithoutCancel(ctx), Path: databasePath}
+		c.SafetyCheck()
+		v.Databases[databasePath] = c
+	}
+	c.setManifest(m)
+	return c, nil
+}
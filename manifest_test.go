@@ -0,0 +1,166 @@
+package go_apario_identifier
+
+import (
+	`context`
+	`encoding/json`
+	`errors`
+	`log`
+	`os`
+	`path/filepath`
+	`testing`
+)
+
+func TestValet_OpenDatabase(t *testing.T) {
+	root, err := os.MkdirTemp("", "manifest.db")
+	if err != nil {
+		t.Errorf("os.MkdirTemp() received err %v", err)
+		return
+	}
+	defer func(path string) {
+		err := os.RemoveAll(path)
+		if err != nil {
+			log.Printf("os.RemoveAll(%v) returned err %v", path, err)
+		}
+	}(root)
+	ctx := context.Background()
+
+	// a database created with InitDatabase
+	db := filepath.Join(root, "documents")
+	m, initErr := InitDatabase(db, DatabaseOptions{Countable: true, Identifier: IdentifierOptions{Length: 7}})
+	if initErr != nil {
+		t.Errorf("InitDatabase() returned err %v", initErr)
+		return
+	}
+	if m.FormatVersion != ManifestFormatVersion || !m.Countable || m.CreatedAt.IsZero() || len(m.CreatedBy) == 0 {
+		t.Errorf("expected a complete manifest ; got %+v", m)
+		return
+	}
+	if !pathExists(filepath.Join(db, ".lastid")) {
+		t.Errorf("expected a countable database to have a .lastid")
+		return
+	}
+	_, initErr = InitDatabase(db, DatabaseOptions{})
+	if !errors.Is(initErr, ErrDatabaseExists) {
+		t.Errorf("expected ErrDatabaseExists ; got %v", initErr)
+		return
+	}
+
+	valet := NewValet(root)
+	cache, openErr := valet.OpenDatabase(ctx, db)
+	if openErr != nil || cache.Manifest == nil || cache.Manifest.Identifier.Length != 7 {
+		t.Errorf("expected to open the database with its manifest ; got %+v and err %v", cache, openErr)
+		return
+	}
+	if tracked, _ := valet.GetCache(db); tracked != cache {
+		t.Errorf("expected the opened database to be tracked by the valet")
+		return
+	}
+
+	// the settings of the manifest apply
+	id, idErr := valet.NewID(db, 0)
+	if idErr != nil || len(id.Fragment.String()) != 7 {
+		t.Errorf("expected NewID to use the identifier length of the manifest ; got %v and err %v", id, idErr)
+		return
+	}
+	if !valet.IsCountableDatabase(db) {
+		t.Errorf("expected the manifest to make the database countable")
+		return
+	}
+	uncounted := filepath.Join(root, "uncounted")
+	_, _ = InitDatabase(uncounted, DatabaseOptions{})
+	_ = os.WriteFile(filepath.Join(uncounted, ".lastid"), []byte("5"), 0600)
+	if NewValet(uncounted).IsCountableDatabase(uncounted) {
+		t.Errorf("expected a manifest that is not countable to win over a .lastid")
+		return
+	}
+
+	// only one of the callers initializing a database at once creates it
+	racing := filepath.Join(root, "racing")
+	created := make(chan error, 8)
+	for i := 0; i < cap(created); i++ {
+		go func() {
+			_, raceErr := InitDatabase(racing, DatabaseOptions{})
+			created <- raceErr
+		}()
+	}
+	winners := 0
+	for i := 0; i < cap(created); i++ {
+		raceErr := <-created
+		if raceErr == nil {
+			winners++
+		} else if !errors.Is(raceErr, ErrDatabaseExists) {
+			t.Errorf("expected ErrDatabaseExists for the callers that lost ; got %v", raceErr)
+			return
+		}
+	}
+	if winners != 1 {
+		t.Errorf("expected exactly one caller to initialize the database ; got %d", winners)
+		return
+	}
+
+	// a database created before manifests existed is only upgraded when it is adopted
+	legacy := filepath.Join(root, "legacy")
+	_ = NewValet(legacy).NewCountableDatabase(legacy)
+	_ = os.Remove(filepath.Join(legacy, ManifestFile))
+	_, openErr = valet.OpenDatabase(ctx, legacy)
+	if !errors.Is(openErr, ErrManifestMissing) || pathExists(filepath.Join(legacy, ManifestFile)) {
+		t.Errorf("expected a directory without a manifest to be refused ; got %v", openErr)
+		return
+	}
+	cache, openErr = valet.AdoptDatabase(ctx, legacy)
+	if openErr != nil || cache.Manifest.FormatVersion != ManifestFormatVersion || !cache.Manifest.Countable {
+		t.Errorf("expected the legacy database to be upgraded ; got %+v and err %v", cache.Manifest, openErr)
+		return
+	}
+	if _, readErr := ReadManifest(legacy); readErr != nil {
+		t.Errorf("expected the upgrade to write the manifest ; got err %v", readErr)
+		return
+	}
+
+	// an upgrade to a format this package does not know yet
+	upgrades := NewManifestUpgrades()
+	moved := false
+	_ = upgrades.Register(1, func(databasePath string, m *Manifest) error {
+		moved = true
+		return nil
+	})
+	if upgrades.Register(1, func(databasePath string, m *Manifest) error { return nil }) == nil {
+		t.Errorf("expected a second upgrade from format 1 to be refused")
+		return
+	}
+	_, openErr = valet.openDatabase(ctx, db, upgrades, 2, false)
+	m, _ = ReadManifest(db)
+	if openErr != nil || !moved || m.FormatVersion != 2 || m.UpgradedAt.IsZero() {
+		t.Errorf("expected the database to be upgraded to format 2 ; got %+v and err %v", m, openErr)
+		return
+	}
+	_, openErr = valet.openDatabase(ctx, db, upgrades, 3, false)
+	if !errors.Is(openErr, ErrManifestUpgrade) {
+		t.Errorf("expected ErrManifestUpgrade without an upgrade from 2 ; got %v", openErr)
+		return
+	}
+	_, openErr = valet.OpenDatabase(ctx, db)
+	if !errors.Is(openErr, ErrManifestTooNew) {
+		t.Errorf("expected ErrManifestTooNew for a format 2 database ; got %v", openErr)
+		return
+	}
+
+	// manifests that describe another layout are refused
+	m.FormatVersion = 1
+	m.PathStrategy = "flat"
+	manifestBytes, _ := json.Marshal(m)
+	_ = os.WriteFile(filepath.Join(db, ManifestFile), manifestBytes, 0600)
+	_, openErr = valet.OpenDatabase(ctx, db)
+	if !errors.Is(openErr, ErrManifestInvalid) {
+		t.Errorf("expected ErrManifestInvalid for an unknown path strategy ; got %v", openErr)
+		return
+	}
+	if _, cacheErr := NewValet(db).GetCache(db); !errors.Is(cacheErr, ErrManifestInvalid) {
+		t.Errorf("expected GetCache to validate the manifest ; got %v", cacheErr)
+		return
+	}
+	_, openErr = valet.OpenDatabase(ctx, filepath.Join(root, "missing"))
+	if !errors.Is(openErr, os.ErrNotExist) {
+		t.Errorf("expected a missing database to be refused ; got %v", openErr)
+	}
+}
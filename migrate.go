@@ -0,0 +1,207 @@
+package go_apario_identifier
+
+import (
+	`context`
+	`errors`
+	`fmt`
+	`io/fs`
+	`os`
+	`path/filepath`
+	`strings`
+	`sync`
+)
+
+var (
+	ErrMigrationMissing Err = errors.New("no migration registered for record schema")
+	ErrMigrationExists  Err = errors.New("migration already registered for record schema")
+	ErrSchemaTooNew     Err = errors.New("record schema is newer than the store")
+	ErrRecordType       Err = errors.New("record holds a different type")
+)
+
+// Migration rewrites the encoded payload of a record from one schema version to the next. The payload is in the codec
+// the record was written with, which is JSON for records written before record headers existed.
+type Migration func(old []byte) ([]byte, error)
+
+// Migrations holds the migration steps of each record type, keyed by the schema version they migrate from
+type Migrations struct {
+	mu    sync.RWMutex
+	steps map[string]map[int]Migration
+}
+
+// NewMigrations returns an empty migration registry
+func NewMigrations() *Migrations {
+	return &Migrations{steps: make(map[string]map[int]Migration)}
+}
+
+// DefaultMigrations is the registry used by Stores that do not set StoreOptions.Migrations
+var DefaultMigrations = NewMigrations()
+
+// RegisterMigration registers step in DefaultMigrations ; see Migrations.Register
+func RegisterMigration(recordType string, from int, step Migration) error {
+	return DefaultMigrations.Register(recordType, from, step)
+}
+
+// Register adds step as the migration of recordType records from schema version from to from+1
+func (m *Migrations) Register(recordType string, from int, step Migration) error {
+	if step == nil || from < 0 {
+		return fmt.Errorf("m.Register(%v, %d) requires a step from a schema of at least 0", recordType, from)
+	}
+	typeErr := validRecordType(recordType)
+	if typeErr != nil {
+		return typeErr
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	steps, exists := m.steps[recordType]
+	if !exists {
+		steps = make(map[int]Migration)
+		m.steps[recordType] = steps
+	}
+	if _, registered := steps[from]; registered {
+		return fmt.Errorf("%w: %v from %d", ErrMigrationExists, recordType, from)
+	}
+	steps[from] = step
+	return nil
+}
+
+// Migrate runs the steps of recordType over payload from schema version from up to version to
+func (m *Migrations) Migrate(recordType string, from, to int, payload []byte) ([]byte, error) {
+	if from > to {
+		return nil, fmt.Errorf("%w: %v is at %d and the store at %d", ErrSchemaTooNew, recordType, from, to)
+	}
+	for version := from; version < to; version++ {
+		m.mu.RLock()
+		step, exists := m.steps[recordType][version]
+		m.mu.RUnlock()
+		if !exists {
+			return nil, fmt.Errorf("%w: %v from %d", ErrMigrationMissing, recordType, version)
+		}
+		migrated, stepErr := step(payload)
+		if stepErr != nil {
+			return nil, fmt.Errorf("migrating %v from %d: %w", recordType, version, stepErr)
+		}
+		payload = migrated
+	}
+	return payload, nil
+}
+
+// validRecordType refuses record types that cannot be written into a RecordHeader
+func validRecordType(recordType string) error {
+	if len(recordType) == 0 || strings.ContainsAny(recordType, ";=\r\n") {
+		return fmt.Errorf("%w: invalid record type %q", ErrRecordHeader, recordType)
+	}
+	return nil
+}
+
+// decode decodes recordBytes into a T, migrating records written at an older schema version first. It returns true
+// when the record was migrated.
+func (s *Store[T]) decode(recordBytes []byte) (T, bool, error) {
+	var record T
+	header, codec, payload, decodeErr := decodePayload(recordBytes)
+	if decodeErr != nil {
+		return record, false, decodeErr
+	}
+	if len(header.Type) > 0 && header.Type != s.recordType {
+		return record, false, fmt.Errorf("%w: %v is not %v", ErrRecordType, header.Type, s.recordType)
+	}
+	migrated := header.Schema != s.schema
+	if migrated {
+		var migrateErr error
+		payload, migrateErr = s.migrations.Migrate(s.recordType, header.Schema, s.schema, payload)
+		if migrateErr != nil {
+			return record, false, migrateErr
+		}
+	}
+	return record, migrated, codec.Unmarshal(payload, &record)
+}
+
+// MigrationReport counts the records a bulk migration looked at
+type MigrationReport struct {
+	Scanned  int `json:"scanned"`  // record files found
+	Migrated int `json:"migrated"` // records rewritten at the Store's schema version
+	Failed   int `json:"failed"`   // records that could not be migrated ; their errors are returned
+}
+
+// Migrate rewrites every record of the Store that was written at an older schema version, so that later reads no
+// longer have to migrate it. Records are rewritten one at a time through Cache.Update ; a record that fails to migrate
+// is left as it was and its error is returned once every other record has been looked at.
+func (s *Store[T]) Migrate(ctx context.Context) (MigrationReport, error) {
+	report := MigrationReport{}
+	var failures error
+	walkErr := s.cache.walkIdentifierDirs(ctx, func(identifier string, dir string) error {
+		recordBytes, readErr := os.ReadFile(filepath.Join(dir, s.file))
+		if readErr != nil {
+			if errors.Is(readErr, fs.ErrNotExist) {
+				return nil
+			}
+			return readErr
+		}
+		report.Scanned++
+		header, _, headerErr := ParseRecordHeader(recordBytes)
+		if headerErr == nil && header.Type == s.recordType && header.Schema == s.schema {
+			return nil
+		}
+		migrated := false
+		updateErr := s.cache.Update(ctx, identifier, func(tx *Tx) error {
+			current, txReadErr := tx.Read(s.file)
+			if txReadErr != nil {
+				return txReadErr
+			}
+			record, _, decodeErr := s.decode(current)
+			if decodeErr != nil {
+				return decodeErr
+			}
+			rewritten, encodeErr := encodeRecord(record, s.codec, s.compression, s.recordType, s.schema)
+			if encodeErr != nil {
+				return encodeErr
+			}
+			migrated = true
+			return tx.Write(s.file, rewritten)
+		})
+		if updateErr != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			report.Failed++
+			failures = errors.Join(failures, fmt.Errorf("%v: %w", identifier, updateErr))
+			return nil
+		}
+		if migrated {
+			report.Migrated++
+		}
+		return nil
+	})
+	return report, errors.Join(walkErr, failures)
+}
+
+// walkIdentifierDirs calls fn with every directory of the database and the identifier it would hold. Directories
+// starting with a dot hold locks, transactions and other bookkeeping, and are skipped along with everything inside.
+func (c *Cache) walkIdentifierDirs(ctx context.Context, fn func(identifier string, dir string) error) error {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	root := filepath.Clean(c.Path)
+	return filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		ctxErr := ctx.Err()
+		if ctxErr != nil {
+			return ctxErr
+		}
+		if !d.IsDir() || path == root {
+			return nil
+		}
+		if strings.HasPrefix(d.Name(), ".") {
+			return filepath.SkipDir
+		}
+		rel, relErr := filepath.Rel(root, path)
+		if relErr != nil {
+			return relErr
+		}
+		return fn(strings.ReplaceAll(rel, string(os.PathSeparator), ``), path)
+	})
+}
@@ -0,0 +1,133 @@
+package go_apario_identifier
+
+import (
+	`context`
+	`encoding/json`
+	`errors`
+	`log`
+	`os`
+	`path/filepath`
+	`testing`
+)
+
+// renameJSONField returns a Migration that renames the field from to the field to
+func renameJSONField(from, to string) Migration {
+	return func(old []byte) ([]byte, error) {
+		fields := map[string]any{}
+		jsonErr := json.Unmarshal(old, &fields)
+		if jsonErr != nil {
+			return nil, jsonErr
+		}
+		fields[to] = fields[from]
+		delete(fields, from)
+		return json.Marshal(fields)
+	}
+}
+
+func TestStore_Migrate(t *testing.T) {
+	db, err := os.MkdirTemp("", "migrate.db")
+	if err != nil {
+		t.Errorf("os.MkdirTemp() received err %v", err)
+		return
+	}
+	defer func(path string) {
+		err := os.RemoveAll(path)
+		if err != nil {
+			log.Printf("os.RemoveAll(%v) returned err %v", path, err)
+		}
+	}(db)
+
+	migrations := NewMigrations()
+	_ = migrations.Register("document", 0, renameJSONField("name", "title"))
+	_ = migrations.Register("document", 1, renameJSONField("page_count", "pages"))
+	if !errors.Is(migrations.Register("document", 1, renameJSONField("a", "b")), ErrMigrationExists) {
+		t.Errorf("expected a second migration from 1 to be refused")
+		return
+	}
+
+	cache, _ := NewValet(db).GetCache(db)
+	documents, storeErr := NewStore[storeTestDocument](cache, StoreOptions{Type: "document", Schema: 2, Migrations: migrations})
+	if storeErr != nil {
+		t.Errorf("NewStore() returned err %v", storeErr)
+		return
+	}
+	ctx := context.Background()
+
+	// a record written years ago, before record headers and schema versions existed
+	legacy := []byte(`{"name":"Memo","page_count":4}`)
+	recordPath := filepath.Join(db, IdentifierPath("1999MEMO"), DefaultRecordFile)
+	_ = os.MkdirAll(filepath.Dir(recordPath), 0700)
+	err = os.WriteFile(recordPath, legacy, 0600)
+	if err != nil {
+		t.Errorf("os.WriteFile() returned err %v", err)
+		return
+	}
+
+	document, getErr := documents.Get(ctx, "1999MEMO")
+	if getErr != nil || document.Title != "Memo" || document.Pages != 4 {
+		t.Errorf("expected the legacy record to be migrated on load ; got %+v and err %v", document, getErr)
+		return
+	}
+	onDisk, _ := os.ReadFile(recordPath)
+	if string(onDisk) != string(legacy) {
+		t.Errorf("expected Get to leave the legacy file alone ; got %q", onDisk)
+		return
+	}
+
+	report, migrateErr := documents.Migrate(ctx)
+	if migrateErr != nil || report.Scanned != 1 || report.Migrated != 1 || report.Failed != 0 {
+		t.Errorf("expected one record to be migrated ; got %+v and err %v", report, migrateErr)
+		return
+	}
+	onDisk, _ = os.ReadFile(recordPath)
+	header, _, headerErr := ParseRecordHeader(onDisk)
+	if headerErr != nil || header.Type != "document" || header.Schema != 2 {
+		t.Errorf("expected the rewritten record at schema 2 ; got %+v and err %v", header, headerErr)
+		return
+	}
+	document, getErr = documents.Get(ctx, "1999MEMO")
+	if getErr != nil || document.Title != "Memo" || document.Pages != 4 {
+		t.Errorf("expected the rewritten record to read back ; got %+v and err %v", document, getErr)
+		return
+	}
+
+	report, migrateErr = documents.Migrate(ctx)
+	if migrateErr != nil || report.Scanned != 1 || report.Migrated != 0 {
+		t.Errorf("expected nothing left to migrate ; got %+v and err %v", report, migrateErr)
+		return
+	}
+
+	// a store that is missing a step, and one that is older than the record
+	partial := NewMigrations()
+	_ = partial.Register("document", 0, renameJSONField("name", "title"))
+	_ = os.WriteFile(recordPath, legacy, 0600)
+	broken, _ := NewStore[storeTestDocument](cache, StoreOptions{Type: "document", Schema: 2, Migrations: partial})
+	_, getErr = broken.Get(ctx, "1999MEMO")
+	if !errors.Is(getErr, ErrMigrationMissing) {
+		t.Errorf("expected ErrMigrationMissing ; got %v", getErr)
+		return
+	}
+	report, migrateErr = broken.Migrate(ctx)
+	if !errors.Is(migrateErr, ErrMigrationMissing) || report.Failed != 1 {
+		t.Errorf("expected the bulk migration to report the failure ; got %+v and err %v", report, migrateErr)
+		return
+	}
+
+	err = documents.Put(ctx, "1999MEMO", storeTestDocument{Title: "Memo", Pages: 5})
+	if err != nil {
+		t.Errorf("documents.Put() returned err %v", err)
+		return
+	}
+	older, _ := NewStore[storeTestDocument](cache, StoreOptions{Type: "document", Schema: 1, Migrations: migrations})
+	_, getErr = older.Get(ctx, "1999MEMO")
+	if !errors.Is(getErr, ErrSchemaTooNew) {
+		t.Errorf("expected ErrSchemaTooNew ; got %v", getErr)
+		return
+	}
+	other, _ := NewStore[storeTestDocument](cache, StoreOptions{Type: "invoice", Schema: 2, Migrations: migrations})
+	_, getErr = other.Get(ctx, "1999MEMO")
+	if !errors.Is(getErr, ErrRecordType) {
+		t.Errorf("expected ErrRecordType ; got %v", getErr)
+		return
+	}
+}
@@ -0,0 +1,60 @@
+package go_apario_identifier
+
+import (
+	`context`
+	`fmt`
+	`sort`
+	`strings`
+	`sync`
+)
+
+// LockMany acquires the exclusive lock on every one of identifiers and returns a single unlock handle that releases
+// all of them. The locks are taken in canonical order (upper-cased, de-duplicated and sorted) so that two callers
+// locking overlapping sets can never wait on each other in a cycle. When any lock cannot be acquired before ctx is
+// done, the locks acquired so far are released and the error names the identifier that failed.
+//
+// The unlock handle may be called more than once ; only the first call releases the locks.
+func (c *Cache) LockMany(ctx context.Context, identifiers ...string) (unlock func(), err error) {
+	ordered := canonicalIdentifiers(identifiers)
+	var locked []string
+	release := func() {
+		for i := len(locked) - 1; i >= 0; i-- {
+			c.UnlockIdentifier(locked[i])
+		}
+	}
+	for _, identifier := range ordered {
+		lockErr := c.LockIdentifierContext(ctx, identifier)
+		if lockErr != nil {
+			release()
+			return nil, fmt.Errorf("c.LockMany() failed to lock %v: %w", identifier, lockErr)
+		}
+		locked = append(locked, identifier)
+	}
+	var once sync.Once
+	return func() { once.Do(release) }, nil
+}
+
+// canonicalIdentifiers returns identifiers upper-cased, without duplicates and in sorted order
+func canonicalIdentifiers(identifiers []string) []string {
+	seen := make(map[string]bool, len(identifiers))
+	var ordered []string
+	for _, identifier := range identifiers {
+		identifier = strings.ToUpper(identifier)
+		if seen[identifier] {
+			continue
+		}
+		seen[identifier] = true
+		ordered = append(ordered, identifier)
+	}
+	sort.Strings(ordered)
+	return ordered
+}
+
+// LockMany acquires the exclusive lock on every one of identifiers inside databasePrefix ; see Cache.LockMany
+func (v *Valet) LockMany(ctx context.Context, databasePrefix string, identifiers ...string) (unlock func(), err error) {
+	c, cErr := v.cache(databasePrefix)
+	if cErr != nil {
+		return nil, cErr
+	}
+	return c.LockMany(ctx, identifiers...)
+}
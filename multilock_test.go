@@ -0,0 +1,81 @@
+package go_apario_identifier
+
+import (
+	`context`
+	`errors`
+	`log`
+	`os`
+	`sync`
+	`testing`
+	`time`
+)
+
+func TestCache_LockMany(t *testing.T) {
+	db, err := os.MkdirTemp("", "many.db")
+	if err != nil {
+		t.Errorf("os.MkdirTemp() received err %v", err)
+		return
+	}
+	defer func(path string) {
+		err := os.RemoveAll(path)
+		if err != nil {
+			log.Printf("os.RemoveAll(%v) returned err %v", path, err)
+		}
+	}(db)
+
+	// two processes move pages in opposite directions between the same documents
+	first, _ := NewValet(db).GetCache(db)
+	second, _ := NewValet(db).GetCache(db)
+	wg := sync.WaitGroup{}
+	errs := make(chan error, 20)
+	for i := 0; i < 10; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			unlock, lockErr := first.LockMany(context.Background(), "2024DOCA", "2024DOCB")
+			if lockErr != nil {
+				errs <- lockErr
+				return
+			}
+			time.Sleep(5 * time.Millisecond)
+			unlock()
+		}()
+		go func() {
+			defer wg.Done()
+			unlock, lockErr := second.LockMany(context.Background(), "2024docb", "2024DOCA", "2024DOCB")
+			if lockErr != nil {
+				errs <- lockErr
+				return
+			}
+			time.Sleep(5 * time.Millisecond)
+			unlock()
+			unlock()
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for lockErr := range errs {
+		t.Errorf("LockMany() returned err %v", lockErr)
+		return
+	}
+
+	// when one identifier is held elsewhere, nothing stays locked
+	err = second.LockIdentifier("2024DOCB")
+	if err != nil {
+		t.Errorf("second.LockIdentifier() returned err %v", err)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	_, err = first.LockMany(ctx, "2024DOCA", "2024DOCB")
+	cancel()
+	if !errors.Is(err, ErrLockTimeout) {
+		t.Errorf("expected ErrLockTimeout ; got %v", err)
+		return
+	}
+	if err = second.TryLockIdentifier("2024DOCA"); err != nil {
+		t.Errorf("expected 2024DOCA to be released after LockMany failed ; got %v", err)
+		return
+	}
+	second.UnlockIdentifier("2024DOCA")
+	second.UnlockIdentifier("2024DOCB")
+}
@@ -17,6 +17,14 @@ func NewValetWithContext(ctx context.Context, databasePath string) *Valet {
 				Path:       databasePath,
 				Mutexes:    make(map[string]*sync.RWMutex),
 				Semaphores: make(map[string]sema.Semaphore),
+				muMu:       &sync.RWMutex{},
+				muSe:       &sync.RWMutex{},
+				muHe:       &sync.Mutex{},
+				muMa:       &sync.Mutex{},
+				muSn:       &sync.Mutex{},
+				held:       make(map[string]string),
+				rheld:      make(map[string][]string),
+				table:      newLockTable(DefaultLockTableCapacity),
 			},
 		},
 		mu: &sync.RWMutex{},
@@ -34,6 +42,14 @@ func NewValet(databasePath string) *Valet {
 				Path:       databasePath,
 				Mutexes:    make(map[string]*sync.RWMutex),
 				Semaphores: make(map[string]sema.Semaphore),
+				muMu:       &sync.RWMutex{},
+				muSe:       &sync.RWMutex{},
+				muHe:       &sync.Mutex{},
+				muMa:       &sync.Mutex{},
+				muSn:       &sync.Mutex{},
+				held:       make(map[string]string),
+				rheld:      make(map[string][]string),
+				table:      newLockTable(DefaultLockTableCapacity),
 			},
 		},
 		mu: &sync.RWMutex{},
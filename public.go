@@ -2,35 +2,21 @@ package go_apario_identifier
 
 import (
 	`context`
-	`log`
 	`path/filepath`
 	`strconv`
 	`strings`
 	`time`
 )
 
+// NewIdentifier claims a random identifier of identifierLength characters inside databasePrefixPath, trying up to
+// attemptsCounter tokens within timeoutSeconds. It is a wrapper around NewIdentifierContext.
 func NewIdentifier(databasePrefixPath string, identifierLength int, attemptsCounter int, timeoutSeconds int) (*Identifier, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second*time.Duration(timeoutSeconds))
 	defer cancel()
-
-	ticker := time.NewTicker(33 * time.Millisecond)
-	for {
-		select {
-		case <-ctx.Done():
-			return nil, ctx.Err()
-		case <-ticker.C:
-			identifier, identifierErr := generateIdentifier(databasePrefixPath, identifierLength, attemptsCounter)
-			if identifierErr != nil {
-				log.Printf("failed to acquire new identifier with err: %v", identifierErr)
-				return nil, identifierErr
-			} else {
-				if len(identifier.String()) > 6 {
-					return identifier, nil
-				}
-			}
-
-		}
-	}
+	return NewIdentifierContext(ctx, databasePrefixPath, IdentifierOptions{
+		Length:      identifierLength,
+		MaxAttempts: attemptsCounter,
+	})
 }
 
 func ParseIdentifier(identifier string) (*Identifier, error) {
@@ -0,0 +1,151 @@
+package go_apario_identifier
+
+import (
+	`context`
+	`encoding/json`
+	`log`
+	`path/filepath`
+	`strings`
+)
+
+// sharedLockPrefix names the lock files of readers ; every shared lock has its own file suffixed by its token so that
+// any number of readers across processes can hold the identifier at once
+const sharedLockPrefix = ".rlocked-"
+
+// isSharedLockFile returns true for .rlocked-<token> files, but not for the temporary files used to renew or reap them
+func isSharedLockFile(name string) bool {
+	return strings.HasPrefix(name, sharedLockPrefix) && !strings.Contains(strings.TrimPrefix(name, sharedLockPrefix), ".")
+}
+
+func (c *Cache) sharedLockFile(identifier string, token string) string {
+	return filepath.Join(filepath.Dir(c.identifierLockFile(identifier)), sharedLockPrefix+token)
+}
+
+// sharedTokens returns the tokens of the shared locks this Cache holds on identifier
+func (c *Cache) sharedTokens(identifier string) []string {
+	c.SafetyCheck()
+	c.muHe.Lock()
+	defer c.muHe.Unlock()
+	return append([]string{}, c.rheld[identifier]...)
+}
+
+// writerLockHeld returns true when the .locked file at lockPath holds a lease that has not expired, including while
+// its holder has it aside to renew it
+func writerLockHeld(lockPath string) bool {
+	name := filepath.Base(lockPath)
+	return lockFilesHeld(filepath.Dir(lockPath), func(entry string) bool {
+		return entry == name || isAsideLockFile(entry, name+lockAsideInfix)
+	})
+}
+
+// sharedLocksHeld returns true when dir holds a shared lock whose lease has not expired, including one that is aside
+// while its holder renews it
+func sharedLocksHeld(dir string) bool {
+	return lockFilesHeld(dir, func(entry string) bool {
+		return isSharedLockFile(entry) || isAsideLockFile(entry, sharedLockPrefix)
+	})
+}
+
+// RLockIdentifier acquires a shared lock on identifier. Any number of readers, in this process or others sharing the
+// database directory, can hold the shared lock at once, while LockIdentifier waits for all of them to release it.
+//
+// Each reader creates its own .rlocked-<token> file and then checks for a .locked file ; when a writer holds (or is
+// waiting for) the identifier, the reader removes its file and retries every 30ms until DefaultLockTimeout has passed.
+// Shared locks hold a lease just like exclusive ones and are renewed with RenewIdentifierLock or Heartbeat.
+func (c *Cache) RLockIdentifier(identifier string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultLockTimeout)
+	defer cancel()
+	return c.rlockIdentifier(ctx, identifier, false)
+}
+
+// RLockIdentifierContext is RLockIdentifier that waits for writers until ctx is done instead of DefaultLockTimeout
+func (c *Cache) RLockIdentifierContext(ctx context.Context, identifier string) error {
+	return c.rlockIdentifier(ctx, identifier, false)
+}
+
+// TryRLockIdentifier makes a single attempt at a shared lock on identifier and returns ErrIdentifierLocked when a
+// writer has it
+func (c *Cache) TryRLockIdentifier(identifier string) error {
+	return c.rlockIdentifier(context.Background(), identifier, true)
+}
+
+func (c *Cache) rlockIdentifier(ctx context.Context, identifier string, try bool) (err error) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	c.retain(identifier)
+	defer func() {
+		if err != nil {
+			c.release(identifier)
+		}
+	}()
+	err = c.IdentifierCheck(identifier)
+	if err != nil {
+		log.Printf("c.RLockIdentifier(%v) received err %v", identifier, err)
+		return err
+	}
+
+	mu := c.identifierMutex(identifier)
+	lockPath := c.identifierLockFile(identifier)
+	lease := c.newLockHolder(identifier, ``)
+	lease.Shared = true
+	sharedPath := c.sharedLockFile(identifier, lease.Token)
+	leaseBytes, jsonErr := json.Marshal(lease)
+	if jsonErr != nil {
+		return jsonErr
+	}
+	err = c.waitLock(ctx, try, func() (bool, error) {
+		if writerLockHeld(lockPath) {
+			return false, nil
+		}
+		createErr := createLockFile(sharedPath, leaseBytes)
+		if createErr != nil {
+			return false, createErr
+		}
+		if !writerLockHeld(lockPath) {
+			return true, nil
+		}
+		// a writer created .locked in the meantime ; give way to it
+		releaseLockFile(sharedPath, lease.Token)
+		return false, nil
+	})
+	if err != nil {
+		return err
+	}
+	err = c.acquireInMemory(ctx, try, mu.RLock, mu.RUnlock, mu.TryRLock)
+	if err != nil {
+		releaseLockFile(sharedPath, lease.Token)
+		return err
+	}
+
+	c.muHe.Lock()
+	c.rheld[identifier] = append(c.rheld[identifier], lease.Token)
+	c.muHe.Unlock()
+	return nil
+}
+
+// RUnlockIdentifier releases one shared lock this Cache holds on identifier
+func (c *Cache) RUnlockIdentifier(identifier string) {
+	err := c.IdentifierCheck(identifier)
+	if err != nil {
+		log.Printf("c.RUnlockIdentifier(%v) received err %v", identifier, err)
+		return
+	}
+	c.muHe.Lock()
+	tokens := c.rheld[identifier]
+	if len(tokens) == 0 {
+		c.muHe.Unlock()
+		return
+	}
+	token := tokens[len(tokens)-1]
+	if len(tokens) == 1 {
+		delete(c.rheld, identifier)
+	} else {
+		c.rheld[identifier] = tokens[:len(tokens)-1]
+	}
+	c.muHe.Unlock()
+
+	releaseLockFile(c.sharedLockFile(identifier, token), token)
+	c.identifierMutex(identifier).RUnlock()
+	c.release(identifier)
+}
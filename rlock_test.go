@@ -0,0 +1,88 @@
+package go_apario_identifier
+
+import (
+	`log`
+	`os`
+	`sync/atomic`
+	`testing`
+	`time`
+)
+
+func TestCache_RLockIdentifier(t *testing.T) {
+	db, err := os.MkdirTemp("", "shared.db")
+	if err != nil {
+		t.Errorf("os.MkdirTemp() received err %v", err)
+		return
+	}
+	defer func(path string) {
+		err := os.RemoveAll(path)
+		if err != nil {
+			log.Printf("os.RemoveAll(%v) returned err %v", path, err)
+		}
+	}(db)
+
+	// every Valet stands in for a separate process sharing the database directory
+	reader1 := NewValet(db)
+	reader2 := NewValet(db)
+	writer := NewValet(db)
+	identifier := "2024SHARED"
+
+	err = reader1.RLock(db, identifier)
+	if err != nil {
+		t.Errorf("reader1.RLock() returned err %v", err)
+		return
+	}
+	err = reader2.RLock(db, identifier)
+	if err != nil {
+		t.Errorf("expected readers to share the lock ; reader2.RLock() returned err %v", err)
+		return
+	}
+	holders, listErr := writer.ListLocks(db)
+	if listErr != nil || len(holders) != 2 || !holders[0].Shared || !holders[1].Shared {
+		t.Errorf("expected 2 shared locks ; got %v and err %v", holders, listErr)
+		return
+	}
+
+	var readersGone atomic.Bool
+	locked := make(chan error, 1)
+	go func() {
+		lockErr := writer.Lock(db, identifier)
+		if lockErr == nil && !readersGone.Load() {
+			t.Errorf("writer.Lock() succeeded while readers held the lock")
+		}
+		locked <- lockErr
+	}()
+	time.Sleep(100 * time.Millisecond)
+	readersGone.Store(true)
+	reader1.RUnlock(db, identifier)
+	reader2.RUnlock(db, identifier)
+	err = <-locked
+	if err != nil {
+		t.Errorf("writer.Lock() returned err %v", err)
+		return
+	}
+
+	var writerGone atomic.Bool
+	rlocked := make(chan error, 1)
+	go func() {
+		rlockErr := reader1.RLock(db, identifier)
+		if rlockErr == nil && !writerGone.Load() {
+			t.Errorf("reader1.RLock() succeeded while the writer held the lock")
+		}
+		rlocked <- rlockErr
+	}()
+	time.Sleep(100 * time.Millisecond)
+	writerGone.Store(true)
+	writer.Unlock(db, identifier)
+	err = <-rlocked
+	if err != nil {
+		t.Errorf("reader1.RLock() returned err %v", err)
+		return
+	}
+	reader1.RUnlock(db, identifier)
+
+	holders, listErr = writer.ListLocks(db)
+	if listErr != nil || len(holders) != 0 {
+		t.Errorf("expected no locks to remain ; got %v and err %v", holders, listErr)
+	}
+}
@@ -0,0 +1,440 @@
+package go_apario_identifier
+
+import (
+	`encoding/json`
+	`errors`
+	`fmt`
+	`io/fs`
+	`os`
+	`path/filepath`
+	`strconv`
+	`strings`
+	`sync`
+	`time`
+)
+
+// SnowflakeEpoch is the moment that the millisecond component of every snowflake fragment is measured from
+var SnowflakeEpoch = time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+const (
+	snowflakeNodeBits     = 10
+	snowflakeSequenceBits = 12
+
+	// MaxSnowflakeNode is the largest node identifier that can be embedded into a snowflake fragment
+	MaxSnowflakeNode = 1<<snowflakeNodeBits - 1
+
+	maxSnowflakeSequence = 1<<snowflakeSequenceBits - 1
+
+	// snowflakeReserve is how far ahead of the clock the high-water mark of a node is persisted, so that it is written
+	// at most once per snowflakeReserve while identifiers are generated
+	snowflakeReserve = time.Second
+)
+
+var (
+	ErrSnowflakeNodeRange Err = fmt.Errorf("snowflake node must be between 0 and %d", MaxSnowflakeNode)
+	ErrSnowflakeNodeTaken Err = errors.New("snowflake node is registered to another owner in this database")
+	ErrSnowflakeNotInUse  Err = errors.New("database is not configured to use a snowflake generator")
+)
+
+// Snowflake generates identifiers whose fragment is the base36 encoding of milliseconds since SnowflakeEpoch, the
+// node that generated it and a per-node sequence. Two instances that use different nodes can never produce the same
+// fragment, therefore no coordination is required between them when they write into replicated databases.
+type Snowflake struct {
+	Node      int64 `json:"n"`
+	mu        *sync.Mutex
+	lastMs    int64
+	sequence  int64
+	reserved  int64                // high-water mark persisted by persist ; nothing at or above it was issued
+	persist   func(ms int64) error // persists the high-water mark of the node ; nil for a memory-only generator
+	lease     *LockHolder          // the lease on the node held by Valet.UseSnowflake
+	leasePath string               // .nodes/<node>.live
+}
+
+// SnowflakeParts is the decoded form of a snowflake fragment
+type SnowflakeParts struct {
+	Time     time.Time `json:"t"`
+	Node     int64     `json:"n"`
+	Sequence int64     `json:"s"`
+}
+
+// SnowflakeNode is the entry recorded inside the database's .nodes directory when a node is registered
+type SnowflakeNode struct {
+	Node       int64     `json:"node"`
+	Owner      string    `json:"owner"`
+	Registered time.Time `json:"registered"`
+	Ephemeral  bool      `json:"ephemeral,omitempty"` // owned by one Valet instance ; another may take it over once it is not live
+}
+
+// NewSnowflake returns a *Snowflake for node, which must be within 0 and MaxSnowflakeNode
+func NewSnowflake(node int64) (*Snowflake, error) {
+	if node < 0 || node > MaxSnowflakeNode {
+		return nil, ErrSnowflakeNodeRange
+	}
+	return &Snowflake{
+		Node: node,
+		mu:   &sync.Mutex{},
+	}, nil
+}
+
+// Next returns the next *Identifier for the snowflake. The sequence resets every millisecond and when more than
+// maxSnowflakeSequence identifiers are requested within the same millisecond (or the clock moves backwards), the
+// millisecond component is advanced past the last one used so that the fragments remain unique and ascending.
+// A Snowflake from NewSnowflake only remembers the last millisecond in memory ; Valet.UseSnowflake persists it so that
+// fragments stay unique across restarts.
+func (s *Snowflake) Next() (*Identifier, error) {
+	if s.mu == nil {
+		s.mu = &sync.Mutex{}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.next()
+}
+
+// next is Next for callers that hold s.mu
+func (s *Snowflake) next() (*Identifier, error) {
+	ms := time.Now().UTC().Sub(SnowflakeEpoch).Milliseconds()
+	if ms < s.lastMs {
+		ms = s.lastMs
+	}
+	sequence := int64(0)
+	if ms == s.lastMs {
+		sequence = s.sequence + 1
+		if sequence > maxSnowflakeSequence {
+			ms++
+			sequence = 0
+		}
+	}
+	if s.persist != nil && ms >= s.reserved {
+		reserved := ms + snowflakeReserve.Milliseconds()
+		persistErr := s.persist(reserved)
+		if persistErr != nil {
+			return nil, fmt.Errorf("failed to persist the high-water mark of snowflake node %d: %w", s.Node, persistErr)
+		}
+		s.reserved = reserved
+	}
+	s.lastMs, s.sequence = ms, sequence
+	value := ms<<(snowflakeNodeBits+snowflakeSequenceBits) | s.Node<<snowflakeSequenceBits | sequence
+
+	year := SnowflakeEpoch.Add(time.Duration(ms) * time.Millisecond).Year()
+	return CodeFragment(Encode64Base36(value)).ToYearIdentifier(year)
+}
+
+// ParseSnowflake decodes the fragment of a snowflake identifier back into its time, node and sequence
+func ParseSnowflake(identifier *Identifier) (*SnowflakeParts, error) {
+	value, decodeErr := Decode64Base36(identifier.Fragment.String())
+	if decodeErr != nil {
+		return nil, decodeErr
+	}
+	ms := value >> (snowflakeNodeBits + snowflakeSequenceBits)
+	return &SnowflakeParts{
+		Time:     SnowflakeEpoch.Add(time.Duration(ms) * time.Millisecond),
+		Node:     (value >> snowflakeSequenceBits) & MaxSnowflakeNode,
+		Sequence: value & maxSnowflakeSequence,
+	}, nil
+}
+
+// snowflakeNodePath returns the registry entry of node inside databasePath ; its lease (.live) and high-water mark
+// (.last) are kept next to it
+func snowflakeNodePath(databasePath string, node int64) string {
+	return filepath.Join(databasePath, ".nodes", strconv.FormatInt(node, 10))
+}
+
+// RegisterSnowflakeNode records node as belonging to owner inside databasePath/.nodes. The node file is created with
+// O_EXCL so only one owner can ever claim a node; registering the same node again with the same owner is permitted.
+func RegisterSnowflakeNode(databasePath string, node int64, owner string) error {
+	return registerSnowflakeNode(databasePath, node, owner, false)
+}
+
+// registerSnowflakeNode is RegisterSnowflakeNode that may take over a node registered by an ephemeral owner. Callers
+// must hold the lease on the node, so that the ephemeral owner is known not to be live.
+func registerSnowflakeNode(databasePath string, node int64, owner string, ephemeral bool) error {
+	if node < 0 || node > MaxSnowflakeNode {
+		return ErrSnowflakeNodeRange
+	}
+	nodesDir := filepath.Join(databasePath, ".nodes")
+	mkdirErr := os.MkdirAll(nodesDir, 0700)
+	if mkdirErr != nil {
+		return mkdirErr
+	}
+
+	nodePath := snowflakeNodePath(databasePath, node)
+	entry := SnowflakeNode{
+		Node:       node,
+		Owner:      owner,
+		Registered: time.Now().UTC(),
+		Ephemeral:  ephemeral,
+	}
+	entryBytes, jsonErr := json.Marshal(entry)
+	if jsonErr != nil {
+		return jsonErr
+	}
+
+	f, openErr := os.OpenFile(nodePath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if openErr != nil {
+		if !os.IsExist(openErr) {
+			return openErr
+		}
+		existingBytes, readErr := os.ReadFile(nodePath)
+		if readErr != nil {
+			return readErr
+		}
+		existing := &SnowflakeNode{}
+		jsonErr := json.Unmarshal(existingBytes, existing)
+		if jsonErr != nil {
+			return fmt.Errorf("invalid .nodes entry %v: %w", node, jsonErr)
+		}
+		if existing.Owner == owner {
+			return nil
+		}
+		if existing.Ephemeral && ephemeral {
+			return WriteFileAtomic(nodePath, entryBytes, 0600, DurabilityFull)
+		}
+		return ErrSnowflakeNodeTaken
+	}
+	_, writeErr := f.Write(entryBytes)
+	closeErr := f.Close()
+	return errors.Join(writeErr, closeErr)
+}
+
+// SnowflakeNodes returns every node registered inside databasePath/.nodes
+func SnowflakeNodes(databasePath string) ([]*SnowflakeNode, error) {
+	entries, readDirErr := os.ReadDir(filepath.Join(databasePath, ".nodes"))
+	if readDirErr != nil {
+		if os.IsNotExist(readDirErr) {
+			return []*SnowflakeNode{}, nil
+		}
+		return nil, readDirErr
+	}
+	var nodes []*SnowflakeNode
+	for _, entry := range entries {
+		if _, nodeErr := strconv.ParseInt(entry.Name(), 10, 64); entry.IsDir() || nodeErr != nil {
+			continue // leases and high-water marks
+		}
+		entryBytes, readErr := os.ReadFile(filepath.Join(databasePath, ".nodes", entry.Name()))
+		if readErr != nil {
+			return nil, readErr
+		}
+		node := &SnowflakeNode{}
+		jsonErr := json.Unmarshal(entryBytes, node)
+		if jsonErr != nil {
+			return nil, fmt.Errorf("invalid .nodes entry %v: %w", entry.Name(), jsonErr)
+		}
+		nodes = append(nodes, node)
+	}
+	return nodes, nil
+}
+
+// snowflakeOwner returns the owner UseSnowflake registers nodes for when none is given. It names the host, the process
+// and the Valet, so that two processes on one host, or two Valets in one process, never share a node.
+func (v *Valet) snowflakeOwner() string {
+	v.SafetyCheck()
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if len(v.instance) == 0 {
+		v.instance = newLockToken()[:12]
+	}
+	return fmt.Sprintf("%v/%d/%v", lockHostname(), os.Getpid(), v.instance)
+}
+
+// UseSnowflake registers node for owner in databasePath and configures the database's Cache to generate identifiers
+// with a *Snowflake. While the Cache uses the node it holds a lease on it (.nodes/<node>.live) that SnowflakeID renews,
+// so no other Valet can use the node at the same time, even with the same owner ; ErrSnowflakeNodeTaken is returned
+// when the node is live elsewhere. When owner is empty, an owner unique to this Valet is used, and another instance
+// may take the node over once this one released it or stopped renewing its lease. The highest millisecond issued by
+// the node is persisted next to it (.nodes/<node>.last), so a restart after the clock moved backwards never reissues a
+// fragment.
+func (v *Valet) UseSnowflake(databasePath string, node int64, owner string) error {
+	c, cErr := v.cache(databasePath)
+	if cErr != nil {
+		return cErr
+	}
+	if node < 0 || node > MaxSnowflakeNode {
+		return ErrSnowflakeNodeRange
+	}
+	ephemeral := len(owner) == 0
+	if ephemeral {
+		owner = v.snowflakeOwner()
+	}
+	c.muSn.Lock()
+	defer c.muSn.Unlock()
+	if current := c.snowflake; current != nil {
+		current.mu.Lock()
+		inUse := current.Node == node && current.lease != nil && current.lease.Label == owner
+		current.mu.Unlock()
+		if inUse {
+			return nil // already in use by this Valet
+		}
+		releaseErr := c.releaseSnowflake()
+		if releaseErr != nil {
+			return releaseErr
+		}
+	}
+
+	snowflake, snowflakeErr := NewSnowflake(node)
+	if snowflakeErr != nil {
+		return snowflakeErr
+	}
+	nodePath := snowflakeNodePath(databasePath, node)
+	mkdirErr := os.MkdirAll(filepath.Dir(nodePath), 0700)
+	if mkdirErr != nil {
+		return mkdirErr
+	}
+	snowflake.leasePath = nodePath + ".live"
+	leaseErr := c.acquireSnowflakeLease(snowflake, owner)
+	if leaseErr != nil {
+		return leaseErr
+	}
+	registerErr := registerSnowflakeNode(databasePath, node, owner, ephemeral)
+	if registerErr != nil {
+		releaseLockFile(snowflake.leasePath, snowflake.lease.Token)
+		return registerErr
+	}
+	markPath := nodePath + ".last"
+	snowflake.persist = func(ms int64) error {
+		return WriteFileAtomic(markPath, []byte(strconv.FormatInt(ms, 10)), 0600, DurabilityFull)
+	}
+	c.snowflake = snowflake
+	return nil
+}
+
+// acquireSnowflakeLease takes the lease on the node of s for owner, reaping a lease that expired, and restores the
+// high-water mark the node reached under its previous lease
+func (c *Cache) acquireSnowflakeLease(s *Snowflake, owner string) error {
+	lease := c.newLockHolder(``, owner)
+	leaseBytes, jsonErr := json.Marshal(lease)
+	if jsonErr != nil {
+		return jsonErr
+	}
+	dir, name := filepath.Dir(s.leasePath), filepath.Base(s.leasePath)
+	for attempt := 0; ; attempt++ {
+		createErr := createLockFile(s.leasePath, leaseBytes)
+		if createErr == nil && !asideLockHeld(dir, name) {
+			break
+		}
+		if createErr == nil {
+			releaseLockFile(s.leasePath, lease.Token) // the live owner is renewing its lease
+		} else if !errors.Is(createErr, fs.ErrExist) {
+			return createErr
+		} else if attempt == 0 {
+			reaped, reapErr := reapLockFile(s.leasePath, time.Now().UTC())
+			if reapErr != nil {
+				return reapErr
+			}
+			if reaped {
+				continue // the previous owner stopped renewing its lease
+			}
+		}
+		holder, holderErr := readLockHolder(s.leasePath)
+		if holderErr != nil {
+			return fmt.Errorf("%w: node %d is live", ErrSnowflakeNodeTaken, s.Node)
+		}
+		return fmt.Errorf("%w: node %d is live for %v until %v", ErrSnowflakeNodeTaken, s.Node, holder.Label, holder.Expires.Format(time.RFC3339))
+	}
+	s.lease = lease
+
+	markBytes, readErr := os.ReadFile(strings.TrimSuffix(s.leasePath, ".live") + ".last")
+	if readErr != nil && !errors.Is(readErr, fs.ErrNotExist) {
+		return errors.Join(readErr, c.dropSnowflakeLease(s))
+	}
+	if readErr == nil {
+		mark, parseErr := strconv.ParseInt(strings.TrimSpace(string(markBytes)), 10, 64)
+		if parseErr != nil {
+			return errors.Join(fmt.Errorf("invalid high-water mark of snowflake node %d: %w", s.Node, parseErr), c.dropSnowflakeLease(s))
+		}
+		s.lastMs = max(s.lastMs, mark)
+		s.reserved = mark
+	}
+	return nil
+}
+
+// keepSnowflakeLease renews the lease on the node of s once a third of it has passed, and takes it again when it
+// lapsed without another Valet taking the node in the meantime. Callers must hold s.mu.
+func (c *Cache) keepSnowflakeLease(s *Snowflake) error {
+	if s.lease == nil {
+		return ErrSnowflakeNotInUse
+	}
+	now := time.Now().UTC()
+	if now.Before(s.lease.Expires.Add(-2 * c.lockTTL() / 3)) {
+		return nil
+	}
+	renewErr := c.renewLockFile(s.leasePath, s.lease.Token)
+	if renewErr == nil {
+		s.lease.Expires = now.Add(c.lockTTL())
+		return nil
+	}
+	if !errors.Is(renewErr, ErrLockExpired) {
+		return renewErr
+	}
+	owner := s.lease.Label
+	s.lease = nil
+	return c.acquireSnowflakeLease(s, owner)
+}
+
+// dropSnowflakeLease releases the lease on the node of s
+func (c *Cache) dropSnowflakeLease(s *Snowflake) error {
+	if s.lease == nil {
+		return nil
+	}
+	released := releaseLockFile(s.leasePath, s.lease.Token)
+	s.lease = nil
+	if !released {
+		return fmt.Errorf("the lease on snowflake node %d was taken by another owner", s.Node)
+	}
+	return nil
+}
+
+// ReleaseSnowflake stops generating identifiers with the database's *Snowflake and releases the lease on its node, so
+// that another Valet can use the node right away instead of waiting for the lease to expire
+func (v *Valet) ReleaseSnowflake(databasePath string) error {
+	c, cErr := v.cache(databasePath)
+	if cErr != nil {
+		return cErr
+	}
+	c.muSn.Lock()
+	defer c.muSn.Unlock()
+	if c.snowflake == nil {
+		return ErrSnowflakeNotInUse
+	}
+	return c.releaseSnowflake()
+}
+
+// releaseSnowflake stops using the *Snowflake of the Cache and releases the lease on its node. The caller must hold
+// c.muSn and c.snowflake must be set.
+func (c *Cache) releaseSnowflake() error {
+	s := c.snowflake
+	c.snowflake = nil
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return c.dropSnowflakeLease(s)
+}
+
+// SnowflakeID returns the next identifier from the database's *Snowflake and creates its directory with a .identifier
+func (v *Valet) SnowflakeID(databasePath string) (*Identifier, error) {
+	c, cErr := v.cache(databasePath)
+	if cErr != nil {
+		return nil, cErr
+	}
+	c.muSn.Lock()
+	s := c.snowflake
+	c.muSn.Unlock()
+	if s == nil {
+		return nil, ErrSnowflakeNotInUse
+	}
+	s.mu.Lock()
+	leaseErr := c.keepSnowflakeLease(s)
+	if leaseErr != nil {
+		s.mu.Unlock()
+		return nil, leaseErr
+	}
+	identifier, identifierErr := s.next()
+	s.mu.Unlock()
+	if identifierErr != nil {
+		return nil, identifierErr
+	}
+
+	claimErr := c.claimIdentifier(identifier)
+	if claimErr != nil {
+		return nil, claimErr
+	}
+	return identifier, nil
+}
@@ -0,0 +1,297 @@
+package go_apario_identifier
+
+import (
+	`errors`
+	`log`
+	`os`
+	`path/filepath`
+	`strconv`
+	`sync`
+	`testing`
+	`time`
+)
+
+func TestSnowflake_Next(t *testing.T) {
+	snowflake, snowflakeErr := NewSnowflake(42)
+	if snowflakeErr != nil {
+		t.Errorf("NewSnowflake(42) returned err %v", snowflakeErr)
+		return
+	}
+
+	seen := make(map[string]bool)
+	previous := int64(-1)
+	for i := 0; i < 10_000; i++ {
+		id, idErr := snowflake.Next()
+		if idErr != nil {
+			t.Errorf("snowflake.Next() returned err %v", idErr)
+			return
+		}
+		if seen[id.String()] {
+			t.Errorf("snowflake.Next() returned duplicate identifier %v", id.String())
+			return
+		}
+		seen[id.String()] = true
+
+		value, decodeErr := Decode64Base36(id.Fragment.String())
+		if decodeErr != nil {
+			t.Errorf("Decode64Base36(%v) returned err %v", id.Fragment.String(), decodeErr)
+			return
+		}
+		if value <= previous {
+			t.Errorf("expected ascending fragments ; got %d after %d", value, previous)
+			return
+		}
+		previous = value
+
+		parts, partsErr := ParseSnowflake(id)
+		if partsErr != nil {
+			t.Errorf("ParseSnowflake(%v) returned err %v", id.String(), partsErr)
+			return
+		}
+		if parts.Node != 42 {
+			t.Errorf("expected node 42 ; got %d", parts.Node)
+			return
+		}
+	}
+
+	_, rangeErr := NewSnowflake(MaxSnowflakeNode + 1)
+	if !errors.Is(rangeErr, ErrSnowflakeNodeRange) {
+		t.Errorf("expected ErrSnowflakeNodeRange ; got %v", rangeErr)
+	}
+}
+
+func TestValet_SnowflakeID(t *testing.T) {
+	db, err := os.MkdirTemp("", "snowflake.db")
+	if err != nil {
+		t.Errorf("os.MkdirTemp() received err %v", err)
+		return
+	}
+	defer func(path string) {
+		err := os.RemoveAll(path)
+		if err != nil {
+			log.Printf("os.RemoveAll(%v) returned err %v", path, err)
+		}
+	}(db)
+
+	valet := NewValet(db)
+	valet.SafetyCheck()
+
+	_, expectErr := valet.SnowflakeID(db)
+	if !errors.Is(expectErr, ErrSnowflakeNotInUse) {
+		t.Errorf("expected ErrSnowflakeNotInUse ; got %v", expectErr)
+		return
+	}
+
+	err = valet.UseSnowflake(db, 7, "reader-a")
+	if err != nil {
+		t.Errorf("valet.UseSnowflake(db, 7, reader-a) returned err %v", err)
+		return
+	}
+
+	err = valet.UseSnowflake(db, 7, "reader-a")
+	if err != nil {
+		t.Errorf("expected re-registering node 7 for the same owner to succeed ; got %v", err)
+		return
+	}
+
+	err = RegisterSnowflakeNode(db, 7, "reader-b")
+	if !errors.Is(err, ErrSnowflakeNodeTaken) {
+		t.Errorf("expected ErrSnowflakeNodeTaken ; got %v", err)
+		return
+	}
+
+	id, idErr := valet.SnowflakeID(db)
+	if idErr != nil {
+		t.Errorf("valet.SnowflakeID(db) returned err %v", idErr)
+		return
+	}
+
+	identifierBytes, readErr := os.ReadFile(filepath.Join(db, IdentifierPath(id.String()), ".identifier"))
+	if readErr != nil {
+		t.Errorf("os.ReadFile(.identifier) returned err %v", readErr)
+		return
+	}
+	if string(identifierBytes) != id.String() {
+		t.Errorf("expected .identifier to contain %v ; got %v", id.String(), string(identifierBytes))
+	}
+
+	nodes, nodesErr := SnowflakeNodes(db)
+	if nodesErr != nil {
+		t.Errorf("SnowflakeNodes(db) returned err %v", nodesErr)
+		return
+	}
+	if len(nodes) != 1 || nodes[0].Owner != "reader-a" {
+		t.Errorf("expected a single node owned by reader-a ; got %v", nodes)
+	}
+}
+
+func TestValet_UseSnowflake_Live(t *testing.T) {
+	db, err := os.MkdirTemp("", "snowflake.db")
+	if err != nil {
+		t.Errorf("os.MkdirTemp() received err %v", err)
+		return
+	}
+	defer func(path string) {
+		err := os.RemoveAll(path)
+		if err != nil {
+			log.Printf("os.RemoveAll(%v) returned err %v", path, err)
+		}
+	}(db)
+
+	first, second := NewValet(db), NewValet(db)
+	err = first.UseSnowflake(db, 7, "")
+	if err != nil {
+		t.Errorf("first.UseSnowflake(db, 7, \"\") returned err %v", err)
+		return
+	}
+	err = second.UseSnowflake(db, 7, "")
+	if !errors.Is(err, ErrSnowflakeNodeTaken) {
+		t.Errorf("expected a node live in another valet of the same host to be refused ; got %v", err)
+		return
+	}
+	err = first.UseSnowflake(db, 8, "reader-a")
+	if err != nil {
+		t.Errorf("first.UseSnowflake(db, 8, reader-a) returned err %v", err)
+		return
+	}
+	err = second.UseSnowflake(db, 8, "reader-a")
+	if !errors.Is(err, ErrSnowflakeNodeTaken) {
+		t.Errorf("expected a live node to be refused to the same owner in another valet ; got %v", err)
+		return
+	}
+
+	// node 7 was released when the first valet moved to node 8 ; its ephemeral owner can be taken over
+	err = second.UseSnowflake(db, 7, "")
+	if err != nil {
+		t.Errorf("expected the released node 7 to be taken over ; got %v", err)
+		return
+	}
+	err = first.ReleaseSnowflake(db)
+	if err != nil {
+		t.Errorf("first.ReleaseSnowflake(db) returned err %v", err)
+		return
+	}
+	if _, idErr := first.SnowflakeID(db); !errors.Is(idErr, ErrSnowflakeNotInUse) {
+		t.Errorf("expected ErrSnowflakeNotInUse after ReleaseSnowflake ; got %v", idErr)
+		return
+	}
+	err = NewValet(db).UseSnowflake(db, 8, "reader-a")
+	if err != nil {
+		t.Errorf("expected the released node 8 to be usable by its owner ; got %v", err)
+		return
+	}
+
+	nodes, nodesErr := SnowflakeNodes(db)
+	if nodesErr != nil || len(nodes) != 2 {
+		t.Errorf("expected nodes 7 and 8 without their leases and marks ; got %v and err %v", nodes, nodesErr)
+	}
+}
+
+func TestValet_UseSnowflake_HighWaterMark(t *testing.T) {
+	db, err := os.MkdirTemp("", "snowflake.db")
+	if err != nil {
+		t.Errorf("os.MkdirTemp() received err %v", err)
+		return
+	}
+	defer func(path string) {
+		err := os.RemoveAll(path)
+		if err != nil {
+			log.Printf("os.RemoveAll(%v) returned err %v", path, err)
+		}
+	}(db)
+
+	valet := NewValet(db)
+	err = valet.UseSnowflake(db, 3, "reader-a")
+	if err != nil {
+		t.Errorf("valet.UseSnowflake(db, 3, reader-a) returned err %v", err)
+		return
+	}
+	id, idErr := valet.SnowflakeID(db)
+	if idErr != nil {
+		t.Errorf("valet.SnowflakeID(db) returned err %v", idErr)
+		return
+	}
+	parts, _ := ParseSnowflake(id)
+	markPath := filepath.Join(db, ".nodes", "3.last")
+	markBytes, readErr := os.ReadFile(markPath)
+	mark, _ := strconv.ParseInt(string(markBytes), 10, 64)
+	if readErr != nil || SnowflakeEpoch.Add(time.Duration(mark)*time.Millisecond).Before(parts.Time) {
+		t.Errorf("expected the high-water mark to be at or after %v ; got %v and err %v", parts.Time, string(markBytes), readErr)
+		return
+	}
+	_ = valet.ReleaseSnowflake(db)
+
+	// a restart after the clock moved an hour backwards
+	ahead := time.Now().UTC().Add(time.Hour)
+	_ = os.WriteFile(markPath, []byte(strconv.FormatInt(ahead.Sub(SnowflakeEpoch).Milliseconds(), 10)), 0600)
+	restarted := NewValet(db)
+	err = restarted.UseSnowflake(db, 3, "reader-a")
+	if err != nil {
+		t.Errorf("restarted.UseSnowflake(db, 3, reader-a) returned err %v", err)
+		return
+	}
+	id, idErr = restarted.SnowflakeID(db)
+	if idErr != nil {
+		t.Errorf("restarted.SnowflakeID(db) returned err %v", idErr)
+		return
+	}
+	parts, _ = ParseSnowflake(id)
+	if parts.Time.Before(ahead.Truncate(time.Millisecond)) {
+		t.Errorf("expected the identifier to be issued after the high-water mark %v ; got %v", ahead, parts.Time)
+	}
+}
+
+func TestValet_SnowflakeID_Concurrent(t *testing.T) {
+	db, err := os.MkdirTemp("", "snowflake.db")
+	if err != nil {
+		t.Errorf("os.MkdirTemp() received err %v", err)
+		return
+	}
+	defer func(path string) {
+		err := os.RemoveAll(path)
+		if err != nil {
+			log.Printf("os.RemoveAll(%v) returned err %v", path, err)
+		}
+	}(db)
+
+	valet := NewValet(db)
+	valet.SafetyCheck()
+
+	errs := make(chan error, 64)
+	wg := sync.WaitGroup{}
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 25; j++ {
+				_, idErr := valet.SnowflakeID(db)
+				if idErr != nil && !errors.Is(idErr, ErrSnowflakeNotInUse) {
+					errs <- idErr
+					return
+				}
+			}
+		}()
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for j := 0; j < 25; j++ {
+			useErr := valet.UseSnowflake(db, int64(j%2), "reader-a")
+			if useErr != nil {
+				errs <- useErr
+				return
+			}
+			releaseErr := valet.ReleaseSnowflake(db)
+			if releaseErr != nil && !errors.Is(releaseErr, ErrSnowflakeNotInUse) {
+				errs <- releaseErr
+				return
+			}
+		}
+	}()
+	wg.Wait()
+	close(errs)
+
+	for e := range errs {
+		t.Errorf("expected concurrent use, release and generation to succeed ; got %v", e)
+	}
+}
@@ -0,0 +1,171 @@
+package go_apario_identifier
+
+import (
+	`context`
+	`errors`
+	`io/fs`
+	`os`
+	`path/filepath`
+	`sort`
+	`strings`
+	`time`
+)
+
+// DefaultStatsLargest is how many of the largest directories Stats reports
+const DefaultStatsLargest = 10
+
+// DirectoryStats is the size of the files held directly by one directory of a database
+type DirectoryStats struct {
+	Path       string `json:"path"`
+	Identifier string `json:"identifier,omitempty"` // set when the directory belongs to an identifier
+	Files      int    `json:"files"`
+	Bytes      int64  `json:"bytes"`
+}
+
+// DatabaseStats describes the contents of one database ; it is meant to be written out as JSON
+type DatabaseStats struct {
+	Database    string           `json:"database"`
+	Computed    time.Time        `json:"computed"`
+	Identifiers int              `json:"identifiers"`
+	Directories int              `json:"directories"`  // shard directories, without those starting with a dot
+	Files       int              `json:"files"`        // every file, including indexes and transactions
+	Bytes       int64            `json:"bytes"`        // size of every file, including indexes and transactions
+	Years       map[int16]int    `json:"years"`        // identifiers per year
+	ShardDepths map[int]int      `json:"shard_depths"` // identifiers per number of directories below the database
+	Largest     []DirectoryStats `json:"largest"`      // shard directories holding the most bytes, largest first
+}
+
+// ValetStats describes every database tracked by a Valet
+type ValetStats struct {
+	Identifiers int                       `json:"identifiers"`
+	Bytes       int64                     `json:"bytes"`
+	Databases   map[string]*DatabaseStats `json:"databases"`
+}
+
+// stats holds the state of one run of Stats
+type stats struct {
+	ctx   context.Context
+	root  string
+	stats *DatabaseStats
+}
+
+// Stats walks the database and counts its identifiers per year and per shard depth, its disk usage and its largest
+// directories. Directories starting with a dot (transactions, indexes, tombstones) count towards the disk usage only.
+func (c *Cache) Stats(ctx context.Context) (*DatabaseStats, error) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	s := &stats{
+		ctx:  ctx,
+		root: filepath.Clean(c.Path),
+		stats: &DatabaseStats{
+			Database:    c.Path,
+			Years:       map[int16]int{},
+			ShardDepths: map[int]int{},
+			Largest:     []DirectoryStats{},
+		},
+	}
+	walkErr := s.dir(s.root, nil, false)
+	s.stats.Computed = time.Now().UTC()
+	return s.stats, walkErr
+}
+
+// dir adds the directory at path, whose path relative to the database is made of segments, and everything below it.
+// Directories inside of a dot directory only add to the disk usage.
+func (s *stats) dir(path string, segments []string, dotted bool) error {
+	ctxErr := s.ctx.Err()
+	if ctxErr != nil {
+		return ctxErr
+	}
+	entries, readDirErr := os.ReadDir(path)
+	if readDirErr != nil {
+		if errors.Is(readDirErr, fs.ErrNotExist) {
+			return nil // removed while walking
+		}
+		return readDirErr
+	}
+
+	own := DirectoryStats{Path: path}
+	isIdentifier := false
+	for _, entry := range entries {
+		if entry.IsDir() {
+			child := filepath.Join(path, entry.Name())
+			childErr := s.dir(child, append(segments[:len(segments):len(segments)], entry.Name()),
+				dotted || strings.HasPrefix(entry.Name(), "."))
+			if childErr != nil {
+				return childErr
+			}
+			continue
+		}
+		info, infoErr := entry.Info()
+		if infoErr != nil {
+			continue // removed while walking
+		}
+		own.Files++
+		own.Bytes += info.Size()
+		if entry.Name() == ".identifier" {
+			isIdentifier = true
+		}
+	}
+
+	s.stats.Files += own.Files
+	s.stats.Bytes += own.Bytes
+	if dotted || path == s.root {
+		return nil
+	}
+	s.stats.Directories++
+	if isIdentifier {
+		identifier := strings.ToUpper(strings.Join(segments, ``))
+		if validIdentifier(identifier) {
+			id, _ := ParseIdentifier(identifier)
+			own.Identifier = identifier
+			s.stats.Identifiers++
+			s.stats.Years[id.Year]++
+			s.stats.ShardDepths[len(segments)]++
+		}
+	}
+	s.largest(own)
+	return nil
+}
+
+// largest keeps dir when it is among the DefaultStatsLargest directories holding the most bytes
+func (s *stats) largest(dir DirectoryStats) {
+	largest := s.stats.Largest
+	if dir.Bytes == 0 || (len(largest) == DefaultStatsLargest && dir.Bytes <= largest[len(largest)-1].Bytes) {
+		return
+	}
+	at := sort.Search(len(largest), func(i int) bool { return largest[i].Bytes < dir.Bytes })
+	largest = append(largest, DirectoryStats{})
+	copy(largest[at+1:], largest[at:])
+	largest[at] = dir
+	if len(largest) > DefaultStatsLargest {
+		largest = largest[:DefaultStatsLargest]
+	}
+	s.stats.Largest = largest
+}
+
+// Stats computes the statistics of every database tracked by the valet ; see Cache.Stats
+func (v *Valet) Stats(ctx context.Context) (*ValetStats, error) {
+	v.SafetyCheck()
+	v.mu.RLock()
+	databases := make(map[string]*Cache, len(v.Databases))
+	for name, c := range v.Databases {
+		databases[name] = c
+	}
+	v.mu.RUnlock()
+
+	all := &ValetStats{Databases: make(map[string]*DatabaseStats, len(databases))}
+	for name, c := range databases {
+		if c == nil {
+			continue
+		}
+		databaseStats, statsErr := c.Stats(ctx)
+		if statsErr != nil {
+			return nil, statsErr
+		}
+		all.Databases[name] = databaseStats
+		all.Identifiers += databaseStats.Identifiers
+		all.Bytes += databaseStats.Bytes
+	}
+	return all, nil
+}
@@ -0,0 +1,77 @@
+package go_apario_identifier
+
+import (
+	`context`
+	`encoding/json`
+	`log`
+	`os`
+	`path/filepath`
+	`strings`
+	`testing`
+)
+
+func TestCache_Stats(t *testing.T) {
+	db, err := os.MkdirTemp("", "stats.db")
+	if err != nil {
+		t.Errorf("os.MkdirTemp() received err %v", err)
+		return
+	}
+	defer func(path string) {
+		err := os.RemoveAll(path)
+		if err != nil {
+			log.Printf("os.RemoveAll(%v) returned err %v", path, err)
+		}
+	}(db)
+
+	valet := NewValet(db)
+	ids := map[string]int{"1961ACE": 1961, "1961ACORN": 1961, "1962BEE": 1962}
+	for id, year := range ids {
+		_, claimErr := valet.ClaimID(db, year, id[4:])
+		if claimErr != nil {
+			t.Errorf("valet.ClaimID(%v) returned err %v", id, claimErr)
+			return
+		}
+	}
+	record := filepath.Join(db, IdentifierPath("1961ACORN"), "record.json")
+	_ = os.WriteFile(record, []byte(strings.Repeat("x", 4096)), 0600)
+	_ = os.MkdirAll(filepath.Join(db, ".indexes", "author"), 0700)
+	_ = os.WriteFile(filepath.Join(db, ".indexes", "author", "1961ACE"), []byte("12345"), 0600)
+
+	cache, _ := valet.GetCache(db)
+	stats, statsErr := cache.Stats(context.Background())
+	if statsErr != nil {
+		t.Errorf("cache.Stats() returned err %v", statsErr)
+		return
+	}
+	if stats.Identifiers != 3 || stats.Years[1961] != 2 || stats.Years[1962] != 1 {
+		t.Errorf("expected 2 identifiers in 1961 and 1 in 1962 ; got %+v", stats)
+		return
+	}
+	depths := map[int]int{}
+	for id := range ids {
+		depths[len(strings.Split(IdentifierPath(id), string(filepath.Separator)))]++
+	}
+	for depth, count := range depths {
+		if stats.ShardDepths[depth] != count {
+			t.Errorf("expected %d identifiers at depth %d ; got %v", count, depth, stats.ShardDepths)
+			return
+		}
+	}
+	if len(stats.Largest) == 0 || stats.Largest[0].Identifier != "1961ACORN" || stats.Largest[0].Bytes < 4096 {
+		t.Errorf("expected 1961ACORN to be the largest directory ; got %+v", stats.Largest)
+		return
+	}
+	if stats.Bytes < 4096+5 || stats.Files < 5 {
+		t.Errorf("expected the disk usage to include records and indexes ; got %d bytes in %d files", stats.Bytes, stats.Files)
+		return
+	}
+	if _, jsonErr := json.Marshal(stats); jsonErr != nil {
+		t.Errorf("json.Marshal(stats) returned err %v", jsonErr)
+		return
+	}
+
+	all, allErr := valet.Stats(context.Background())
+	if allErr != nil || all.Identifiers != 3 || all.Bytes != stats.Bytes || all.Databases[db] == nil {
+		t.Errorf("expected the valet to report the database ; got %+v and err %v", all, allErr)
+	}
+}
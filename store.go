@@ -0,0 +1,239 @@
+package go_apario_identifier
+
+import (
+	`context`
+	`errors`
+	`fmt`
+	`io/fs`
+	`os`
+	`path/filepath`
+	`reflect`
+	`strings`
+)
+
+// DefaultRecordFile is the file inside of each identifier that a Store keeps its record in
+const DefaultRecordFile = "record.json"
+
+var (
+	ErrRecordNotFound    Err = errors.New("record not found")
+	ErrInvalidIdentifier Err = errors.New("invalid identifier")
+)
+
+// StoreOptions configures a Store
+type StoreOptions struct {
+	File        string            `json:"file"`        // record file inside of each identifier ; defaults to DefaultRecordFile
+	Identifier  IdentifierOptions `json:"identifier"`  // how Create generates identifiers
+	Codec       Codec             `json:"-"`           // how records are encoded ; defaults to the Cache's Codec
+	Compression Compression       `json:"-"`           // how records are compressed ; defaults to the Cache's Compression
+	Type        string            `json:"type"`        // record type written into each header ; defaults to the name of T
+	Schema      int               `json:"schema"`      // schema version records are written at and migrated up to
+	Migrations  *Migrations       `json:"-"`           // migration steps of Type ; defaults to DefaultMigrations
+	Indexes     []StoreIndex      `json:"indexes"`     // secondary indexes maintained by Put and Delete
+	FullText    *TextIndex        `json:"-"`           // full-text index maintained by Put and Delete
+	TextFields  []string          `json:"text_fields"` // exported struct fields Put adds to FullText
+}
+
+// Store reads and writes records of type T inside of a Cache's database, one record file per identifier. Reads take
+// a shared lock on the identifier and writes go through Cache.Update, so a record is never seen half written.
+type Store[T any] struct {
+	cache       *Cache
+	file        string
+	opts        IdentifierOptions
+	codec       Codec
+	compression Compression
+	recordType  string
+	schema      int
+	migrations  *Migrations
+	indexes     []StoreIndex
+	text        *TextIndex
+	textFields  []string
+}
+
+// NewStore returns a Store of T records inside of the database of c
+func NewStore[T any](c *Cache, opts StoreOptions) (*Store[T], error) {
+	if c == nil {
+		return nil, ErrNoSuchDatabase
+	}
+	if len(opts.File) == 0 {
+		opts.File = DefaultRecordFile
+	}
+	nameErr := validTxFileName(opts.File)
+	if nameErr != nil {
+		return nil, nameErr
+	}
+	if opts.Codec == nil {
+		opts.Codec = c.Codec
+	}
+	if opts.Compression == nil {
+		opts.Compression = c.Compression
+	}
+	if len(opts.Type) == 0 {
+		opts.Type = reflect.TypeOf((*T)(nil)).Elem().String()
+	}
+	typeErr := validRecordType(opts.Type)
+	if typeErr != nil {
+		return nil, typeErr
+	}
+	if opts.Schema < 0 {
+		return nil, fmt.Errorf("NewStore(%v) requires a schema of at least 0", opts.Type)
+	}
+	if opts.Migrations == nil {
+		opts.Migrations = DefaultMigrations
+	}
+	names := map[string]bool{}
+	for _, idx := range opts.Indexes {
+		nameErr := validIndexName(idx.Name)
+		if nameErr != nil {
+			return nil, nameErr
+		}
+		if names[idx.Name] || (len(idx.Field) == 0 && idx.Keys == nil) {
+			return nil, fmt.Errorf("%w: %q is declared twice or indexes nothing", ErrIndexName, idx.Name)
+		}
+		names[idx.Name] = true
+	}
+	c.SafetyCheck()
+	return &Store[T]{
+		cache:       c,
+		file:        opts.File,
+		opts:        opts.Identifier,
+		codec:       opts.Codec,
+		compression: opts.Compression,
+		recordType:  opts.Type,
+		schema:      opts.Schema,
+		migrations:  opts.Migrations,
+		indexes:     opts.Indexes,
+		text:        opts.FullText,
+		textFields:  opts.TextFields,
+	}, nil
+}
+
+// storeIdentifier parses identifier, or returns an error matching ErrInvalidIdentifier when it is not a year followed
+// by a fragment of the IdentifierCharset
+func storeIdentifier(identifier string) (*Identifier, error) {
+	upper := strings.ToUpper(identifier)
+	if !validIdentifier(upper) {
+		return nil, fmt.Errorf("%w: %q", ErrInvalidIdentifier, identifier)
+	}
+	for _, r := range upper[4:] {
+		if !strings.ContainsRune(IdentifierCharset, r) {
+			return nil, fmt.Errorf("%w: %q", ErrInvalidIdentifier, identifier)
+		}
+	}
+	return ParseIdentifier(upper)
+}
+
+// existing parses identifier and returns an error matching ErrRecordNotFound when its directory does not exist, so
+// that reading a missing record does not create the directories that locking it would
+func (s *Store[T]) existing(identifier string) (string, error) {
+	id, idErr := storeIdentifier(identifier)
+	if idErr != nil {
+		return ``, idErr
+	}
+	if !pathExists(filepath.Join(s.cache.Path, IdentifierPath(id.String()))) {
+		return ``, fmt.Errorf("%w: %v", ErrRecordNotFound, id.String())
+	}
+	return id.String(), nil
+}
+
+// Get reads the record of identifier, or returns an error matching ErrRecordNotFound when it has none. Records written
+// at an older schema version are migrated as they are read ; the file is left as it is until it is written again.
+func (s *Store[T]) Get(ctx context.Context, identifier string) (T, error) {
+	var record T
+	identifier, idErr := s.existing(identifier)
+	if idErr != nil {
+		return record, idErr
+	}
+	recoverErr := s.cache.recoverPending(ctx, identifier)
+	if recoverErr != nil {
+		return record, recoverErr
+	}
+	lockErr := s.cache.RLockIdentifierContext(ctx, identifier)
+	if lockErr != nil {
+		return record, lockErr
+	}
+	defer s.cache.RUnlockIdentifier(identifier)
+
+	recordBytes, readErr := os.ReadFile(filepath.Join(s.cache.Path, IdentifierPath(identifier), s.file))
+	if readErr != nil {
+		if errors.Is(readErr, fs.ErrNotExist) {
+			return record, fmt.Errorf("%w: %v", ErrRecordNotFound, identifier)
+		}
+		return record, readErr
+	}
+	record, _, decodeErr := s.decode(recordBytes)
+	if decodeErr != nil {
+		return record, fmt.Errorf("s.Get(%v) failed to decode %v: %w", identifier, s.file, decodeErr)
+	}
+	return record, nil
+}
+
+// Put writes record as the record of identifier, replacing the one it had. Identifiers that are not claimed yet are
+// claimed first, and identifiers that were deleted and left a tombstone behind are refused with an
+// *IdentifierTakenError. An error matching ErrAfterCommit means the record was written but its old index entries could
+// not all be removed ; Lookup skips them and Rebuild removes them.
+func (s *Store[T]) Put(ctx context.Context, identifier string, record T) error {
+	id, idErr := storeIdentifier(identifier)
+	if idErr != nil {
+		return idErr
+	}
+	identifier = id.String()
+	claimErr := s.cache.claimIdentifier(id)
+	var taken *IdentifierTakenError
+	if claimErr != nil && (!errors.As(claimErr, &taken) || taken.Tombstoned) {
+		return claimErr // claimed already is fine, deleted is not
+	}
+	recordBytes, encodeErr := encodeRecord(record, s.codec, s.compression, s.recordType, s.schema)
+	if encodeErr != nil {
+		return encodeErr
+	}
+	return s.cache.Update(ctx, identifier, func(tx *Tx) error {
+		indexErr := s.indexUpdate(tx, &record)
+		if indexErr != nil {
+			return indexErr
+		}
+		s.textUpdate(ctx, tx, &record)
+		return tx.Write(s.file, recordBytes)
+	})
+}
+
+// Create claims a new identifier with the Store's IdentifierOptions, whose zero values default to those of the
+// database's manifest, and writes record as its record
+func (s *Store[T]) Create(ctx context.Context, record T) (*Identifier, error) {
+	m, manifestErr := s.cache.loadManifest()
+	if manifestErr != nil {
+		return nil, manifestErr
+	}
+	identifier, idErr := NewIdentifierContext(ctx, s.cache.Path, m.identifierOptions(s.opts))
+	if idErr != nil {
+		return nil, idErr
+	}
+	putErr := s.Put(ctx, identifier.String(), record)
+	if putErr != nil {
+		return nil, putErr
+	}
+	return identifier, nil
+}
+
+// Delete removes the record of identifier. The identifier itself stays claimed ; use Cache.DeleteIdentifier to delete
+// it along with every other file it holds. As with Put, an error matching ErrAfterCommit means the record was deleted.
+func (s *Store[T]) Delete(ctx context.Context, identifier string) error {
+	identifier, idErr := s.existing(identifier)
+	if idErr != nil {
+		return idErr
+	}
+	return s.cache.Update(ctx, identifier, func(tx *Tx) error {
+		_, readErr := tx.Read(s.file)
+		if readErr != nil {
+			if errors.Is(readErr, fs.ErrNotExist) {
+				return fmt.Errorf("%w: %v", ErrRecordNotFound, identifier)
+			}
+			return readErr
+		}
+		indexErr := s.indexUpdate(tx, nil)
+		if indexErr != nil {
+			return indexErr
+		}
+		s.textUpdate(ctx, tx, nil)
+		return tx.Delete(s.file)
+	})
+}
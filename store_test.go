@@ -0,0 +1,129 @@
+package go_apario_identifier
+
+import (
+	`context`
+	`errors`
+	`log`
+	`os`
+	`path/filepath`
+	`strings`
+	`testing`
+)
+
+type storeTestDocument struct {
+	Title string `json:"title"`
+	Pages int    `json:"pages"`
+}
+
+func TestStore(t *testing.T) {
+	db, err := os.MkdirTemp("", "store.db")
+	if err != nil {
+		t.Errorf("os.MkdirTemp() received err %v", err)
+		return
+	}
+	defer func(path string) {
+		err := os.RemoveAll(path)
+		if err != nil {
+			log.Printf("os.RemoveAll(%v) returned err %v", path, err)
+		}
+	}(db)
+
+	cache, _ := NewValet(db).GetCache(db)
+	documents, storeErr := NewStore[storeTestDocument](cache, StoreOptions{File: "document.json"})
+	if storeErr != nil {
+		t.Errorf("NewStore() returned err %v", storeErr)
+		return
+	}
+	ctx := context.Background()
+
+	id, createErr := documents.Create(ctx, storeTestDocument{Title: "Annual Report", Pages: 12})
+	if createErr != nil {
+		t.Errorf("documents.Create() returned err %v", createErr)
+		return
+	}
+	document, getErr := documents.Get(ctx, id.String())
+	if getErr != nil || document.Title != "Annual Report" || document.Pages != 12 {
+		t.Errorf("expected the created document ; got %+v and err %v", document, getErr)
+		return
+	}
+
+	document.Pages = 13
+	err = documents.Put(ctx, id.String(), document)
+	if err != nil {
+		t.Errorf("documents.Put() returned err %v", err)
+		return
+	}
+	document, getErr = documents.Get(ctx, id.String())
+	if getErr != nil || document.Pages != 13 {
+		t.Errorf("expected the updated document ; got %+v and err %v", document, getErr)
+		return
+	}
+
+	err = documents.Delete(ctx, id.String())
+	if err != nil {
+		t.Errorf("documents.Delete() returned err %v", err)
+		return
+	}
+	if _, getErr = documents.Get(ctx, id.String()); !errors.Is(getErr, ErrRecordNotFound) {
+		t.Errorf("expected ErrRecordNotFound after Delete ; got %v", getErr)
+		return
+	}
+	if err = documents.Delete(ctx, id.String()); !errors.Is(err, ErrRecordNotFound) {
+		t.Errorf("expected ErrRecordNotFound when deleting twice ; got %v", err)
+		return
+	}
+
+	err = cache.DeleteIdentifier(id.String())
+	if err != nil {
+		t.Errorf("cache.DeleteIdentifier() returned err %v", err)
+		return
+	}
+	if err = documents.Put(ctx, id.String(), document); !errors.Is(err, ErrIdentifierTaken) {
+		t.Errorf("expected ErrIdentifierTaken for a tombstoned identifier ; got %v", err)
+		return
+	}
+
+	for _, invalid := range []string{"ab", "2024", "2024../X", "YEARABC"} {
+		if err = documents.Put(ctx, invalid, document); !errors.Is(err, ErrInvalidIdentifier) {
+			t.Errorf("expected ErrInvalidIdentifier for %q ; got %v", invalid, err)
+			return
+		}
+	}
+	if cache.PathExists(filepath.Join(db, "AB")) {
+		t.Errorf("expected an invalid identifier to leave nothing behind")
+		return
+	}
+
+	// reading a missing identifier does not create its directories
+	if _, getErr = documents.Get(ctx, "2024NOPE99"); !errors.Is(getErr, ErrRecordNotFound) {
+		t.Errorf("expected ErrRecordNotFound for a missing identifier ; got %v", getErr)
+		return
+	}
+	if err = documents.Delete(ctx, "2024NOPE99"); !errors.Is(err, ErrRecordNotFound) {
+		t.Errorf("expected ErrRecordNotFound when deleting a missing identifier ; got %v", err)
+		return
+	}
+	if cache.PathExists(filepath.Join(db, "2024")) {
+		t.Errorf("expected reading a missing identifier to leave no directories behind")
+		return
+	}
+
+	// writing an identifier that was never claimed claims it
+	err = documents.Put(ctx, "2024vanity", document)
+	if err != nil {
+		t.Errorf("documents.Put(2024VANITY) returned err %v", err)
+		return
+	}
+	idBytes, _ := os.ReadFile(filepath.Join(db, IdentifierPath("2024VANITY"), ".identifier"))
+	if string(idBytes) != "2024VANITY" {
+		t.Errorf("expected Put to claim 2024VANITY ; got .identifier %q", idBytes)
+		return
+	}
+	report, _ := cache.Fsck(ctx, FsckOptions{})
+	for _, issue := range report.Issues {
+		if strings.HasPrefix(issue.Path, filepath.Join(db, "2024")) {
+			t.Errorf("expected no issues with the identifiers of 2024 ; got %+v", issue)
+			return
+		}
+	}
+}
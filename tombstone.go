@@ -0,0 +1,163 @@
+package go_apario_identifier
+
+import (
+	`errors`
+	`fmt`
+	`os`
+	`path/filepath`
+	`strconv`
+	`strings`
+	`time`
+)
+
+// tombstonesDirectory is the directory inside of a database that holds one marker file per deleted identifier
+const tombstonesDirectory = ".tombstones"
+
+// Tombstone records when an identifier was deleted; a tombstoned identifier is never issued again
+type Tombstone struct {
+	Identifier string    `json:"identifier"`
+	DeletedAt  time.Time `json:"deleted_at"`
+}
+
+func (c *Cache) tombstonePath(identifier string) string {
+	return filepath.Join(c.Path, tombstonesDirectory, strings.ToUpper(identifier))
+}
+
+// IsTombstoned returns true when identifier was deleted from the Cache's database
+func (c *Cache) IsTombstoned(identifier string) bool {
+	return c.PathExists(c.tombstonePath(identifier))
+}
+
+// Tombstone reads the tombstone of identifier
+func (c *Cache) Tombstone(identifier string) (*Tombstone, error) {
+	path := c.tombstonePath(identifier)
+	tombstoneBytes, readErr := os.ReadFile(path)
+	if readErr != nil {
+		return nil, readErr
+	}
+	deletedAt, parseErr := strconv.ParseInt(strings.TrimSpace(string(tombstoneBytes)), 10, 64)
+	if parseErr != nil {
+		info, statErr := os.Stat(path)
+		if statErr != nil {
+			return nil, errors.Join(parseErr, statErr)
+		}
+		return &Tombstone{Identifier: strings.ToUpper(identifier), DeletedAt: info.ModTime().UTC()}, nil
+	}
+	return &Tombstone{Identifier: strings.ToUpper(identifier), DeletedAt: time.Unix(deletedAt, 0).UTC()}, nil
+}
+
+// Tombstones returns every tombstone inside of the Cache's database
+func (c *Cache) Tombstones() ([]*Tombstone, error) {
+	entries, readDirErr := os.ReadDir(filepath.Join(c.Path, tombstonesDirectory))
+	if readDirErr != nil {
+		if os.IsNotExist(readDirErr) {
+			return []*Tombstone{}, nil
+		}
+		return nil, readDirErr
+	}
+	var tombstones []*Tombstone
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		tombstone, tombstoneErr := c.Tombstone(entry.Name())
+		if tombstoneErr != nil {
+			return nil, tombstoneErr
+		}
+		tombstones = append(tombstones, tombstone)
+	}
+	return tombstones, nil
+}
+
+func (c *Cache) writeTombstone(identifier string, deletedAt time.Time) error {
+	mkdirErr := os.MkdirAll(filepath.Join(c.Path, tombstonesDirectory), 0700)
+	if mkdirErr != nil {
+		return mkdirErr
+	}
+	return c.writeFile(c.tombstonePath(identifier), []byte(fmt.Sprintf("%d", deletedAt.UTC().Unix())))
+}
+
+// DeleteIdentifier locks identifier, leaves a tombstone so that it is never issued again and then removes the files
+// inside of its directory. Directories of other identifiers nested below it are left in place, and directories that
+// are empty afterward are removed up to the root of the database. An error matching ErrIdentifierNotFound is returned
+// when identifier has no directory, so that an identifier that was never issued is not tombstoned.
+func (c *Cache) DeleteIdentifier(identifier string) error {
+	id, idErr := storeIdentifier(identifier)
+	if idErr != nil {
+		return idErr
+	}
+	identifier = id.String()
+	if !pathExists(filepath.Join(c.Path, IdentifierPath(identifier))) {
+		return fmt.Errorf("%w: %v", ErrIdentifierNotFound, identifier)
+	}
+
+	lockErr := c.LockIdentifier(identifier)
+	if lockErr != nil {
+		return lockErr
+	}
+
+	tombstoneErr := c.writeTombstone(identifier, time.Now().UTC())
+	if tombstoneErr != nil {
+		c.UnlockIdentifier(identifier)
+		return tombstoneErr
+	}
+
+	dir := filepath.Join(c.Path, IdentifierPath(identifier))
+	entries, readDirErr := os.ReadDir(dir)
+	if readDirErr != nil {
+		c.UnlockIdentifier(identifier)
+		return readDirErr
+	}
+	var rmErr error
+	for _, entry := range entries {
+		if entry.IsDir() || entry.Name() == ".locked" {
+			continue
+		}
+		rmErr = errors.Join(rmErr, os.Remove(filepath.Join(dir, entry.Name())))
+	}
+	c.UnlockIdentifier(identifier)
+	if rmErr != nil {
+		return rmErr
+	}
+
+	// remove the directories that are now empty ; os.Remove refuses to remove a directory that is not empty
+	root := filepath.Clean(c.Path)
+	for dir != root && strings.HasPrefix(dir, root) {
+		if os.Remove(dir) != nil {
+			break
+		}
+		dir = filepath.Dir(dir)
+	}
+	return nil
+}
+
+// PurgeTombstones removes the tombstones that are older than retention and returns how many were removed. A purged
+// identifier may be issued again.
+func (c *Cache) PurgeTombstones(retention time.Duration) (int, error) {
+	tombstones, tombstonesErr := c.Tombstones()
+	if tombstonesErr != nil {
+		return 0, tombstonesErr
+	}
+	purged := 0
+	cutoff := time.Now().UTC().Add(-retention)
+	for _, tombstone := range tombstones {
+		if tombstone.DeletedAt.After(cutoff) {
+			continue
+		}
+		rmErr := os.Remove(c.tombstonePath(tombstone.Identifier))
+		if rmErr != nil && !os.IsNotExist(rmErr) {
+			return purged, rmErr
+		}
+		purged++
+	}
+	return purged, nil
+}
+
+// DeleteID deletes identifier from databasePath and leaves a tombstone behind
+func (v *Valet) DeleteID(databasePath string, identifier string) error {
+	c, cErr := v.cache(databasePath)
+	if cErr != nil {
+		return cErr
+	}
+	return c.DeleteIdentifier(identifier)
+}
@@ -0,0 +1,147 @@
+package go_apario_identifier
+
+import (
+	`errors`
+	`log`
+	`os`
+	`path/filepath`
+	`testing`
+	`time`
+)
+
+func TestCache_DeleteIdentifier(t *testing.T) {
+	db, err := os.MkdirTemp("", "tombstones.db")
+	if err != nil {
+		t.Errorf("os.MkdirTemp() received err %v", err)
+		return
+	}
+	defer func(path string) {
+		err := os.RemoveAll(path)
+		if err != nil {
+			log.Printf("os.RemoveAll(%v) returned err %v", path, err)
+		}
+	}(db)
+
+	valet := NewValet(db)
+	valet.SafetyCheck()
+	cache, cacheErr := valet.GetCache(db)
+	if cacheErr != nil {
+		t.Errorf("valet.GetCache() returned err %v", cacheErr)
+		return
+	}
+
+	id, claimErr := valet.ClaimID(db, 2024, "W")
+	if claimErr != nil {
+		t.Errorf("valet.ClaimID() returned err %v", claimErr)
+		return
+	}
+	nested, nestedErr := valet.ClaimID(db, 2024, "WX")
+	if nestedErr != nil {
+		t.Errorf("valet.ClaimID() returned err %v", nestedErr)
+		return
+	}
+
+	err = valet.DeleteID(db, id.String())
+	if err != nil {
+		t.Errorf("valet.DeleteID(%v) returned err %v", id.String(), err)
+		return
+	}
+
+	if !cache.IsTombstoned(id.String()) {
+		t.Errorf("expected %v to be tombstoned", id.String())
+		return
+	}
+	if cache.PathExists(filepath.Join(db, IdentifierPath(id.String()), ".identifier")) {
+		t.Errorf("expected the .identifier of %v to be removed", id.String())
+		return
+	}
+	if !cache.PathExists(filepath.Join(db, IdentifierPath(nested.String()), ".identifier")) {
+		t.Errorf("expected the nested identifier %v to be left in place", nested.String())
+		return
+	}
+
+	_, reclaimErr := valet.ClaimID(db, 2024, "W")
+	var takenErr *IdentifierTakenError
+	if !errors.As(reclaimErr, &takenErr) || !takenErr.Tombstoned {
+		t.Errorf("expected a tombstoned *IdentifierTakenError ; got %v", reclaimErr)
+		return
+	}
+
+	purged, purgeErr := cache.PurgeTombstones(time.Hour)
+	if purgeErr != nil || purged != 0 {
+		t.Errorf("expected no tombstones to be purged within the retention window ; got %d and err %v", purged, purgeErr)
+		return
+	}
+	purged, purgeErr = cache.PurgeTombstones(-time.Second)
+	if purgeErr != nil || purged != 1 {
+		t.Errorf("expected 1 tombstone to be purged ; got %d and err %v", purged, purgeErr)
+		return
+	}
+
+	_, reclaimErr = valet.ClaimID(db, 2024, "W")
+	if reclaimErr != nil {
+		t.Errorf("expected a purged identifier to be claimable ; got %v", reclaimErr)
+	}
+}
+
+func TestCache_DeleteIdentifier_Missing(t *testing.T) {
+	db, err := os.MkdirTemp("", "tombstones.db")
+	if err != nil {
+		t.Errorf("os.MkdirTemp() received err %v", err)
+		return
+	}
+	defer func(path string) {
+		err := os.RemoveAll(path)
+		if err != nil {
+			log.Printf("os.RemoveAll(%v) returned err %v", path, err)
+		}
+	}(db)
+
+	valet := NewValet(db)
+	valet.SafetyCheck()
+	cache, cacheErr := valet.GetCache(db)
+	if cacheErr != nil {
+		t.Errorf("valet.GetCache() returned err %v", cacheErr)
+		return
+	}
+
+	err = valet.DeleteID(db, "ab")
+	if !errors.Is(err, ErrInvalidIdentifier) {
+		t.Errorf("expected ErrInvalidIdentifier ; got %v", err)
+		return
+	}
+
+	unclaimed, unclaimedErr := CodeFragment("Z").ToYearIdentifier(2024)
+	if unclaimedErr != nil {
+		t.Errorf("CodeFragment(Z).ToYearIdentifier() returned err %v", unclaimedErr)
+		return
+	}
+	err = valet.DeleteID(db, unclaimed.String())
+	if !errors.Is(err, ErrIdentifierNotFound) {
+		t.Errorf("expected ErrIdentifierNotFound ; got %v", err)
+		return
+	}
+	if cache.IsTombstoned(unclaimed.String()) {
+		t.Errorf("expected the never claimed %v not to be tombstoned", unclaimed.String())
+		return
+	}
+
+	id, claimErr := valet.ClaimID(db, 2024, "Q")
+	if claimErr != nil {
+		t.Errorf("valet.ClaimID() returned err %v", claimErr)
+		return
+	}
+	err = valet.DeleteID(db, id.String())
+	if err != nil {
+		t.Errorf("valet.DeleteID(%v) returned err %v", id.String(), err)
+		return
+	}
+	_, reclaimErr := valet.ClaimID(db, 2024, "Q")
+	if !errors.Is(reclaimErr, ErrIdentifierTaken) {
+		t.Errorf("expected ErrIdentifierTaken ; got %v", reclaimErr)
+		return
+	}
+	if cache.PathExists(filepath.Join(db, IdentifierPath(id.String()))) {
+		t.Errorf("expected claiming the deleted %v not to recreate its directory", id.String())
+	}
+}
@@ -0,0 +1,407 @@
+package go_apario_identifier
+
+import (
+	`context`
+	`encoding/json`
+	`errors`
+	`fmt`
+	`io/fs`
+	`os`
+	`path/filepath`
+	`sort`
+	`strings`
+	`sync`
+	`time`
+)
+
+const (
+	// txDirectory is the directory inside of a database where transactions stage their writes
+	txDirectory = ".tx"
+	// txCommitted is the directory inside of an identifier that holds a committed transaction until it is applied
+	txCommitted = ".txn"
+	// txJournal lists the writes and deletes of a committed transaction
+	txJournal = ".journal"
+)
+
+var (
+	ErrTxClosed    Err = errors.New("transaction is already committed or discarded")
+	ErrTxFileName  Err = errors.New("invalid transaction file name")
+	ErrAfterCommit Err = errors.New("transaction committed but a follow-up step failed")
+)
+
+// txJournalEntry is the content of a committed transaction's journal
+type txJournalEntry struct {
+	Identifier string   `json:"identifier"`
+	Writes     []string `json:"writes"`
+	Deletes    []string `json:"deletes"`
+}
+
+// Tx stages writes and deletes of the files of one identifier. Nothing is visible to readers until the function given
+// to Cache.Update returns nil ; then every change is applied, or none of them are. The changes are applied one file at
+// a time while the identifier is locked, so only readers that hold the identifier's shared lock (Store.Get or
+// RLockIdentifier) see all of them or none ; Store.Get and LoadIdentifierFileInto also finish applying a commit that a
+// crash interrupted before they read. Files read without the lock, such as with SafeLoadBytes, may be seen halfway
+// through a commit.
+type Tx struct {
+	mu         sync.Mutex
+	identifier string
+	dir        string // directory of the identifier
+	staging    string // directory the writes are staged in
+	writes     map[string]bool
+	deletes    map[string]bool
+	durability Durability
+	closed     bool
+	onCommit   []func() error // called once the changes are applied, while the identifier is still locked
+}
+
+// Identifier returns the identifier the transaction updates
+func (tx *Tx) Identifier() string {
+	return tx.identifier
+}
+
+// validTxFileName accepts plain file names inside of the identifier directory that are not used for locking or
+// bookkeeping
+func validTxFileName(name string) error {
+	switch {
+	case len(name) == 0, name == ".", name == "..", strings.ContainsAny(name, `/\`):
+		return fmt.Errorf("%w: %q", ErrTxFileName, name)
+	case name == ".locked", name == ".identifier", name == txCommitted, name == txJournal,
+		strings.HasPrefix(name, sharedLockPrefix):
+		return fmt.Errorf("%w: %q is reserved", ErrTxFileName, name)
+	}
+	return nil
+}
+
+// Read returns the contents of name as the transaction sees it: staged writes and deletes first, then the file inside
+// of the identifier directory
+func (tx *Tx) Read(name string) ([]byte, error) {
+	nameErr := validTxFileName(name)
+	if nameErr != nil {
+		return nil, nameErr
+	}
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	if tx.closed {
+		return nil, ErrTxClosed
+	}
+	if tx.deletes[name] {
+		return nil, fmt.Errorf("%v deleted in transaction: %w", name, fs.ErrNotExist)
+	}
+	if tx.writes[name] {
+		return os.ReadFile(filepath.Join(tx.staging, name))
+	}
+	return os.ReadFile(filepath.Join(tx.dir, name))
+}
+
+// Write stages bytes to be written to name
+func (tx *Tx) Write(name string, bytes []byte) error {
+	nameErr := validTxFileName(name)
+	if nameErr != nil {
+		return nameErr
+	}
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	if tx.closed {
+		return ErrTxClosed
+	}
+	writeErr := WriteFileAtomic(filepath.Join(tx.staging, name), bytes, 0600, tx.durability)
+	if writeErr != nil {
+		return writeErr
+	}
+	delete(tx.deletes, name)
+	tx.writes[name] = true
+	return nil
+}
+
+// Delete stages the removal of name
+func (tx *Tx) Delete(name string) error {
+	nameErr := validTxFileName(name)
+	if nameErr != nil {
+		return nameErr
+	}
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	if tx.closed {
+		return ErrTxClosed
+	}
+	if tx.writes[name] {
+		rmErr := os.Remove(filepath.Join(tx.staging, name))
+		if rmErr != nil && !os.IsNotExist(rmErr) {
+			return rmErr
+		}
+		delete(tx.writes, name)
+	}
+	tx.deletes[name] = true
+	return nil
+}
+
+// commit writes the journal into the staging directory and renames it into the identifier directory. The rename is the
+// point at which the transaction is committed ; applying it afterward is idempotent and is finished by recovery when
+// the process crashes halfway through.
+func (tx *Tx) commit() error {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	if tx.closed {
+		return ErrTxClosed
+	}
+	tx.closed = true
+	journal := txJournalEntry{Identifier: tx.identifier}
+	for name := range tx.writes {
+		journal.Writes = append(journal.Writes, name)
+	}
+	for name := range tx.deletes {
+		journal.Deletes = append(journal.Deletes, name)
+	}
+	if len(journal.Writes) == 0 && len(journal.Deletes) == 0 {
+		rmErr := os.RemoveAll(tx.staging)
+		if rmErr != nil {
+			return rmErr
+		}
+		return tx.committed()
+	}
+	sort.Strings(journal.Writes)
+	sort.Strings(journal.Deletes)
+	journalBytes, jsonErr := json.Marshal(journal)
+	if jsonErr != nil {
+		return errors.Join(jsonErr, os.RemoveAll(tx.staging))
+	}
+	writeErr := WriteFileAtomic(filepath.Join(tx.staging, txJournal), journalBytes, 0600, tx.durability)
+	if writeErr != nil {
+		return errors.Join(writeErr, os.RemoveAll(tx.staging))
+	}
+	committed := filepath.Join(tx.dir, txCommitted)
+	renameErr := os.Rename(tx.staging, committed)
+	if renameErr != nil {
+		return errors.Join(renameErr, os.RemoveAll(tx.staging))
+	}
+	if tx.durability == DurabilityFull {
+		syncErr := syncDir(tx.dir)
+		if syncErr != nil {
+			return syncErr
+		}
+	}
+	applyErr := applyCommitted(committed)
+	if applyErr != nil {
+		return applyErr
+	}
+	return tx.committed()
+}
+
+// afterCommit registers fn to be called once the transaction is applied. It is not called when the transaction is
+// discarded.
+func (tx *Tx) afterCommit(fn func() error) {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	tx.onCommit = append(tx.onCommit, fn)
+}
+
+// committed calls the functions registered with afterCommit. The transaction is applied already, so their errors are
+// returned wrapped in ErrAfterCommit for callers to tell them apart from a failed write. The caller must hold tx.mu.
+func (tx *Tx) committed() error {
+	var hookErr error
+	for _, fn := range tx.onCommit {
+		hookErr = errors.Join(hookErr, fn())
+	}
+	if hookErr != nil {
+		return fmt.Errorf("%w: %w", ErrAfterCommit, hookErr)
+	}
+	return nil
+}
+
+// discard removes everything the transaction staged
+func (tx *Tx) discard() error {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	if tx.closed {
+		return nil
+	}
+	tx.closed = true
+	return os.RemoveAll(tx.staging)
+}
+
+// applyCommitted moves the writes of the committed transaction at committed into place, removes its deletes and then
+// removes the transaction. Writes that were already moved before a crash are skipped.
+func applyCommitted(committed string) error {
+	journalBytes, readErr := os.ReadFile(filepath.Join(committed, txJournal))
+	if readErr != nil {
+		if os.IsNotExist(readErr) {
+			// the journal is removed last ; without it the transaction was already applied
+			return os.RemoveAll(committed)
+		}
+		return readErr
+	}
+	journal := txJournalEntry{}
+	jsonErr := json.Unmarshal(journalBytes, &journal)
+	if jsonErr != nil {
+		return fmt.Errorf("corrupt transaction journal in %v: %w", committed, jsonErr)
+	}
+	dir := filepath.Dir(committed)
+	for _, name := range journal.Writes {
+		renameErr := os.Rename(filepath.Join(committed, name), filepath.Join(dir, name))
+		if renameErr != nil && !os.IsNotExist(renameErr) {
+			return renameErr
+		}
+	}
+	for _, name := range journal.Deletes {
+		rmErr := os.Remove(filepath.Join(dir, name))
+		if rmErr != nil && !os.IsNotExist(rmErr) {
+			return rmErr
+		}
+	}
+	rmErr := os.Remove(filepath.Join(committed, txJournal))
+	if rmErr != nil && !os.IsNotExist(rmErr) {
+		return rmErr
+	}
+	return os.RemoveAll(committed)
+}
+
+// Update locks identifier and calls fn with a transaction over the files of its directory. When fn returns nil the
+// staged writes and deletes are applied all at once ; when it returns an error (or ctx is done) they are discarded and
+// the directory is left as it was. The lock is renewed in the background while fn runs. An error matching
+// ErrAfterCommit means the changes were applied and only a follow-up step failed, such as removing stale index entries ;
+// the write must not be retried as if it was lost.
+func (c *Cache) Update(ctx context.Context, identifier string, fn func(tx *Tx) error) error {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	lockErr := c.LockIdentifierContext(ctx, identifier)
+	if lockErr != nil {
+		return lockErr
+	}
+	defer c.UnlockIdentifier(identifier)
+	stop := c.Heartbeat(ctx, identifier)
+	defer stop()
+
+	dir := filepath.Join(c.Path, IdentifierPath(identifier))
+	recoverErr := c.recoverCommitted(dir)
+	if recoverErr != nil {
+		return recoverErr
+	}
+
+	mkdirErr := os.MkdirAll(filepath.Join(c.Path, txDirectory), 0700)
+	if mkdirErr != nil {
+		return mkdirErr
+	}
+	staging, tempErr := os.MkdirTemp(filepath.Join(c.Path, txDirectory), strings.ToUpper(identifier)+"-")
+	if tempErr != nil {
+		return tempErr
+	}
+	tx := &Tx{
+		identifier: strings.ToUpper(identifier),
+		dir:        dir,
+		staging:    staging,
+		writes:     make(map[string]bool),
+		deletes:    make(map[string]bool),
+		durability: c.Durability,
+	}
+
+	fnErr := fn(tx)
+	if fnErr == nil {
+		fnErr = ctx.Err()
+	}
+	if fnErr != nil {
+		return errors.Join(fnErr, tx.discard())
+	}
+	return tx.commit()
+}
+
+// recoverCommitted finishes applying a transaction that was committed inside of dir before the process crashed
+func (c *Cache) recoverCommitted(dir string) error {
+	committed := filepath.Join(dir, txCommitted)
+	if !c.PathExists(committed) {
+		return nil
+	}
+	return applyCommitted(committed)
+}
+
+// recoverPending finishes applying a transaction that was committed for identifier before the process crashed, under
+// the identifier's lock, so that a reader does not see half of it. A transaction that is being applied by a live
+// Update holds the lock, so waiting for the lock lets it finish first.
+func (c *Cache) recoverPending(ctx context.Context, identifier string) error {
+	dir := filepath.Join(c.Path, IdentifierPath(identifier))
+	if !c.PathExists(filepath.Join(dir, txCommitted)) {
+		return nil
+	}
+	lockErr := c.LockIdentifierContext(ctx, identifier)
+	if lockErr != nil {
+		return lockErr
+	}
+	defer c.UnlockIdentifier(identifier)
+	return c.recoverCommitted(dir)
+}
+
+// RecoverTransactions finishes applying every transaction that was committed before the process crashed and removes
+// staging directories that were abandoned for longer than the Cache's LockTTL. It returns the number of committed
+// transactions that were applied.
+func (c *Cache) RecoverTransactions(ctx context.Context) (int, error) {
+	recovered := 0
+	root := filepath.Clean(c.Path)
+	walkErr := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		ctxErr := ctx.Err()
+		if ctxErr != nil {
+			return ctxErr
+		}
+		if !d.IsDir() || path == root {
+			return nil
+		}
+		if d.Name() == txCommitted {
+			dir := filepath.Dir(path)
+			rel, relErr := filepath.Rel(root, dir)
+			if relErr != nil {
+				return relErr
+			}
+			identifier := strings.ReplaceAll(rel, string(os.PathSeparator), ``)
+			lockErr := c.LockIdentifierContext(ctx, identifier)
+			if lockErr != nil {
+				return lockErr
+			}
+			applyErr := c.recoverCommitted(dir)
+			c.UnlockIdentifier(identifier)
+			if applyErr != nil {
+				return applyErr
+			}
+			recovered++
+			return filepath.SkipDir
+		}
+		if strings.HasPrefix(d.Name(), ".") {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	if walkErr != nil {
+		return recovered, walkErr
+	}
+
+	entries, readDirErr := os.ReadDir(filepath.Join(root, txDirectory))
+	if readDirErr != nil {
+		if os.IsNotExist(readDirErr) {
+			return recovered, nil
+		}
+		return recovered, readDirErr
+	}
+	cutoff := time.Now().Add(-c.lockTTL())
+	var rmErr error
+	for _, entry := range entries {
+		info, infoErr := entry.Info()
+		if infoErr != nil || info.ModTime().After(cutoff) {
+			continue // possibly still in use by an Update
+		}
+		rmErr = errors.Join(rmErr, os.RemoveAll(filepath.Join(root, txDirectory, entry.Name())))
+	}
+	return recovered, rmErr
+}
+
+// Update runs fn in a transaction over the files of identifier inside databasePrefix ; see Cache.Update
+func (v *Valet) Update(ctx context.Context, databasePrefix string, identifier string, fn func(tx *Tx) error) error {
+	c, cErr := v.cache(databasePrefix)
+	if cErr != nil {
+		return cErr
+	}
+	return c.Update(ctx, identifier, fn)
+}
@@ -0,0 +1,138 @@
+package go_apario_identifier
+
+import (
+	`context`
+	`errors`
+	`log`
+	`os`
+	`path/filepath`
+	`testing`
+)
+
+func TestCache_Update(t *testing.T) {
+	db, err := os.MkdirTemp("", "transactions.db")
+	if err != nil {
+		t.Errorf("os.MkdirTemp() received err %v", err)
+		return
+	}
+	defer func(path string) {
+		err := os.RemoveAll(path)
+		if err != nil {
+			log.Printf("os.RemoveAll(%v) returned err %v", path, err)
+		}
+	}(db)
+
+	valet := NewValet(db)
+	cache, _ := valet.GetCache(db)
+	identifier := "2024RECORD"
+	dir := filepath.Join(db, IdentifierPath(identifier))
+
+	err = valet.Update(context.Background(), db, identifier, func(tx *Tx) error {
+		writeErr := tx.Write("record.json", []byte(`{"v":1}`))
+		if writeErr != nil {
+			return writeErr
+		}
+		return tx.Write("pages.json", []byte(`[1]`))
+	})
+	if err != nil {
+		t.Errorf("valet.Update() returned err %v", err)
+		return
+	}
+
+	// a failed update leaves every file as it was
+	failed := errors.New("failed halfway")
+	err = cache.Update(context.Background(), identifier, func(tx *Tx) error {
+		writeErr := tx.Write("record.json", []byte(`{"v":2}`))
+		if writeErr != nil {
+			return writeErr
+		}
+		staged, readErr := tx.Read("record.json")
+		if readErr != nil || string(staged) != `{"v":2}` {
+			t.Errorf("expected the transaction to read its own write ; got %s and err %v", staged, readErr)
+		}
+		deleteErr := tx.Delete("pages.json")
+		if deleteErr != nil {
+			return deleteErr
+		}
+		return failed
+	})
+	if !errors.Is(err, failed) {
+		t.Errorf("expected the error of fn to be returned ; got %v", err)
+		return
+	}
+	record, _ := os.ReadFile(filepath.Join(dir, "record.json"))
+	if string(record) != `{"v":1}` || !pathExists(filepath.Join(dir, "pages.json")) {
+		t.Errorf("expected the failed update to be discarded ; record.json is %s", record)
+		return
+	}
+	if err = writeReservedInTx(cache, identifier); !errors.Is(err, ErrTxFileName) {
+		t.Errorf("expected ErrTxFileName for .locked ; got %v", err)
+		return
+	}
+
+	// a transaction committed right before a crash is rolled forward
+	committed := filepath.Join(dir, txCommitted)
+	err = os.MkdirAll(committed, 0700)
+	if err != nil {
+		t.Errorf("os.MkdirAll() returned err %v", err)
+		return
+	}
+	_ = os.WriteFile(filepath.Join(committed, "record.json"), []byte(`{"v":3}`), 0600)
+	_ = os.WriteFile(filepath.Join(committed, txJournal), []byte(`{"identifier":"2024RECORD","writes":["record.json"],"deletes":["pages.json"]}`), 0600)
+	recovered, recoverErr := cache.RecoverTransactions(context.Background())
+	if recoverErr != nil || recovered != 1 {
+		t.Errorf("expected 1 transaction to be recovered ; got %d and err %v", recovered, recoverErr)
+		return
+	}
+	record, _ = os.ReadFile(filepath.Join(dir, "record.json"))
+	if string(record) != `{"v":3}` || pathExists(filepath.Join(dir, "pages.json")) || pathExists(committed) {
+		t.Errorf("expected the committed transaction to be applied ; record.json is %s", record)
+		return
+	}
+
+	// readers finish applying a crashed transaction before they read
+	_ = os.MkdirAll(committed, 0700)
+	_ = os.WriteFile(filepath.Join(committed, "record.json"), []byte(`{"v":4}`), 0600)
+	_ = os.WriteFile(filepath.Join(committed, txJournal), []byte(`{"identifier":"2024RECORD","writes":["record.json"]}`), 0600)
+	loaded := map[string]int{}
+	_, loadErr := cache.LoadIdentifierFileInto(identifier, "record.json", &loaded)
+	if loadErr != nil || loaded["v"] != 4 || pathExists(committed) {
+		t.Errorf("expected the reader to apply the committed transaction first ; got %v and err %v", loaded, loadErr)
+	}
+}
+
+func writeReservedInTx(cache *Cache, identifier string) error {
+	return cache.Update(context.Background(), identifier, func(tx *Tx) error {
+		return tx.Write(".locked", []byte("0"))
+	})
+}
+
+func TestCache_Update_AfterCommit(t *testing.T) {
+	db, err := os.MkdirTemp("", "transactions.db")
+	if err != nil {
+		t.Errorf("os.MkdirTemp() received err %v", err)
+		return
+	}
+	defer func(path string) {
+		err := os.RemoveAll(path)
+		if err != nil {
+			log.Printf("os.RemoveAll(%v) returned err %v", path, err)
+		}
+	}(db)
+
+	cache, _ := NewValet(db).GetCache(db)
+	identifier := "2024HOOKED"
+	hookErr := errors.New("index unavailable")
+	err = cache.Update(context.Background(), identifier, func(tx *Tx) error {
+		tx.afterCommit(func() error { return hookErr })
+		return tx.Write("record.json", []byte(`{"v":1}`))
+	})
+	if !errors.Is(err, ErrAfterCommit) || !errors.Is(err, hookErr) {
+		t.Errorf("expected the failed hook to be reported as ErrAfterCommit ; got %v", err)
+		return
+	}
+	record, readErr := os.ReadFile(filepath.Join(db, IdentifierPath(identifier), "record.json"))
+	if readErr != nil || string(record) != `{"v":1}` {
+		t.Errorf("expected the write to be committed despite the hook ; got %s and err %v", record, readErr)
+	}
+}
@@ -5,6 +5,7 @@ import (
 	`errors`
 	`fmt`
 	`io`
+	`io/fs`
 	`log`
 	`net/http`
 	`os`
@@ -16,6 +17,11 @@ import (
 	sema `github.com/andreimerlescu/go-sema`
 )
 
+var (
+	ErrNoSuchDatabase Err = errors.New("no such database is tracked by the valet")
+	ErrLastIDNotSaved Err = errors.New("identifier claimed but .lastid was not updated")
+)
+
 type Valet struct {
 	ctx                  context.Context
 	InitialPath          string
@@ -23,6 +29,7 @@ type Valet struct {
 	Databases            map[string]*Cache `json:"-"`
 	mu                   *sync.RWMutex
 	lim                  int
+	instance             string // tells Valets apart in the owner of snowflake nodes ; see snowflakeOwner
 }
 
 func (v *Valet) GetRemotePathFileBytes(path string, ctx context.Context, cancel context.CancelFunc) []byte {
@@ -57,9 +64,34 @@ func (v *Valet) GetRemotePathFileBytes(path string, ctx context.Context, cancel
 	return body
 }
 
+// GetCache returns the *Cache of databasePrefix, or nil when the Valet does not track it. The manifest of the database
+// is validated the first time, and an error is returned for as long as it is invalid.
 func (v *Valet) GetCache(databasePrefix string) (*Cache, error) {
 	v.SafetyCheck()
-	return v.Databases[databasePrefix], nil
+	v.mu.RLock()
+	c := v.Databases[databasePrefix]
+	v.mu.RUnlock()
+	if c == nil {
+		return nil, nil
+	}
+	_, manifestErr := c.loadManifest()
+	if manifestErr != nil {
+		return nil, manifestErr
+	}
+	return c, nil
+}
+
+// cache returns the *Cache registered for databasePath or an error when the Valet is not tracking that database
+func (v *Valet) cache(databasePath string) (*Cache, error) {
+	c, cacheErr := v.GetCache(databasePath)
+	if cacheErr != nil {
+		return nil, cacheErr
+	}
+	if c == nil {
+		return nil, ErrNoSuchDatabase
+	}
+	c.SafetyCheck()
+	return c, nil
 }
 
 func (v *Valet) SetCache(databasePrefix string, identifier string) (*Cache, error) {
@@ -78,39 +110,60 @@ func (v *Valet) SetCache(databasePrefix string, identifier string) (*Cache, erro
 	return cache, nil
 }
 
-func (v *Valet) Lock(databasePrefix string, identifier string) (err error) {
-	defer func() {
-		r := recover()
-		var wasErr bool
-		err, wasErr = r.(error)
-		if !wasErr {
-			err = fmt.Errorf("valet .Lock() received unexpected error %v", r)
-		}
-	}()
-	v.SafetyCheck()
-	c := v.Databases[databasePrefix]
-	c.SafetyCheck()
-	m, exists := c.Mutexes[identifier]
-	if !exists {
-		return errors.New("no such identifier found")
+// Lock acquires the exclusive lock on identifier inside databasePrefix, in memory and on disk ; see Cache.LockIdentifier
+func (v *Valet) Lock(databasePrefix string, identifier string) error {
+	c, cErr := v.cache(databasePrefix)
+	if cErr != nil {
+		return cErr
 	}
-	m.Lock()
-	return nil
+	return c.LockIdentifier(identifier)
+}
+
+// LockContext acquires the exclusive lock on identifier inside databasePrefix, waiting until ctx is done
+func (v *Valet) LockContext(ctx context.Context, databasePrefix string, identifier string) error {
+	c, cErr := v.cache(databasePrefix)
+	if cErr != nil {
+		return cErr
+	}
+	return c.LockIdentifierContext(ctx, identifier)
 }
 
+// TryLock makes a single attempt at the exclusive lock on identifier inside databasePrefix
+func (v *Valet) TryLock(databasePrefix string, identifier string) error {
+	c, cErr := v.cache(databasePrefix)
+	if cErr != nil {
+		return cErr
+	}
+	return c.TryLockIdentifier(identifier)
+}
+
+// Unlock releases the exclusive lock on identifier inside databasePrefix
 func (v *Valet) Unlock(databasePrefix string, identifier string) {
-	defer func() {
-		r := recover()
-		log.Printf("valet .Unlock() recovered from panic %v", r)
-	}()
-	v.SafetyCheck()
-	c := v.Databases[databasePrefix]
-	c.SafetyCheck()
-	m, exists := c.Mutexes[identifier]
-	if !exists {
+	c, cErr := v.cache(databasePrefix)
+	if cErr != nil {
+		log.Printf("valet .Unlock() received err %v", cErr)
 		return
 	}
-	m.Unlock()
+	c.UnlockIdentifier(identifier)
+}
+
+// RLock acquires a shared lock on identifier inside databasePrefix ; see Cache.RLockIdentifier
+func (v *Valet) RLock(databasePrefix string, identifier string) error {
+	c, cErr := v.cache(databasePrefix)
+	if cErr != nil {
+		return cErr
+	}
+	return c.RLockIdentifier(identifier)
+}
+
+// RUnlock releases a shared lock on identifier inside databasePrefix
+func (v *Valet) RUnlock(databasePrefix string, identifier string) {
+	c, cErr := v.cache(databasePrefix)
+	if cErr != nil {
+		log.Printf("valet .RUnlock() received err %v", cErr)
+		return
+	}
+	c.RUnlockIdentifier(identifier)
 }
 
 func (v *Valet) Acquire(databasePrefix string, identifier string) {
@@ -119,10 +172,16 @@ func (v *Valet) Acquire(databasePrefix string, identifier string) {
 		log.Printf("valet .Acquire() recovered from panic %v", r)
 	}()
 	v.SafetyCheck()
+	v.mu.RLock()
 	c := v.Databases[databasePrefix]
+	v.mu.RUnlock()
 	c.SafetyCheck()
+	c.retain(identifier) // kept until Release so that the semaphore is not evicted while it is held
+	c.muSe.RLock()
 	s, exists := c.Semaphores[identifier]
+	c.muSe.RUnlock()
 	if !exists {
+		c.release(identifier)
 		return
 	}
 	s.Acquire()
@@ -134,13 +193,18 @@ func (v *Valet) Release(databasePrefix string, identifier string) {
 		log.Printf("valet .Release() recovered from panic %v", r)
 	}()
 	v.SafetyCheck()
+	v.mu.RLock()
 	c := v.Databases[databasePrefix]
+	v.mu.RUnlock()
 	c.SafetyCheck()
+	c.muSe.RLock()
 	s, exists := c.Semaphores[identifier]
+	c.muSe.RUnlock()
 	if !exists {
 		return
 	}
 	s.Release()
+	c.release(identifier)
 }
 
 func (v *Valet) SafetyCheck() {
@@ -169,14 +233,34 @@ func (v *Valet) NewCountableDatabase(databasePath string) error {
 	firstId := int64(1)
 	lastIdPath := filepath.Join(databasePath, ".lastid")
 	idStr := fmt.Sprintf("%d", firstId)
-	writeErr := os.WriteFile(lastIdPath, []byte(idStr), 0600)
+	writeErr := WriteFileAtomic(lastIdPath, []byte(idStr), 0600, DurabilityFull)
 	if writeErr != nil {
 		return writeErr
 	}
+	m, markErr := markCountable(databasePath)
+	if markErr != nil {
+		return markErr
+	}
+	v.SafetyCheck()
+	v.mu.RLock()
+	c := v.Databases[databasePath]
+	v.mu.RUnlock()
+	if c != nil {
+		c.setManifest(m)
+	}
 	return nil
 }
 
+// IsCountableDatabase reports whether NextID counts the identifiers of databasePath. The manifest decides when the
+// database has one ; otherwise the database is countable when its .lastid can be read.
 func (v *Valet) IsCountableDatabase(databasePath string) bool {
+	c, cErr := v.GetCache(databasePath)
+	if cErr != nil || c == nil {
+		return false
+	}
+	if m, _ := c.loadManifest(); m != nil {
+		return m.Countable
+	}
 	_, lastIdErr := v.LastID(databasePath)
 	return lastIdErr == nil
 }
@@ -196,26 +280,30 @@ func (v *Valet) LastID(databasePath string) (*Identifier, error) {
 
 	lockedThenBytes, readErr := os.ReadFile(lastIdPath)
 	if readErr != nil {
-		return v.NewID(databasePath, 6)
+		return v.NewID(databasePath, 0)
 	}
 	thenStr := string(lockedThenBytes)
 	lastId, convErr := strconv.Atoi(thenStr)
 	if convErr != nil {
-		return v.NewID(databasePath, 6)
+		return v.NewID(databasePath, 0)
 	}
 
 	identifier, identifierErr := IntegerFragment(lastId).ToIdentifier()
 	if identifierErr != nil {
 		// invalid identifier generated
-		return v.NewID(databasePath, 6)
+		return v.NewID(databasePath, 0)
 	}
 
 	return identifier, nil
 }
 
+// NextID claims the identifier that follows .lastid in a countable database and records it in .lastid ; databases
+// that are not countable get a random identifier from NewID. When the identifier was claimed but .lastid could not be
+// written, the identifier is returned along with an error matching ErrLastIDNotSaved : it is yours to use, and the next
+// call skips it because it is taken.
 func (v *Valet) NextID(databasePath string) (*Identifier, error) {
 	if !v.IsCountableDatabase(databasePath) {
-		return v.NewID(databasePath, 6)
+		return v.NewID(databasePath, 0)
 	}
 
 	// assume that database is using incremental base36 for its storage needs
@@ -223,70 +311,71 @@ func (v *Valet) NextID(databasePath string) (*Identifier, error) {
 	c, cacheErr := v.GetCache(databasePath)
 	if cacheErr != nil {
 		// failed to get cache for valet database
-		return v.NewID(databasePath, 6)
-	}
-
-	if !c.PathExists(lastIdPath) {
-		return v.NewID(databasePath, 6)
+		return v.NewID(databasePath, 0)
 	}
 
 	lockedThenBytes, readErr := os.ReadFile(lastIdPath)
+	if errors.Is(readErr, fs.ErrNotExist) {
+		lockedThenBytes, readErr = []byte("1"), nil // countable according to its manifest ; start where InitDatabase does
+	}
 	if readErr != nil {
-		return v.NewID(databasePath, 6)
+		return v.NewID(databasePath, 0)
 	}
 	thenStr := string(lockedThenBytes)
 	lastId, convErr := strconv.Atoi(thenStr)
 	if convErr != nil {
-		return v.NewID(databasePath, 6)
+		return v.NewID(databasePath, 0)
 	}
 
-	nextId := lastId + 1
-	nextIdStr := fmt.Sprintf("%d", nextId)
-	writeErr := os.WriteFile(lastIdPath, []byte(nextIdStr), 0600)
-	if writeErr != nil {
-		// failed to write to the file
-		return v.NewID(databasePath, 6)
-	}
-
-	identifier, identifierErr := IntegerFragment(nextId).ToIdentifier()
-	if identifierErr != nil {
-		// invalid identifier generated
-		return v.NewID(databasePath, 6)
-	}
-
-	identifierDir := filepath.Join(c.Path, identifier.Path())
-	if !c.PathExists(identifierDir) {
-		mkdirErr := os.MkdirAll(identifierDir, 0700)
-		if mkdirErr != nil {
-			return nil, mkdirErr
+	nextId := lastId
+	for {
+		nextId++
+		identifier, identifierErr := IntegerFragment(nextId).ToIdentifier()
+		if identifierErr != nil {
+			// invalid identifier generated
+			return v.NewID(databasePath, 0)
 		}
+		claimErr := c.claimIdentifier(identifier)
+		if errors.Is(claimErr, ErrIdentifierTaken) {
+			continue // claimed with ClaimID or by another caller, or deleted ; never reissue it
+		}
+		if claimErr != nil {
+			return nil, claimErr
+		}
+		writeErr := c.writeFile(lastIdPath, []byte(fmt.Sprintf("%d", nextId)))
+		if writeErr != nil {
+			// the identifier is claimed, so the next call skips it even though .lastid is behind
+			return identifier, fmt.Errorf("%w: %w", ErrLastIDNotSaved, writeErr)
+		}
+		return identifier, nil
 	}
-
-	identifierPath := filepath.Join(identifierDir, ".identifier")
-	idPathLockErr := c.LockIdentifier(identifier.String())
-	defer c.UnlockIdentifier(identifier.String())
-	if idPathLockErr != nil {
-		return v.NewID(databasePath, 6)
-	}
-	writeErr = os.WriteFile(identifierPath, []byte(identifier.String()), 0600)
-	if writeErr != nil {
-		return v.NewID(databasePath, 6)
-	}
-
-	return identifier, nil
 }
 
+// NewID claims a random identifier of length characters inside databasePath. The IdentifierOptions of the database's
+// manifest provide the length when it is 0, along with the attempts and the year ; without them, 6 characters are used.
 func (v *Valet) NewID(databasePath string, length int) (*Identifier, error) {
-	c, cErr := v.GetCache(databasePath)
+	c, cErr := v.cache(databasePath)
 	if cErr != nil {
 		return nil, cErr
 	}
-	id, idErr := NewIdentifier(databasePath, length, 17, 30)
+	manifest, _ := c.loadManifest() // v.cache validated it
+	opts := manifest.identifierOptions(IdentifierOptions{Length: length})
+	if opts.Length == 0 {
+		opts.Length = 6
+	}
+	if opts.MaxAttempts == 0 {
+		opts.MaxAttempts = 17
+	}
+	ctx, cancel := context.WithTimeout(c.ctx, 30*time.Second)
+	defer cancel()
+	id, idErr := NewIdentifierContext(ctx, databasePath, opts)
 	if idErr != nil {
 		return nil, idErr
 	}
-	s := c.Semaphore(id.String())
-	m := c.Mutex(id.String())
+	c.retain(id.String())
+	defer c.release(id.String())
+	s := c.identifierSemaphore(id.String())
+	m := c.identifierMutex(id.String())
 
 	// perform a flush on the semaphore and mutex wrapped with the semaphore first
 	s.Acquire()
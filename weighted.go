@@ -0,0 +1,281 @@
+package go_apario_identifier
+
+import (
+	`container/list`
+	`context`
+	`errors`
+	`sync`
+
+	sema `github.com/andreimerlescu/go-sema`
+)
+
+var (
+	ErrSemaphoreWeight      Err = errors.New("semaphore weight must be at least 1")
+	ErrSemaphoreLimit       Err = errors.New("semaphore limit must be at least 1")
+	ErrSemaphoreNotWeighted Err = errors.New("identifier semaphore is not a *WeightedSemaphore")
+)
+
+// SemaphoreStats describes who is holding and waiting on a WeightedSemaphore
+type SemaphoreStats struct {
+	Limit         int64 `json:"limit"`
+	Used          int64 `json:"used"`
+	Holders       int   `json:"holders"`
+	Waiters       int   `json:"waiters"`
+	WaitingWeight int64 `json:"waiting_weight"`
+}
+
+type semaphoreWaiter struct {
+	weight int64
+	ready  chan struct{}
+}
+
+// WeightedSemaphore limits the total weight held at once, such as the concurrency limit an identifier's .sema file
+// sets. Waiters are served in the order they arrived so that a heavy acquisition is not starved by lighter ones, and
+// the limit can be changed while the semaphore is in use. It satisfies sema.Semaphore, where Acquire and Release have
+// a weight of 1.
+type WeightedSemaphore struct {
+	mu      sync.Mutex
+	limit   int64
+	used    int64
+	holders int
+	waiters list.List
+}
+
+var _ sema.Semaphore = (*WeightedSemaphore)(nil)
+
+// NewWeightedSemaphore returns a WeightedSemaphore that allows limit weight to be held at once
+func NewWeightedSemaphore(limit int64) *WeightedSemaphore {
+	if limit < 1 {
+		limit = 1
+	}
+	return &WeightedSemaphore{limit: limit}
+}
+
+// AcquireContext waits until weight is available or ctx is done
+func (s *WeightedSemaphore) AcquireContext(ctx context.Context, weight int64) error {
+	if weight < 1 {
+		return ErrSemaphoreWeight
+	}
+	s.mu.Lock()
+	if s.waiters.Len() == 0 && s.used+weight <= s.limit {
+		s.used += weight
+		s.holders++
+		s.mu.Unlock()
+		return nil
+	}
+	w := &semaphoreWaiter{weight: weight, ready: make(chan struct{})}
+	element := s.waiters.PushBack(w)
+	s.mu.Unlock()
+
+	select {
+	case <-w.ready:
+		return nil
+	case <-ctx.Done():
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	select {
+	case <-w.ready:
+		// acquired while ctx was being canceled ; give it back
+		s.used -= weight
+		s.holders--
+	default:
+		s.waiters.Remove(element)
+	}
+	s.notify()
+	return ctx.Err()
+}
+
+// TryAcquire acquires weight only when it is available right away
+func (s *WeightedSemaphore) TryAcquire(weight int64) bool {
+	if weight < 1 {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.waiters.Len() > 0 || s.used+weight > s.limit {
+		return false
+	}
+	s.used += weight
+	s.holders++
+	return true
+}
+
+// ReleaseWeight gives back weight that was acquired with AcquireContext or TryAcquire
+func (s *WeightedSemaphore) ReleaseWeight(weight int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.used -= weight
+	s.holders--
+	if s.used < 0 || s.holders < 0 {
+		s.used, s.holders = 0, 0
+	}
+	s.notify()
+}
+
+// SetLimit changes how much weight may be held at once. Lowering the limit does not take weight away from holders ;
+// new acquisitions wait until enough of it has been released.
+func (s *WeightedSemaphore) SetLimit(limit int64) {
+	if limit < 1 {
+		limit = 1
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.limit = limit
+	s.notify()
+}
+
+// Limit returns how much weight may be held at once
+func (s *WeightedSemaphore) Limit() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.limit
+}
+
+// Stats returns the current holders and waiters of the semaphore
+func (s *WeightedSemaphore) Stats() SemaphoreStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stats := SemaphoreStats{
+		Limit:   s.limit,
+		Used:    s.used,
+		Holders: s.holders,
+		Waiters: s.waiters.Len(),
+	}
+	for element := s.waiters.Front(); element != nil; element = element.Next() {
+		stats.WaitingWeight += element.Value.(*semaphoreWaiter).weight
+	}
+	return stats
+}
+
+// notify hands weight to waiters in arrival order while it is available. The caller must hold s.mu.
+func (s *WeightedSemaphore) notify() {
+	for {
+		element := s.waiters.Front()
+		if element == nil {
+			return
+		}
+		w := element.Value.(*semaphoreWaiter)
+		if s.used+w.weight > s.limit {
+			return
+		}
+		s.used += w.weight
+		s.holders++
+		s.waiters.Remove(element)
+		close(w.ready)
+	}
+}
+
+// Acquire acquires a weight of 1 and satisfies sema.Semaphore
+func (s *WeightedSemaphore) Acquire() {
+	_ = s.AcquireContext(context.Background(), 1)
+}
+
+// Release releases a weight of 1 and satisfies sema.Semaphore
+func (s *WeightedSemaphore) Release() {
+	s.ReleaseWeight(1)
+}
+
+// Len returns the weight currently held and satisfies sema.Semaphore
+func (s *WeightedSemaphore) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return int(s.used)
+}
+
+// IsEmpty returns true when no weight is held and satisfies sema.Semaphore
+func (s *WeightedSemaphore) IsEmpty() bool {
+	return s.Len() == 0
+}
+
+// weightedSemaphore returns the WeightedSemaphore of identifier
+func (c *Cache) weightedSemaphore(identifier string) (*WeightedSemaphore, error) {
+	s, weighted := c.identifierSemaphore(identifier).(*WeightedSemaphore)
+	if !weighted {
+		return nil, ErrSemaphoreNotWeighted
+	}
+	return s, nil
+}
+
+// AcquireSemaphore acquires weight from the semaphore of identifier, waiting until ctx is done. The identifier's
+// mutex and semaphore stay in memory until ReleaseSemaphore is called.
+func (c *Cache) AcquireSemaphore(ctx context.Context, identifier string, weight int64) (err error) {
+	c.retain(identifier)
+	defer func() {
+		if err != nil {
+			c.release(identifier)
+		}
+	}()
+	s, sErr := c.weightedSemaphore(identifier)
+	if sErr != nil {
+		return sErr
+	}
+	return c.acquireWeight(ctx, false, s, weight)
+}
+
+// TryAcquireSemaphore acquires weight from the semaphore of identifier only when it is available right away
+func (c *Cache) TryAcquireSemaphore(identifier string, weight int64) bool {
+	c.retain(identifier)
+	s, sErr := c.weightedSemaphore(identifier)
+	if sErr != nil || !s.TryAcquire(weight) {
+		c.release(identifier)
+		return false
+	}
+	return true
+}
+
+// ReleaseSemaphore gives back weight acquired with AcquireSemaphore or TryAcquireSemaphore
+func (c *Cache) ReleaseSemaphore(identifier string, weight int64) {
+	s, sErr := c.weightedSemaphore(identifier)
+	if sErr != nil {
+		return
+	}
+	s.ReleaseWeight(weight)
+	c.release(identifier)
+}
+
+// SetSemaphoreLimit changes the concurrency limit of identifier at runtime and persists it to its .sema file
+func (c *Cache) SetSemaphoreLimit(identifier string, limit int64) error {
+	if limit < 1 {
+		return ErrSemaphoreLimit
+	}
+	writeErr := c.writeInt64File(identifier, ".sema", limit)
+	if writeErr != nil {
+		return writeErr
+	}
+	s, sErr := c.weightedSemaphore(identifier)
+	if sErr != nil {
+		return sErr
+	}
+	s.SetLimit(limit)
+	return nil
+}
+
+// SemaphoreStats returns the current holders and waiters of the semaphore of identifier
+func (c *Cache) SemaphoreStats(identifier string) (SemaphoreStats, error) {
+	s, sErr := c.weightedSemaphore(identifier)
+	if sErr != nil {
+		return SemaphoreStats{}, sErr
+	}
+	return s.Stats(), nil
+}
+
+// acquireWeight acquires weight from s while honoring ctx and the Cache's context. When try is set, ErrIdentifierLocked
+// is returned unless the weight is available right away.
+func (c *Cache) acquireWeight(ctx context.Context, try bool, s *WeightedSemaphore, weight int64) error {
+	if try {
+		if s.TryAcquire(weight) {
+			return nil
+		}
+		return ErrIdentifierLocked
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stop := context.AfterFunc(c.ctx, cancel)
+	defer stop()
+	acquireErr := s.AcquireContext(ctx, weight)
+	if acquireErr != nil && c.ctx.Err() != nil {
+		return c.ctx.Err()
+	}
+	return lockWaitErr(acquireErr)
+}
@@ -0,0 +1,105 @@
+package go_apario_identifier
+
+import (
+	`context`
+	`errors`
+	`log`
+	`os`
+	`testing`
+	`time`
+)
+
+func TestCache_SetSemaphoreLimit(t *testing.T) {
+	db, err := os.MkdirTemp("", "weighted.db")
+	if err != nil {
+		t.Errorf("os.MkdirTemp() received err %v", err)
+		return
+	}
+	defer func(path string) {
+		err := os.RemoveAll(path)
+		if err != nil {
+			log.Printf("os.RemoveAll(%v) returned err %v", path, err)
+		}
+	}(db)
+
+	cache, _ := NewValet(db).GetCache(db)
+	identifier := "2024WEIGHT"
+
+	err = cache.SetSemaphoreLimit(identifier, 3)
+	if err != nil {
+		t.Errorf("cache.SetSemaphoreLimit() returned err %v", err)
+		return
+	}
+	err = cache.AcquireSemaphore(context.Background(), identifier, 2)
+	if err != nil {
+		t.Errorf("cache.AcquireSemaphore() returned err %v", err)
+		return
+	}
+	if cache.TryAcquireSemaphore(identifier, 2) {
+		t.Errorf("expected TryAcquireSemaphore(2) to fail with 1 of 3 available")
+		return
+	}
+	if !cache.TryAcquireSemaphore(identifier, 1) {
+		t.Errorf("expected TryAcquireSemaphore(1) to succeed with 1 of 3 available")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	err = cache.AcquireSemaphore(ctx, identifier, 1)
+	cancel()
+	if !errors.Is(err, ErrLockTimeout) {
+		t.Errorf("expected ErrLockTimeout from a full semaphore ; got %v", err)
+		return
+	}
+
+	acquired := make(chan error, 1)
+	go func() {
+		acquired <- cache.AcquireSemaphore(context.Background(), identifier, 4)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	stats, statsErr := cache.SemaphoreStats(identifier)
+	if statsErr != nil || stats.Used != 3 || stats.Holders != 2 || stats.Waiters != 1 || stats.WaitingWeight != 4 {
+		t.Errorf("unexpected semaphore stats %+v and err %v", stats, statsErr)
+		return
+	}
+
+	// raising the limit at runtime lets the heavy waiter in once the holders are gone
+	err = cache.SetSemaphoreLimit(identifier, 4)
+	if err != nil {
+		t.Errorf("cache.SetSemaphoreLimit() returned err %v", err)
+		return
+	}
+	cache.ReleaseSemaphore(identifier, 2)
+	cache.ReleaseSemaphore(identifier, 1)
+	err = <-acquired
+	if err != nil {
+		t.Errorf("cache.AcquireSemaphore(4) returned err %v", err)
+		return
+	}
+	cache.ReleaseSemaphore(identifier, 4)
+
+	// the limit is persisted to .sema
+	reopened, _ := NewValet(db).GetCache(db)
+	stats, statsErr = reopened.SemaphoreStats(identifier)
+	if statsErr != nil || stats.Limit != 4 {
+		t.Errorf("expected the limit of 4 to be read back from .sema ; got %+v and err %v", stats, statsErr)
+		return
+	}
+
+	// Write leaves the limit of an existing semaphore alone and only seeds the semaphores created afterward
+	err = cache.Write(identifier, 2)
+	if err != nil {
+		t.Errorf("cache.Write() returned err %v", err)
+		return
+	}
+	stats, statsErr = cache.SemaphoreStats(identifier)
+	if statsErr != nil || stats.Limit != 4 {
+		t.Errorf("expected Write to keep the runtime limit of 4 ; got %+v and err %v", stats, statsErr)
+		return
+	}
+	reopened, _ = NewValet(db).GetCache(db)
+	stats, statsErr = reopened.SemaphoreStats(identifier)
+	if statsErr != nil || stats.Limit != 2 {
+		t.Errorf("expected a new semaphore to start at the limit of 2 ; got %+v and err %v", stats, statsErr)
+	}
+}